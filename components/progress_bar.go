@@ -0,0 +1,129 @@
+package components
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ansurfen/cushion/utils"
+
+	"github.com/charmbracelet/bubbles/progress"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+type ProgressBarStyle struct {
+	TitleStyle lipgloss.Style
+	Width      int
+}
+
+func DefaultProgressBarStyle() *ProgressBarStyle {
+	return &ProgressBarStyle{
+		TitleStyle: FontColor(lipgloss.Color("211")),
+		Width:      40,
+	}
+}
+
+// ProgressBarPayLoad is the task of progress bar, and Callback reports percent in [0, 1],
+// such as DownloadProgress.Percent of utils.Download.
+// ctx of Callback is cancelled when user quits the progress bar.
+type ProgressBarPayLoad struct {
+	Title    string
+	Callback func(ctx context.Context, report func(percent float64)) error
+}
+
+type progressMsg float64
+
+type progressDoneMsg struct{}
+
+type progressBar struct {
+	title    string
+	progress progress.Model
+	style    *ProgressBarStyle
+	quitting bool
+}
+
+func (m *progressBar) Init() tea.Cmd {
+	return nil
+}
+
+func (m *progressBar) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case KeyQ, KeyESC, KeyCtrlC:
+			m.quitting = true
+			return m, tea.Quit
+		}
+	case progressMsg:
+		return m, m.progress.SetPercent(float64(msg))
+	case progressDoneMsg:
+		m.quitting = true
+		return m, tea.Quit
+	case progress.FrameMsg:
+		newModel, cmd := m.progress.Update(msg)
+		if newModel, ok := newModel.(progress.Model); ok {
+			m.progress = newModel
+		}
+		return m, cmd
+	}
+	return m, nil
+}
+
+func (m *progressBar) View() string {
+	if m.quitting {
+		return ""
+	}
+	return fmt.Sprintf("\n  %s\n  %s\n\n", m.style.TitleStyle.Render(m.title), m.progress.View())
+}
+
+// UseProgressBar to show progress of callback until it returns, and returns the error of callback.
+// The callback is cancelled and context.Canceled is returned when user quits the progress bar.
+func UseProgressBar(style *ProgressBarStyle, payload *ProgressBarPayLoad) error {
+	pb := &progressBar{
+		title:    payload.Title,
+		progress: progress.New(progress.WithDefaultGradient(), progress.WithWidth(style.Width)),
+		style:    style,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := tea.NewProgram(pb)
+	done := make(chan error, 1)
+	go func() {
+		done <- payload.Callback(ctx, func(percent float64) {
+			if ctx.Err() == nil {
+				p.Send(progressMsg(percent))
+			}
+		})
+		p.Send(progressDoneMsg{})
+	}()
+	_, err := p.Run()
+	cancel()
+	// wait for callback, so that it doesn't outlive the progress bar
+	cbErr := <-done
+	if err != nil {
+		return err
+	}
+	return cbErr
+}
+
+// UseDownloadProgressBar to download url into dst with progress bar,
+// and the download is cancelled when user quits the progress bar.
+func UseDownloadProgressBar(style *ProgressBarStyle, title, url, dst string, opt utils.DownloadOpt) (*utils.DownloadResult, error) {
+	var res *utils.DownloadResult
+	err := UseProgressBar(style, &ProgressBarPayLoad{
+		Title: title,
+		Callback: func(ctx context.Context, report func(float64)) error {
+			progress := opt.Progress
+			opt.Progress = func(p utils.DownloadProgress) {
+				if progress != nil {
+					progress(p)
+				}
+				report(p.Percent())
+			}
+			var err error
+			res, err = utils.Download(ctx, url, dst, opt)
+			return err
+		},
+	})
+	return res, err
+}
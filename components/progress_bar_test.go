@@ -0,0 +1,20 @@
+package components
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProgressBar(t *testing.T) {
+	UseProgressBar(DefaultProgressBarStyle(), &ProgressBarPayLoad{
+		Title: "Downloading",
+		Callback: func(ctx context.Context, report func(float64)) error {
+			for i := 0; i <= 10; i++ {
+				report(float64(i) / 10)
+				time.Sleep(100 * time.Millisecond)
+			}
+			return nil
+		},
+	})
+}
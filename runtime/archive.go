@@ -0,0 +1,83 @@
+package runtime
+
+import (
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// archiveOpt is the option of cushion-archive
+type archiveOpt struct {
+	// Format is zip, tar, tar.gz or tar.bz2, which is inferred by extension when it's empty
+	Format          string   `lua:"format"`
+	StripComponents int      `lua:"strip_components"`
+	Include         []string `lua:"include"`
+	Exclude         []string `lua:"exclude"`
+}
+
+func loadArchive(lvm *lua.LState) int {
+	return LuaModuleLoader(lvm, LuaFuncs{
+		"extract": archiveExtract,
+		"create":  archiveCreate,
+		"list":    archiveList,
+		"detect":  archiveDetect,
+	})
+}
+
+// checkArchiveOpt decodes option at n, and raises error when it's invalid
+func checkArchiveOpt(lvm *lua.LState, n int) utils.ArchiveOpt {
+	opt := archiveOpt{}
+	if tbl := lvm.OptTable(n, nil); tbl != nil {
+		if err := DecodeWithPath("opt", tbl, &opt); err != nil {
+			raiseError(lvm, err)
+		}
+	}
+	return utils.ArchiveOpt{
+		Format:          utils.ArchiveFormat(opt.Format),
+		StripComponents: opt.StripComponents,
+		Include:         opt.Include,
+		Exclude:         opt.Exclude,
+	}
+}
+
+// archiveExtract to extract zip, tar, tar.gz or tar.bz2 detected by magic bytes,
+// and entries escaping destination are rejected.
+//
+//	local err = archive.extract("go.tar.gz", "sdk", { strip_components = 1, exclude = { "*_test.go" } })
+func archiveExtract(lvm *lua.LState) int {
+	src, dst := lvm.CheckString(1), lvm.CheckString(2)
+	errHandle(lvm, utils.Extract(src, dst, checkArchiveOpt(lvm, 3)))
+	return 1
+}
+
+// archiveCreate to create archive of path or array of paths, and tar.bz2 isn't supported
+//
+//	local err = archive.create("dist/app.tar.gz", { "bin", "README.md" })
+func archiveCreate(lvm *lua.LState) int {
+	dst := lvm.CheckString(1)
+	paths := []string{}
+	switch v := lvm.CheckAny(2).(type) {
+	case lua.LString:
+		paths = append(paths, string(v))
+	case *lua.LTable:
+		for i := 1; i <= v.Len(); i++ {
+			paths = append(paths, v.RawGetInt(i).String())
+		}
+	default:
+		lvm.ArgError(2, "path or array of paths expected")
+	}
+	errHandle(lvm, utils.CreateArchive(dst, paths, checkArchiveOpt(lvm, 3)))
+	return 1
+}
+
+// archiveList returns names of entries matching include and exclude of option
+func archiveList(lvm *lua.LState) int {
+	names, err := utils.ListArchive(lvm.CheckString(1), checkArchiveOpt(lvm, 2))
+	return fsResult(lvm, strSlice2Table(names), err)
+}
+
+// archiveDetect returns format of archive by magic bytes
+func archiveDetect(lvm *lua.LState) int {
+	format, err := utils.DetectArchive(lvm.CheckString(1))
+	return fsResult(lvm, lua.LString(format), err)
+}
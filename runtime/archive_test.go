@@ -0,0 +1,37 @@
+package runtime
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestArchive(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	vm.SetGlobalVar("root", lua.LString(t.TempDir()))
+	err := vm.Eval(`
+Import({"cushion-fs", "cushion-archive"})
+local fs = require("cushion-fs")
+local archive = require("cushion-archive")
+assert(fs.write(root .. "/app/bin/main.lua", "print(1)") == nil)
+assert(fs.write(root .. "/app/debug.log", "log") == nil)
+
+assert(archive.create(root .. "/app.tar.gz", { root .. "/app" }, { exclude = { "*.log" } }) == nil)
+assert(archive.detect(root .. "/app.tar.gz") == "tar.gz")
+local names = archive.list(root .. "/app.tar.gz", { include = { "**/*.lua" } })
+assert(#names == 1 and names[1] == "app/bin/main.lua", names[1])
+
+assert(archive.extract(root .. "/app.tar.gz", root .. "/out", { strip_components = 1 }) == nil)
+assert(fs.read(root .. "/out/bin/main.lua") == "print(1)")
+assert(not fs.exists(root .. "/out/debug.log"))
+
+assert(archive.create(root .. "/app.zip", root .. "/app") == nil)
+assert(archive.detect(root .. "/app.zip") == "zip")
+local _, err = archive.detect(root .. "/app/bin/main.lua")
+assert(err ~= nil)
+assert(archive.create(root .. "/app.tar.bz2", root .. "/app") ~= nil)
+assert(not pcall(archive.extract, root .. "/app.zip", root .. "/out", { strip_components = "1" }))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
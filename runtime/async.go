@@ -0,0 +1,582 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// eventLoop is the single-threaded loop of vm, which runs callbacks posted by goroutines
+// on the goroutine of vm, so that coroutines awaiting promises are resumed safely.
+type eventLoop struct {
+	vm *LuaVM
+
+	mutex  sync.Mutex
+	posted []func()
+	notify chan struct{}
+
+	// the following fields are only accessed by the goroutine of vm
+	pending   int
+	tasks     map[*lua.LState]*asyncTask
+	timers    map[int]*time.Timer
+	nextTimer int
+	errs      []error
+}
+
+// asyncTask is the coroutine started by cushion-async.run or set_timeout
+type asyncTask struct {
+	promise *luaPromise
+	cancel  context.CancelFunc
+}
+
+func newEventLoop(vm *LuaVM) *eventLoop {
+	return &eventLoop{
+		vm:     vm,
+		notify: make(chan struct{}, 1),
+		tasks:  make(map[*lua.LState]*asyncTask),
+		timers: make(map[int]*time.Timer),
+	}
+}
+
+// post to run fn on the goroutine of vm, which is safe to be called by any goroutine
+func (loop *eventLoop) post(fn func()) {
+	loop.mutex.Lock()
+	loop.posted = append(loop.posted, fn)
+	loop.mutex.Unlock()
+	select {
+	case loop.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (loop *eventLoop) take() []func() {
+	loop.mutex.Lock()
+	defer loop.mutex.Unlock()
+	fns := loop.posted
+	loop.posted = nil
+	return fns
+}
+
+// idle returns whether there are no callbacks and operations in progress
+func (loop *eventLoop) idle() bool {
+	loop.mutex.Lock()
+	defer loop.mutex.Unlock()
+	return len(loop.posted) == 0 && loop.pending == 0
+}
+
+// runOnce waits until callbacks are posted, and runs them in order
+func (loop *eventLoop) runOnce(ctx context.Context) error {
+	fns := loop.take()
+	for len(fns) == 0 {
+		if loop.pending == 0 {
+			return errors.New("async: event loop is idle")
+		}
+		select {
+		case <-loop.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		fns = loop.take()
+	}
+	for _, fn := range fns {
+		fn()
+	}
+	return nil
+}
+
+// run to run callbacks until loop is idle, and it returns errors of tasks started by set_timeout
+func (loop *eventLoop) run(ctx context.Context) error {
+	for !loop.idle() {
+		if err := loop.runOnce(ctx); err != nil {
+			return err
+		}
+	}
+	errs := loop.errs
+	loop.errs = nil
+	return errors.Join(errs...)
+}
+
+// spawn to run fn as coroutine on next tick, and the returned promise is settled by its results
+func (loop *eventLoop) spawn(fn *lua.LFunction, args []lua.LValue) *luaPromise {
+	p := newPromise(loop)
+	loop.post(func() {
+		co, cancel := loop.vm.state.NewThread()
+		attachThread(loop.vm.state, co)
+		loop.tasks[co] = &asyncTask{promise: p, cancel: cancel}
+		loop.resume(co, fn, args...)
+	})
+	return p
+}
+
+// resume to run coroutine until it yields or dies
+func (loop *eventLoop) resume(co *lua.LState, fn *lua.LFunction, args ...lua.LValue) {
+	task := loop.tasks[co]
+	st, err, values := loop.vm.state.Resume(co, fn, args...)
+	switch st {
+	case lua.ResumeYield:
+		return
+	case lua.ResumeOK:
+		task.promise.resolve(values...)
+	case lua.ResumeError:
+		task.promise.reject(asyncReason(err))
+	}
+	delete(loop.tasks, co)
+	if task.cancel != nil {
+		task.cancel()
+	}
+}
+
+// async runs work on goroutine, and the returned promise is settled on the goroutine of vm
+func (loop *eventLoop) async(work func() (any, error)) *luaPromise {
+	p := newPromise(loop)
+	loop.pending++
+	go func() {
+		v, err := work()
+		loop.post(func() {
+			loop.pending--
+			if err != nil {
+				p.reject(lua.LString(err.Error()))
+				return
+			}
+			lv, err := Encode(loop.vm.state, v)
+			if err != nil {
+				p.reject(lua.LString(err.Error()))
+				return
+			}
+			p.resolve(lv)
+		})
+	}()
+	return p
+}
+
+// delay returns promise which is resolved after d
+func (loop *eventLoop) delay(d time.Duration) *luaPromise {
+	p := newPromise(loop)
+	loop.setTimer(d, func() { p.resolve() })
+	return p
+}
+
+func (loop *eventLoop) setTimer(d time.Duration, fn func()) int {
+	loop.nextTimer++
+	id := loop.nextTimer
+	loop.pending++
+	loop.timers[id] = time.AfterFunc(d, func() {
+		loop.post(func() {
+			if _, ok := loop.timers[id]; !ok {
+				return
+			}
+			delete(loop.timers, id)
+			loop.pending--
+			fn()
+		})
+	})
+	return id
+}
+
+// stop to cancel tasks and timers, and the loop shouldn't be used after stopped
+func (loop *eventLoop) stop() {
+	for _, task := range loop.tasks {
+		if task.cancel != nil {
+			task.cancel()
+		}
+	}
+	for _, timer := range loop.timers {
+		timer.Stop()
+	}
+}
+
+func (loop *eventLoop) clearTimer(id int) {
+	if timer, ok := loop.timers[id]; ok {
+		timer.Stop()
+		delete(loop.timers, id)
+		loop.pending--
+	}
+}
+
+// asyncReason returns the lua value raised by error
+func asyncReason(err error) lua.LValue {
+	if apiErr, ok := err.(*lua.ApiError); ok && apiErr.Object != nil {
+		return apiErr.Object
+	}
+	return lua.LString(err.Error())
+}
+
+const (
+	promisePending = iota
+	promiseFulfilled
+	promiseRejected
+)
+
+// luaPromise is the result of async operation, which is settled only once.
+// Callbacks are always run on next tick of loop, even if promise has been settled.
+type luaPromise struct {
+	loop      *eventLoop
+	state     int
+	values    []lua.LValue
+	reason    lua.LValue
+	callbacks []func(*luaPromise)
+}
+
+func newPromise(loop *eventLoop) *luaPromise {
+	return &luaPromise{loop: loop}
+}
+
+func (p *luaPromise) resolve(values ...lua.LValue) {
+	p.settle(promiseFulfilled, values, lua.LNil)
+}
+
+func (p *luaPromise) reject(reason lua.LValue) {
+	p.settle(promiseRejected, nil, reason)
+}
+
+func (p *luaPromise) settle(state int, values []lua.LValue, reason lua.LValue) {
+	if p.state != promisePending {
+		return
+	}
+	p.state, p.values, p.reason = state, values, reason
+	for _, cb := range p.callbacks {
+		cb := cb
+		p.loop.post(func() { cb(p) })
+	}
+	p.callbacks = nil
+}
+
+func (p *luaPromise) then(cb func(*luaPromise)) {
+	if p.state == promisePending {
+		p.callbacks = append(p.callbacks, cb)
+		return
+	}
+	p.loop.post(func() { cb(p) })
+}
+
+// results returns true with values when promise is fulfilled, otherwise false with reason
+func (p *luaPromise) results() []lua.LValue {
+	if p.state == promiseRejected {
+		return []lua.LValue{lua.LFalse, p.reason}
+	}
+	return append([]lua.LValue{lua.LTrue}, p.values...)
+}
+
+func (p *luaPromise) status() string {
+	switch p.state {
+	case promiseFulfilled:
+		return "fulfilled"
+	case promiseRejected:
+		return "rejected"
+	}
+	return "pending"
+}
+
+const promiseTypeName = "cushion-async.promise"
+
+// Go runs work on goroutine, and returns promise for cushion-async, which is settled with its result.
+// The result is encoded as lua value by Encode, and error rejects the promise with its message.
+func (vm *LuaVM) Go(work func() (any, error)) lua.LValue {
+	return vm.promiseValue(vm.state, vm.loop.async(work))
+}
+
+// RunLoop to run event loop until all tasks, timers and async operations are finished.
+// It returns errors raised by tasks of set_timeout, which aren't awaited by anyone.
+func (vm *LuaVM) RunLoop(ctx context.Context) error {
+	return vm.exec(ctx, func() error {
+		return vm.loop.run(vm.loopContext(ctx))
+	})
+}
+
+// loopContext returns the context to wait for callbacks, and hooks aren't run when waiting
+func (vm *LuaVM) loopContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = vm.state.Context()
+	}
+	if sctx, ok := ctx.(*stepContext); ok {
+		ctx = sctx.hctx.Context
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return ctx
+}
+
+func (vm *LuaVM) promiseValue(lvm *lua.LState, p *luaPromise) *lua.LUserData {
+	ud := lvm.NewUserData()
+	ud.Value = p
+	lvm.SetMetatable(ud, promiseMeta(lvm))
+	return ud
+}
+
+// promiseMeta returns metatable of promise, and await method is added when cushion-async is loaded
+func promiseMeta(lvm *lua.LState) *lua.LTable {
+	if meta, ok := lvm.GetTypeMetatable(promiseTypeName).(*lua.LTable); ok {
+		return meta
+	}
+	meta := lvm.NewTypeMetatable(promiseTypeName)
+	meta.RawSetString("__index", lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+		"status": asyncStatus,
+	}))
+	return meta
+}
+
+func checkPromise(lvm *lua.LState, n int) *luaPromise {
+	if ud, ok := lvm.Get(n).(*lua.LUserData); ok {
+		if p, ok := ud.Value.(*luaPromise); ok {
+			return p
+		}
+	}
+	lvm.ArgError(n, "promise expected")
+	return nil
+}
+
+// asyncPrelude defines functions raising error of rejected promise in lua,
+// because the results of yielding go function are returned to caller directly.
+const asyncPrelude = `
+local async, raw_await = ...
+local function check(ok, ...)
+	if not ok then
+		-- the level of gopher-lua counts error itself, so that 4 is the caller of await
+		error((...), 4)
+	end
+	return ...
+end
+function async.await(p)
+	local ret = { check(raw_await(p)) }
+	return unpack(ret, 1, #ret)
+end
+function async.sleep(ms)
+	return async.await(async.delay(ms))
+end
+return async
+`
+
+// loadAsync returns the loader of cushion-async
+func loadAsync(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		mod := lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+			"run":           asyncRun(vm),
+			"all":           asyncAll(vm),
+			"race":          asyncRace(vm),
+			"delay":         asyncDelay(vm),
+			"set_timeout":   asyncSetTimeout(vm),
+			"clear_timeout": asyncClearTimeout(vm),
+			"loop":          asyncLoop(vm),
+			"status":        asyncStatus,
+			"fetch":         asyncFetch(vm),
+			"unzip":         asyncUnzip(vm),
+			"exec":          asyncExec(vm),
+		})
+		fn, err := lvm.Load(strings.NewReader(asyncPrelude), "<cushion-async>")
+		if err != nil {
+			raiseError(lvm, err)
+		}
+		lvm.Push(fn)
+		lvm.Push(mod)
+		lvm.Push(lvm.NewFunction(asyncAwait(vm)))
+		lvm.Call(2, 1)
+		lvm.SetField(promiseMeta(lvm).RawGetString("__index"), "await", mod.RawGetString("await"))
+		return 1
+	}
+}
+
+// asyncAwait returns true with values of fulfilled promise, or false with reason.
+// The coroutine of task is yielded until promise is settled, and the main thread runs
+// event loop instead, because it isn't able to be yielded.
+func asyncAwait(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		p := checkPromise(lvm, 1)
+		if p.state == promisePending {
+			if _, ok := vm.loop.tasks[lvm]; ok {
+				p.then(func(p *luaPromise) {
+					vm.loop.resume(lvm, nil, p.results()...)
+				})
+				return lvm.Yield()
+			}
+			if lvm != vm.state {
+				raiseError(lvm, errors.New("await should be called in main thread or task of cushion-async.run"))
+			}
+			ctx := vm.loopContext(nil)
+			for p.state == promisePending {
+				if err := vm.loop.runOnce(ctx); err != nil {
+					raiseError(lvm, fmt.Errorf("await: %w", err))
+				}
+			}
+		}
+		results := p.results()
+		for _, v := range results {
+			lvm.Push(v)
+		}
+		return len(results)
+	}
+}
+
+func asyncRun(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		fn := lvm.CheckFunction(1)
+		args := []lua.LValue{}
+		for i := 2; i <= lvm.GetTop(); i++ {
+			args = append(args, lvm.Get(i))
+		}
+		lvm.Push(vm.promiseValue(lvm, vm.loop.spawn(fn, args)))
+		return 1
+	}
+}
+
+// checkPromises returns promises of list, and other values are regarded as fulfilled promises
+func checkPromises(vm *LuaVM, lvm *lua.LState) []*luaPromise {
+	promises := []*luaPromise{}
+	list := lvm.CheckTable(1)
+	for i := 1; i <= list.Len(); i++ {
+		v := list.RawGetInt(i)
+		if ud, ok := v.(*lua.LUserData); ok {
+			if p, ok := ud.Value.(*luaPromise); ok {
+				promises = append(promises, p)
+				continue
+			}
+		}
+		p := newPromise(vm.loop)
+		p.resolve(v)
+		promises = append(promises, p)
+	}
+	return promises
+}
+
+// asyncAll returns promise which is fulfilled with list of first values when all promises are fulfilled,
+// and it's rejected by the first rejected promise.
+func asyncAll(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		promises := checkPromises(vm, lvm)
+		all := newPromise(vm.loop)
+		results := lvm.CreateTable(len(promises), 0)
+		left := len(promises)
+		if left == 0 {
+			all.resolve(results)
+		}
+		for i, p := range promises {
+			i := i
+			p.then(func(p *luaPromise) {
+				if p.state == promiseRejected {
+					all.reject(p.reason)
+					return
+				}
+				var v lua.LValue = lua.LNil
+				if len(p.values) > 0 {
+					v = p.values[0]
+				}
+				results.RawSetInt(i+1, v)
+				if left--; left == 0 {
+					all.resolve(results)
+				}
+			})
+		}
+		lvm.Push(vm.promiseValue(lvm, all))
+		return 1
+	}
+}
+
+// asyncRace returns promise which is settled as the first settled promise
+func asyncRace(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		race := newPromise(vm.loop)
+		for _, p := range checkPromises(vm, lvm) {
+			p.then(func(p *luaPromise) {
+				race.settle(p.state, p.values, p.reason)
+			})
+		}
+		lvm.Push(vm.promiseValue(lvm, race))
+		return 1
+	}
+}
+
+func asyncDelay(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		d := time.Duration(float64(lvm.CheckNumber(1)) * float64(time.Millisecond))
+		lvm.Push(vm.promiseValue(lvm, vm.loop.delay(d)))
+		return 1
+	}
+}
+
+// asyncSetTimeout runs function as task after ms, and returns id of timer.
+// The error of task is returned by RunLoop or raised by loop.
+func asyncSetTimeout(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		fn := lvm.CheckFunction(1)
+		d := time.Duration(float64(lvm.CheckNumber(2)) * float64(time.Millisecond))
+		args := []lua.LValue{}
+		for i := 3; i <= lvm.GetTop(); i++ {
+			args = append(args, lvm.Get(i))
+		}
+		id := vm.loop.setTimer(d, func() {
+			vm.loop.spawn(fn, args).then(func(p *luaPromise) {
+				if p.state == promiseRejected {
+					vm.loop.errs = append(vm.loop.errs, fmt.Errorf("async: set_timeout: %s", p.reason))
+				}
+			})
+		})
+		lvm.Push(lua.LNumber(id))
+		return 1
+	}
+}
+
+func asyncClearTimeout(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		vm.loop.clearTimer(lvm.CheckInt(1))
+		return 0
+	}
+}
+
+// asyncLoop runs event loop until it's idle, which only could be called in main thread
+func asyncLoop(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		if lvm != vm.state {
+			raiseError(lvm, errors.New("loop should be called in main thread"))
+		}
+		if err := vm.loop.run(vm.loopContext(nil)); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+func asyncStatus(lvm *lua.LState) int {
+	lvm.Push(lua.LString(checkPromise(lvm, 1).status()))
+	return 1
+}
+
+func asyncFetch(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		url, dst := lvm.CheckString(1), lvm.CheckString(2)
+		// progress isn't reported, because download runs on other goroutine
+		opt := checkDownloadOpt(lvm, 3, false)
+		lvm.Push(vm.promiseValue(lvm, vm.loop.async(func() (any, error) {
+			_, err := utils.Download(context.Background(), url, dst, opt)
+			return dst, err
+		})))
+		return 1
+	}
+}
+
+func asyncUnzip(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		src, dst := lvm.CheckString(1), lvm.CheckString(2)
+		lvm.Push(vm.promiseValue(lvm, vm.loop.async(func() (any, error) {
+			return dst, utils.Unzip(src, dst)
+		})))
+		return 1
+	}
+}
+
+func asyncExec(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		cmd := lvm.CheckString(1)
+		lvm.Push(vm.promiseValue(lvm, vm.loop.async(func() (any, error) {
+			out, err := utils.ExecStr(cmd)
+			return utils.ConvertByte2String(out, shellCharset()), err
+		})))
+		return 1
+	}
+}
@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestAsync(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	vm.SetGlobalVar("slow", vm.Interp().NewFunction(func(lvm *LuaInterp) int {
+		d := time.Duration(lvm.CheckInt(1)) * time.Millisecond
+		lvm.Push(vm.Go(func() (any, error) {
+			time.Sleep(d)
+			return map[string]any{"waited": d.Milliseconds()}, nil
+		}))
+		return 1
+	}))
+	start := time.Now()
+	err := vm.Eval(`
+Import({"cushion-async"})
+local async = require("cushion-async")
+local order = {}
+local function job(name, ms)
+	async.sleep(ms)
+	table.insert(order, name)
+	return name
+end
+local results = async.await(async.all({ async.run(job, "b", 60), async.run(job, "a", 30), slow(50) }))
+assert(results[1] == "b" and results[2] == "a" and results[3].waited == 50)
+assert(table.concat(order, ",") == "a,b")
+assert(async.await(async.race({ async.delay(80), async.run(job, "c", 10) })) == "c")
+
+local failed = async.run(function() async.sleep(5) error("boom") end)
+local ok, err = pcall(function() failed:await() end)
+assert(not ok and err:find("^<string>:16:") and err:find("boom") and failed:status() == "rejected")
+
+Fired = false
+async.set_timeout(function() Fired = true end, 10)
+local id = async.set_timeout(function() error("cancelled timer fires") end, 10)
+async.clear_timeout(id)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if vm.GetGlobalVar("Fired") != lua.LTrue {
+		t.Fatal("timer isn't fired")
+	}
+	// jobs run concurrently, so that it takes about the longest one rather than their sum
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("async jobs are too slow: %s", elapsed)
+	}
+}
@@ -0,0 +1,208 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Budget limits the resource which could be consumed by a single Eval or Call.
+// Zero value of field means unlimited or default.
+type Budget struct {
+	// MaxInstructions is the max count of instructions to be executed
+	MaxInstructions int64
+	// RegistrySize is the initial size of registry (data stack), it defaults to lua.RegistrySize
+	RegistrySize int
+	// RegistryMaxSize allows registry to grow up to it, and registry can't grow when it's less than RegistrySize
+	RegistryMaxSize int
+	// CallStackSize is the max depth of call stack, it defaults to lua.CallStackSize
+	CallStackSize int
+	// MaxTables is the soft limit of tables which are reachable from globals, registry and stack
+	MaxTables int
+	// MaxStrings is the soft limit of distinct strings which are reachable from globals, registry and stack
+	MaxStrings int
+	// CheckInterval is how many instructions to count tables and strings once, it defaults to 1000
+	CheckInterval int64
+}
+
+const (
+	BudgetInstructions = "instructions"
+	BudgetRegistry     = "registry"
+	BudgetCallStack    = "callstack"
+	BudgetTables       = "tables"
+	BudgetStrings      = "strings"
+)
+
+// BudgetExceededError is returned when the execution exceeds the limit of Budget
+type BudgetExceededError struct {
+	// Resource is the name of exceeded limit, such as instructions, registry, callstack, tables and strings
+	Resource string
+	Limit    int64
+	// Used is the amount to be used when execution is aborted, and it's zero when it can't be counted.
+	Used int64
+}
+
+func (err *BudgetExceededError) Error() string {
+	if err.Used == 0 {
+		return fmt.Sprintf("budget exceeded: %s exceeds limit %d", err.Resource, err.Limit)
+	}
+	return fmt.Sprintf("budget exceeded: %s used %d, limit %d", err.Resource, err.Used, err.Limit)
+}
+
+func (budget *Budget) apply(opt *lua.Options) {
+	if budget.RegistrySize > 0 {
+		opt.RegistrySize = budget.RegistrySize
+	}
+	if budget.RegistryMaxSize > 0 {
+		opt.RegistryMaxSize = budget.RegistryMaxSize
+	}
+	if budget.CallStackSize > 0 {
+		opt.CallStackSize = budget.CallStackSize
+	}
+}
+
+// convert turns the overflow error of gopher-lua into BudgetExceededError
+func (budget *Budget) convert(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*BudgetExceededError); ok {
+		return err
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "registry overflow"):
+		limit := budget.RegistryMaxSize
+		if limit < budget.RegistrySize || limit == 0 {
+			limit = budget.RegistrySize
+		}
+		if limit == 0 {
+			limit = lua.RegistrySize
+		}
+		return &BudgetExceededError{Resource: BudgetRegistry, Limit: int64(limit)}
+	case strings.Contains(msg, "stack overflow"):
+		limit := budget.CallStackSize
+		if limit == 0 {
+			limit = lua.CallStackSize
+		}
+		return &BudgetExceededError{Resource: BudgetCallStack, Limit: int64(limit)}
+	}
+	return err
+}
+
+var _ vmHook = &budgetHook{}
+
+type budgetHook struct {
+	budget       *Budget
+	instructions int64
+}
+
+func newBudgetHook(budget *Budget) *budgetHook {
+	return &budgetHook{budget: budget}
+}
+
+func (hook *budgetHook) begin() {
+	hook.instructions = 0
+}
+
+func (hook *budgetHook) step(state *lua.LState) error {
+	hook.instructions++
+	budget := hook.budget
+	if budget.MaxInstructions > 0 && hook.instructions > budget.MaxInstructions {
+		return &BudgetExceededError{Resource: BudgetInstructions, Limit: budget.MaxInstructions, Used: hook.instructions}
+	}
+	if budget.MaxTables == 0 && budget.MaxStrings == 0 {
+		return nil
+	}
+	interval := budget.CheckInterval
+	if interval <= 0 {
+		interval = 1000
+	}
+	if hook.instructions%interval != 0 {
+		return nil
+	}
+	walker := newBudgetWalker()
+	walker.walkState(state)
+	if budget.MaxTables > 0 && len(walker.tables) > budget.MaxTables {
+		return &BudgetExceededError{Resource: BudgetTables, Limit: int64(budget.MaxTables), Used: int64(len(walker.tables))}
+	}
+	if budget.MaxStrings > 0 && len(walker.strings) > budget.MaxStrings {
+		return &BudgetExceededError{Resource: BudgetStrings, Limit: int64(budget.MaxStrings), Used: int64(len(walker.strings))}
+	}
+	return nil
+}
+
+// budgetWalker counts the tables and strings which are reachable
+type budgetWalker struct {
+	tables  map[*lua.LTable]struct{}
+	funcs   map[*lua.LFunction]struct{}
+	strings map[lua.LString]struct{}
+}
+
+func newBudgetWalker() *budgetWalker {
+	return &budgetWalker{
+		tables:  make(map[*lua.LTable]struct{}),
+		funcs:   make(map[*lua.LFunction]struct{}),
+		strings: make(map[lua.LString]struct{}),
+	}
+}
+
+func (walker *budgetWalker) walkState(state *lua.LState) {
+	walker.walk(state.G.Global)
+	walker.walk(state.G.Registry)
+	for level := 0; ; level++ {
+		dbg, ok := state.GetStack(level)
+		if !ok {
+			break
+		}
+		for i := 1; ; i++ {
+			name, v := state.GetLocal(dbg, i)
+			if len(name) == 0 {
+				break
+			}
+			walker.walk(v)
+		}
+	}
+	for i := 1; i <= state.GetTop(); i++ {
+		walker.walk(state.Get(i))
+	}
+}
+
+func (walker *budgetWalker) walk(v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		walker.strings[v] = struct{}{}
+	case *lua.LTable:
+		if v == nil {
+			return
+		}
+		if _, ok := walker.tables[v]; ok {
+			return
+		}
+		walker.tables[v] = struct{}{}
+		walker.walk(v.Metatable)
+		v.ForEach(func(k, v lua.LValue) {
+			walker.walk(k)
+			walker.walk(v)
+		})
+	case *lua.LFunction:
+		if v == nil {
+			return
+		}
+		if _, ok := walker.funcs[v]; ok {
+			return
+		}
+		walker.funcs[v] = struct{}{}
+		walker.walk(v.Env)
+		for _, uv := range v.Upvalues {
+			walker.walk(uv.Value())
+		}
+	case *lua.LUserData:
+		if v == nil {
+			return
+		}
+		walker.walk(v.Metatable)
+		walker.walk(v.Env)
+	}
+}
@@ -0,0 +1,43 @@
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBudget(t *testing.T) {
+	testDataset := map[string]struct {
+		budget   Budget
+		script   string
+		resource string
+	}{
+		"instructions": {Budget{MaxInstructions: 10000}, `while true do end`, BudgetInstructions},
+		"pcall":        {Budget{MaxInstructions: 10000}, `while true do pcall(function() while true do end end) end`, BudgetInstructions},
+		"coroutine":    {Budget{MaxInstructions: 10000}, `coroutine.wrap(function() local i = 0 while i < 5e7 do i = i + 1 end end)()`, BudgetInstructions},
+		"create":       {Budget{MaxInstructions: 10000}, `local co = coroutine.create(function() while true do coroutine.yield() end end) while true do coroutine.resume(co) end`, BudgetInstructions},
+		"callstack":    {Budget{CallStackSize: 64}, `local function f() return 1 + f() end f()`, BudgetCallStack},
+		"tables":       {Budget{MaxTables: 500, CheckInterval: 100}, `t = {} for i = 1, 100000 do t[i] = {} end`, BudgetTables},
+		"strings":      {Budget{MaxStrings: 500, CheckInterval: 100}, `t = {} for i = 1, 100000 do t[i] = "s" .. i end`, BudgetStrings},
+		"unlimited":    {Budget{MaxInstructions: 10000}, `local a = 0 for i = 1, 100 do a = a + i end`, ""},
+	}
+	for name, data := range testDataset {
+		budget := data.budget
+		vm := NewVirtualMachineWithOpt(LuaVMOpt{Budget: &budget}).Default()
+		err := vm.Eval(data.script)
+		if len(data.resource) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		exceeded := &BudgetExceededError{}
+		if !errors.As(err, &exceeded) || exceeded.Resource != data.resource {
+			t.Errorf("%s: want %s exceeded, got %v", name, data.resource, err)
+			continue
+		}
+		// budget is reset for every Eval
+		if err := vm.Eval(`ok = true`); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package runtime
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	godebug "runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// ErrUnsupportedScript is returned when the extension of script file isn't .lua
+var ErrUnsupportedScript = errors.New("unsupported script")
+
+var defaultCompileCache = NewCompileCache("")
+
+// DefaultCompileCache returns the in-memory CompileCache shared by virtual machines in process
+func DefaultCompileCache() *CompileCache {
+	return defaultCompileCache
+}
+
+// CompileCacheDir returns the default directory to persist compiled scripts, which is located in workdir.
+func CompileCacheDir() string {
+	return path.Join(utils.GetEnv().Workdir(), "cache", "lua")
+}
+
+// compileCacheVersion should be increased when protoDump is changed
+const compileCacheVersion = 1
+
+// compileCacheSalt is mixed into hash of script, so that protos persisted by
+// other format of cache or version of gopher-lua aren't loaded.
+var compileCacheSalt = func() string {
+	version := lua.PackageVersion
+	if info, ok := godebug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/yuin/gopher-lua" {
+				version = dep.Version
+				if dep.Replace != nil {
+					version = dep.Replace.Path + "@" + dep.Replace.Version
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("cushion-luac/%d gopher-lua/%s", compileCacheVersion, version)
+}()
+
+// CompileCache stores FunctionProto compiled from script file in memory,
+// which is keyed by path, size, modified time and content hash of file.
+// When dir isn't empty, serialized proto also is persisted in dir
+// so that it's able to be reused between different processes.
+type CompileCache struct {
+	dir    string
+	mutex  sync.RWMutex
+	protos map[string]*compiledProto
+}
+
+type compiledProto struct {
+	size  int64
+	mtime time.Time
+	hash  string
+	proto *lua.FunctionProto
+}
+
+func NewCompileCache(dir string) *CompileCache {
+	return &CompileCache{
+		dir:    dir,
+		protos: make(map[string]*compiledProto),
+	}
+}
+
+// Compile returns FunctionProto of file, which only is compiled when file is changed.
+func (cache *CompileCache) Compile(fullpath string) (*lua.FunctionProto, error) {
+	if ext := path.Ext(fullpath); ext != ".lua" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScript, fullpath)
+	}
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.RLock()
+	cp, ok := cache.protos[fullpath]
+	cache.mutex.RUnlock()
+	if ok && cp.size == info.Size() && cp.mtime.Equal(info.ModTime()) {
+		return cp.proto, nil
+	}
+	raw, err := os.ReadFile(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte(compileCacheSalt+"\x00"+fullpath+"\x00"), raw...))
+	hash := hex.EncodeToString(sum[:])
+	if !ok || cp.hash != hash {
+		cp = &compiledProto{hash: hash}
+		if cp.proto, err = cache.load(hash); err != nil {
+			if cp.proto, err = compileChunk(raw, fullpath); err != nil {
+				return nil, err
+			}
+			cache.save(hash, cp.proto)
+		}
+	}
+	cp = &compiledProto{size: info.Size(), mtime: info.ModTime(), hash: hash, proto: cp.proto}
+	cache.mutex.Lock()
+	cache.protos[fullpath] = cp
+	cache.mutex.Unlock()
+	return cp.proto, nil
+}
+
+// Len returns the count of protos which are cached in memory
+func (cache *CompileCache) Len() int {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return len(cache.protos)
+}
+
+// Purge to remove all protos in memory, and persisted protos aren't removed.
+func (cache *CompileCache) Purge() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.protos = make(map[string]*compiledProto)
+}
+
+// load returns proto persisted in dir. It fails when proto is broken or incompatible,
+// and the panic of reflection also is recovered as error, so that script is compiled again.
+func (cache *CompileCache) load(hash string) (proto *lua.FunctionProto, err error) {
+	if len(cache.dir) == 0 {
+		return nil, os.ErrNotExist
+	}
+	raw, err := os.ReadFile(filepath.Join(cache.dir, hash+".luac"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			proto, err = nil, fmt.Errorf("invalid compiled proto %s: %v", hash, r)
+		}
+	}()
+	dump := &protoDump{}
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(dump); err != nil {
+		return nil, err
+	}
+	return dump.proto()
+}
+
+// save to persist proto, and it's ignored when failed because cache is optional.
+func (cache *CompileCache) save(hash string, proto *lua.FunctionProto) {
+	if len(cache.dir) == 0 {
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(newProtoDump(proto)); err != nil {
+		return
+	}
+	if err := utils.SafeMkdirs(cache.dir); err != nil {
+		return
+	}
+	tmp := filepath.Join(cache.dir, hash+".luac."+utils.RandString(8))
+	if err := os.WriteFile(tmp, buf.Bytes(), 0666); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(cache.dir, hash+".luac")); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+func compileChunk(raw []byte, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(raw), name)
+	if err != nil {
+		return nil, &lua.ApiError{Type: lua.ApiErrorSyntax, Object: lua.LString(err.Error()), Cause: err}
+	}
+	return lua.Compile(chunk, name)
+}
+
+// protoDump is the serializable form of lua.FunctionProto
+type protoDump struct {
+	SourceName         string
+	LineDefined        int
+	LastLineDefined    int
+	NumUpvalues        uint8
+	NumParameters      uint8
+	IsVarArg           uint8
+	NumUsedRegisters   uint8
+	Code               []uint32
+	Constants          []constantDump
+	FunctionPrototypes []*protoDump
+	DbgSourcePositions []int
+	DbgLocals          []*lua.DbgLocalInfo
+	DbgCalls           []lua.DbgCall
+	DbgUpvalues        []string
+}
+
+// constantDump only stores number and string, because there are no other constants in proto.
+type constantDump struct {
+	IsString bool
+	Str      string
+	Num      float64
+}
+
+func newProtoDump(proto *lua.FunctionProto) *protoDump {
+	dump := &protoDump{
+		SourceName:         proto.SourceName,
+		LineDefined:        proto.LineDefined,
+		LastLineDefined:    proto.LastLineDefined,
+		NumUpvalues:        proto.NumUpvalues,
+		NumParameters:      proto.NumParameters,
+		IsVarArg:           proto.IsVarArg,
+		NumUsedRegisters:   proto.NumUsedRegisters,
+		Code:               proto.Code,
+		DbgSourcePositions: proto.DbgSourcePositions,
+		DbgLocals:          proto.DbgLocals,
+		DbgCalls:           proto.DbgCalls,
+		DbgUpvalues:        proto.DbgUpvalues,
+	}
+	for _, c := range proto.Constants {
+		switch v := c.(type) {
+		case lua.LString:
+			dump.Constants = append(dump.Constants, constantDump{IsString: true, Str: string(v)})
+		case lua.LNumber:
+			dump.Constants = append(dump.Constants, constantDump{Num: float64(v)})
+		}
+	}
+	for _, p := range proto.FunctionPrototypes {
+		dump.FunctionPrototypes = append(dump.FunctionPrototypes, newProtoDump(p))
+	}
+	return dump
+}
+
+func (dump *protoDump) proto() (*lua.FunctionProto, error) {
+	// every function ends with RETURN, so that empty code is broken
+	if len(dump.Code) == 0 {
+		return nil, errors.New("invalid compiled proto: empty code")
+	}
+	proto := &lua.FunctionProto{
+		SourceName:         dump.SourceName,
+		LineDefined:        dump.LineDefined,
+		LastLineDefined:    dump.LastLineDefined,
+		NumUpvalues:        dump.NumUpvalues,
+		NumParameters:      dump.NumParameters,
+		IsVarArg:           dump.IsVarArg,
+		NumUsedRegisters:   dump.NumUsedRegisters,
+		Code:               dump.Code,
+		DbgSourcePositions: dump.DbgSourcePositions,
+		DbgLocals:          dump.DbgLocals,
+		DbgCalls:           dump.DbgCalls,
+		DbgUpvalues:        dump.DbgUpvalues,
+	}
+	// stringConstants is unexported, which is used by vm to access field quickly
+	strs := []string{}
+	for _, c := range dump.Constants {
+		if c.IsString {
+			proto.Constants = append(proto.Constants, lua.LString(c.Str))
+			strs = append(strs, c.Str)
+		} else {
+			proto.Constants = append(proto.Constants, lua.LNumber(c.Num))
+			strs = append(strs, "")
+		}
+	}
+	if err := utils.NewReflectObject(proto).Set("stringConstants", strs); err != nil {
+		return nil, err
+	}
+	for _, p := range dump.FunctionPrototypes {
+		sub, err := p.proto()
+		if err != nil {
+			return nil, err
+		}
+		proto.FunctionPrototypes = append(proto.FunctionPrototypes, sub)
+	}
+	return proto, nil
+}
@@ -0,0 +1,121 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCompileCache(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sdk.lua")
+	if err := os.WriteFile(script, []byte(`local conf = { name = "cushion" } sdk = conf.name .. #arg_list`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCompileCache(filepath.Join(dir, "cache"))
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Cache: cache}).Default()
+	vm.SetGlobalVar("arg_list", strSlice2Table([]string{"a", "b"}))
+	for i := 0; i < 2; i++ {
+		if err := vm.EvalFile(script); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, _ := vm.CompileFile(script)
+	// load from disk
+	cache.Purge()
+	second, err := vm.CompileFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || cache.Len() != 1 {
+		t.Fatal("proto isn't loaded from disk")
+	}
+	vm.SetGlobalVar("sdk", lua.LNil)
+	if err := vm.EvalProto(second); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.GetGlobalVar("sdk").String(); got != "cushion2" {
+		t.Fatalf("want cushion2, got %s", got)
+	}
+	// file changed with the same modified time is compiled again
+	info, _ := os.Stat(script)
+	if err := os.WriteFile(script, []byte(`sdk = "changed"`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(script, info.ModTime(), info.ModTime())
+	if err := vm.EvalFile(script); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.GetGlobalVar("sdk").String(); got != "changed" {
+		t.Fatalf("want changed, got %s", got)
+	}
+	if err := vm.EvalFile(filepath.Join(dir, "sdk.txt")); !errors.Is(err, ErrUnsupportedScript) {
+		t.Fatalf("want ErrUnsupportedScript, got %v", err)
+	}
+}
+
+func TestCompileCacheLoad(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sdk.lua")
+	err := os.WriteFile(script, []byte(`
+local conf = { name = "cushion", tags = { "a", "b" } }
+function conf:join(...)
+	local parts = { self.name }
+	for _, v in ipairs({ ... }) do
+		parts[#parts + 1] = v
+	end
+	return table.concat(parts, "-")
+end
+local function counter()
+	local n = 0
+	return function() n = n + 1 return n end
+end
+local next = counter()
+next()
+sdk = conf:join(conf.tags[2], tostring(next()))`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	evalSDK := func() string {
+		vm := NewVirtualMachineWithOpt(LuaVMOpt{Cache: NewCompileCache(cacheDir)})
+		if err := vm.EvalFile(script); err != nil {
+			t.Fatal(err)
+		}
+		return vm.GetGlobalVar("sdk").String()
+	}
+	if got := evalSDK(); got != "cushion-b-2" {
+		t.Fatalf("want cushion-b-2, got %s", got)
+	}
+	luac, _ := filepath.Glob(filepath.Join(cacheDir, "*.luac"))
+	if len(luac) != 1 {
+		t.Fatalf("want 1 compiled proto, got %v", luac)
+	}
+	persisted, _ := os.ReadFile(luac[0])
+	// proto is loaded from disk by new cache, and it isn't saved again as compiling
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(luac[0], old, old)
+	if got := evalSDK(); got != "cushion-b-2" {
+		t.Fatalf("want cushion-b-2 from compiled proto, got %s", got)
+	}
+	if info, err := os.Stat(luac[0]); err != nil || !info.ModTime().Equal(old) {
+		t.Fatal("proto isn't loaded from disk")
+	}
+	// broken proto is compiled again and replaced
+	for _, broken := range [][]byte{[]byte("broken"), persisted[:len(persisted)/2], {}} {
+		if err := os.WriteFile(luac[0], broken, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if got := evalSDK(); got != "cushion-b-2" {
+			t.Fatalf("want cushion-b-2 from broken proto, got %s", got)
+		}
+		if raw, _ := os.ReadFile(luac[0]); !bytes.Equal(raw, persisted) {
+			t.Fatal("broken proto isn't replaced")
+		}
+	}
+}
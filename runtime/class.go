@@ -0,0 +1,251 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaClass is the meta of go type which is exposed as lua class
+type luaClass struct {
+	name    string
+	rt      reflect.Type
+	fields  map[string]codecField
+	methods map[string]reflect.Method
+	mt      *lua.LTable
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterClass to expose go struct as lua class, and proto is the value or pointer of struct.
+// Exported fields are accessed by `lua` tag or field name, methods of pointer are bound to object,
+// and Name.new{...} creates object whose fields are validated.
+// When struct has `Validate() error` method, it'll be called after object is created.
+func (vm *LuaVM) RegisterClass(name string, proto any) error {
+	rt := reflect.TypeOf(proto)
+	for rt != nil && rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt == nil || rt.Kind() != reflect.Struct {
+		return fmt.Errorf("class %s: expected struct, got %v", name, rt)
+	}
+	class := &luaClass{
+		name:    name,
+		rt:      rt,
+		fields:  make(map[string]codecField),
+		methods: make(map[string]reflect.Method),
+	}
+	fields := structFields(rt)
+	for _, f := range fields {
+		class.fields[f.name] = f
+	}
+	// first lower name of field without tag is matched like Decode, unless it's taken by other field
+	for _, f := range fields {
+		for _, name := range f.names() {
+			if _, ok := class.fields[name]; !ok {
+				class.fields[name] = f
+			}
+		}
+	}
+	pt := reflect.PointerTo(rt)
+	for i := 0; i < pt.NumMethod(); i++ {
+		m := pt.Method(i)
+		class.methods[m.Name] = m
+	}
+	if vm.classes == nil {
+		vm.classes = make(map[reflect.Type]*luaClass)
+	}
+	vm.classes[rt] = class
+	lvm := vm.state
+	class.mt = lvm.NewTypeMetatable("cushion.class." + name)
+	lvm.SetFuncs(class.mt, LuaFuncs{
+		"__index":    vm.classIndex(class),
+		"__newindex": vm.classNewIndex(class),
+		"__tostring": vm.classToString(class),
+	})
+	class.mt.RawSetString("__name", lua.LString(name))
+	lvm.SetGlobal(name, lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+		"new": vm.classNew(class),
+	}))
+	return nil
+}
+
+// NewClassObject wraps pointer of registered struct as lua object
+func (vm *LuaVM) NewClassObject(obj any) (lua.LValue, error) {
+	rv := reflect.ValueOf(obj)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, errors.New("class object must be a non-nil pointer")
+	}
+	class, ok := vm.classes[rv.Type().Elem()]
+	if !ok {
+		return nil, fmt.Errorf("class of %s isn't registered", rv.Type().Elem())
+	}
+	return vm.newObject(class, rv), nil
+}
+
+func (vm *LuaVM) newObject(class *luaClass, rv reflect.Value) *lua.LUserData {
+	ud := vm.state.NewUserData()
+	ud.Value = utils.NewReflectObject(rv.Interface())
+	ud.Metatable = class.mt
+	return ud
+}
+
+// checkObject returns the ReflectObject of userdata at n
+func (class *luaClass) checkObject(lvm *lua.LState, n int) *utils.ReflectObject {
+	ud := lvm.CheckUserData(n)
+	if obj, ok := ud.Value.(*utils.ReflectObject); ok && ud.Metatable == class.mt {
+		return obj
+	}
+	lvm.ArgError(n, class.name+" expected")
+	return nil
+}
+
+func (vm *LuaVM) classNew(class *luaClass) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		tbl := lvm.OptTable(1, lvm.NewTable())
+		tbl.ForEach(func(k, v lua.LValue) {
+			if _, ok := class.fields[k.String()]; !ok {
+				raiseError(lvm, fmt.Errorf("%s.new: unknown field %s", class.name, k.String()))
+			}
+		})
+		rv := reflect.New(class.rt)
+		if err := DecodeWithPath(class.name, tbl, rv.Interface()); err != nil {
+			raiseError(lvm, fmt.Errorf("%s.new: %w", class.name, err))
+		}
+		if v, ok := rv.Interface().(interface{ Validate() error }); ok {
+			if err := v.Validate(); err != nil {
+				raiseError(lvm, fmt.Errorf("%s.new: %w", class.name, err))
+			}
+		}
+		lvm.Push(vm.newObject(class, rv))
+		return 1
+	}
+}
+
+func (vm *LuaVM) classIndex(class *luaClass) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		obj := class.checkObject(lvm, 1)
+		key := lvm.CheckString(2)
+		if f, ok := class.fields[key]; ok {
+			v, err := vm.encodeResult(obj.Get(f.field.Name))
+			if err != nil {
+				raiseError(lvm, err)
+			}
+			lvm.Push(v)
+			return 1
+		}
+		m, ok := class.methods[key]
+		if !ok {
+			m, ok = class.methods[utils.FirstUpper(key)]
+		}
+		if ok {
+			lvm.Push(lvm.NewFunction(vm.classMethod(class, m)))
+			return 1
+		}
+		lvm.Push(lua.LNil)
+		return 1
+	}
+}
+
+func (vm *LuaVM) classNewIndex(class *luaClass) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		obj := class.checkObject(lvm, 1)
+		key := lvm.CheckString(2)
+		f, ok := class.fields[key]
+		if !ok {
+			raiseError(lvm, fmt.Errorf("%s: unknown field %s", class.name, key))
+		}
+		v := reflect.New(f.field.Type)
+		if err := DecodeWithPath(class.name+"."+key, lvm.Get(3), v.Interface()); err != nil {
+			raiseError(lvm, err)
+		}
+		if f.field.Type.Kind() == reflect.Interface {
+			// ReflectObject can't set interface because of kind check
+			reflect.ValueOf(obj.Raw()).Elem().FieldByIndex(f.field.Index).Set(v.Elem())
+		} else if err := obj.Set(f.field.Name, v.Elem().Interface()); err != nil {
+			raiseError(lvm, fmt.Errorf("%s.%s: %w", class.name, key, err))
+		}
+		return 0
+	}
+}
+
+func (vm *LuaVM) classToString(class *luaClass) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		obj := class.checkObject(lvm, 1)
+		if s, ok := obj.Raw().(fmt.Stringer); ok {
+			lvm.Push(lua.LString(s.String()))
+			return 1
+		}
+		fields := []string{}
+		for _, f := range structFields(class.rt) {
+			fields = append(fields, fmt.Sprintf("%s=%v", f.name, obj.Get(f.field.Name).Interface()))
+		}
+		lvm.Push(lua.LString(fmt.Sprintf("%s{%s}", class.name, strings.Join(fields, ", "))))
+		return 1
+	}
+}
+
+// classMethod binds method to object, and it's able to be called by obj:method(...) or obj.method(...)
+func (vm *LuaVM) classMethod(class *luaClass, m reflect.Method) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		obj := class.checkObject(lvm, 1)
+		args := []reflect.Value{reflect.ValueOf(obj.Raw())}
+		mt := m.Type
+		argc := lvm.GetTop() - 1
+		for i := 1; i < mt.NumIn(); i++ {
+			pt := mt.In(i)
+			if mt.IsVariadic() && i == mt.NumIn()-1 {
+				for j := i; j <= argc; j++ {
+					v := reflect.New(pt.Elem())
+					if err := DecodeWithPath(fmt.Sprintf("%s.%s#%d", class.name, m.Name, j), lvm.Get(j+1), v.Interface()); err != nil {
+						raiseError(lvm, err)
+					}
+					args = append(args, v.Elem())
+				}
+				break
+			}
+			v := reflect.New(pt)
+			if err := DecodeWithPath(fmt.Sprintf("%s.%s#%d", class.name, m.Name, i), lvm.Get(i+1), v.Interface()); err != nil {
+				raiseError(lvm, err)
+			}
+			args = append(args, v.Elem())
+		}
+		outs := m.Func.Call(args)
+		if n := len(outs); n > 0 && mt.Out(n-1) == errorType {
+			if err, _ := outs[n-1].Interface().(error); err != nil {
+				raiseError(lvm, err)
+			}
+			outs = outs[:n-1]
+		}
+		for _, out := range outs {
+			v, err := vm.encodeResult(out)
+			if err != nil {
+				raiseError(lvm, err)
+			}
+			lvm.Push(v)
+		}
+		return len(outs)
+	}
+}
+
+// encodeResult wraps the pointer of registered class as object, otherwise encodes it
+func (vm *LuaVM) encodeResult(rv reflect.Value) (lua.LValue, error) {
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		if class, ok := vm.classes[rv.Type().Elem()]; ok {
+			return vm.newObject(class, rv), nil
+		}
+	}
+	if rv.Kind() == reflect.Struct {
+		if class, ok := vm.classes[rv.Type()]; ok {
+			ptr := reflect.New(rv.Type())
+			ptr.Elem().Set(rv)
+			return vm.newObject(class, ptr), nil
+		}
+	}
+	return encodeValue(vm.state, "", rv, make(map[encodeRef]bool))
+}
@@ -0,0 +1,97 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type classServer struct {
+	Host    string `lua:"host"`
+	Port    int    `lua:"port"`
+	started bool
+}
+
+func (s *classServer) Start() error {
+	if s.started {
+		return errors.New("server is running")
+	}
+	s.started = true
+	return nil
+}
+
+func (s *classServer) Addr(scheme string) string {
+	return fmt.Sprintf("%s://%s:%d", scheme, s.Host, s.Port)
+}
+
+func (s *classServer) Running() bool {
+	return s.started
+}
+
+func (s *classServer) Validate() error {
+	if s.Port <= 0 {
+		return errors.New("port must be positive")
+	}
+	return nil
+}
+
+func TestRegisterClass(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	if err := vm.RegisterClass("Server", classServer{}); err != nil {
+		t.Fatal(err)
+	}
+	err := vm.Eval(`
+local s = Server.new{ host = "localhost", port = 80 }
+s.port = 8080
+assert(s:Addr("http") == "http://localhost:8080")
+s:Start()
+assert(s:Running())
+assert(s.started == nil)
+str = tostring(s)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.GetGlobalVar("str").String(); got != "Server{host=localhost, port=8080}" {
+		t.Fatal(got)
+	}
+	testDataset := map[string]string{
+		`Server.new{ host = "a", port = 0 }`:                   "port must be positive",
+		`Server.new{ host = "a", port = "80" }`:                "Server.port: expected number, got string",
+		`Server.new{ host = "a", port = 1, started = true }`:   "unknown field started",
+		`local s = Server.new{ port = 1 } s.started = true`:    "unknown field started",
+		`local s = Server.new{ port = 1 } s:Start() s:Start()`: "server is running",
+	}
+	for script, want := range testDataset {
+		if err := vm.Eval(script); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want %s, got %v", script, want, err)
+		}
+	}
+}
+
+type classClient struct {
+	Addr    string
+	Timeout int `lua:"timeout"`
+}
+
+func TestRegisterClassUntagged(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	if err := vm.RegisterClass("Client", classClient{}); err != nil {
+		t.Fatal(err)
+	}
+	err := vm.Eval(`
+local c = Client.new{ addr = "localhost", timeout = 3 }
+assert(c.addr == "localhost" and c.Addr == "localhost")
+c.addr = "127.0.0.1"
+assert(c.Addr == "127.0.0.1")
+c.Addr = "::1"
+assert(c.addr == "::1")
+local d = Client.new{ Addr = "remote" }
+assert(d.addr == "remote")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Eval(`Client.new{ Timeout = 3 }`); err == nil || !strings.Contains(err.Error(), "unknown field Timeout") {
+		t.Fatal(err)
+	}
+}
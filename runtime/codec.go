@@ -0,0 +1,475 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// CodecError is returned when value can't be converted between lua and go,
+// and Path locates the value to be failed, such as config.servers[2].port
+type CodecError struct {
+	Path string
+	Msg  string
+}
+
+func (err *CodecError) Error() string {
+	if len(err.Path) == 0 {
+		return err.Msg
+	}
+	return fmt.Sprintf("%s: %s", err.Path, err.Msg)
+}
+
+var luaValueType = reflect.TypeOf((*lua.LValue)(nil)).Elem()
+
+// Decode to convert lua value into out, which must be a non-nil pointer.
+// Struct field is matched by `lua:"name"` tag, field name or its first lower form,
+// and the index of array in Path is one-based like lua.
+func Decode(lv lua.LValue, out any) error {
+	return DecodeWithPath("", lv, out)
+}
+
+// DecodeWithPath is the same as Decode, but the path of error is prefixed with root
+func DecodeWithPath(root string, lv lua.LValue, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &CodecError{Path: root, Msg: "decode target must be a non-nil pointer"}
+	}
+	return decodeValue(root, lv, rv.Elem(), make(map[*lua.LTable]bool))
+}
+
+// decodeValue converts lv into rv, and seen is tables being decoded to detect cycle
+func decodeValue(p string, lv lua.LValue, rv reflect.Value, seen map[*lua.LTable]bool) error {
+	if lv == nil {
+		lv = lua.LNil
+	}
+	if rv.Type() == luaValueType {
+		rv.Set(reflect.ValueOf(lv))
+		return nil
+	}
+	if lv == lua.LNil {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+	if tbl, ok := lv.(*lua.LTable); ok {
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+			if seen[tbl] {
+				return &CodecError{Path: p, Msg: "cyclic table can't be decoded"}
+			}
+			seen[tbl] = true
+			defer delete(seen, tbl)
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return decodeValue(p, lv, rv.Elem(), seen)
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return decodeErr(p, "interface", lv)
+		}
+		v, err := toGoValue(p, lv)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(v))
+	case reflect.Bool:
+		b, ok := lv.(lua.LBool)
+		if !ok {
+			return decodeErr(p, "boolean", lv)
+		}
+		rv.SetBool(bool(b))
+	case reflect.String:
+		switch v := lv.(type) {
+		case lua.LString:
+			rv.SetString(string(v))
+		case lua.LNumber:
+			rv.SetString(v.String())
+		default:
+			return decodeErr(p, "string", lv)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return decodeErr(p, "number", lv)
+		}
+		if float64(n) != math.Trunc(float64(n)) || rv.OverflowInt(int64(n)) {
+			return &CodecError{Path: p, Msg: fmt.Sprintf("number %v overflows %s", n, rv.Type())}
+		}
+		rv.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return decodeErr(p, "number", lv)
+		}
+		if n < 0 || float64(n) != math.Trunc(float64(n)) || rv.OverflowUint(uint64(n)) {
+			return &CodecError{Path: p, Msg: fmt.Sprintf("number %v overflows %s", n, rv.Type())}
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return decodeErr(p, "number", lv)
+		}
+		rv.SetFloat(float64(n))
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			if s, ok := lv.(lua.LString); ok {
+				rv.SetBytes([]byte(s))
+				return nil
+			}
+		}
+		tbl, ok := lv.(*lua.LTable)
+		if !ok {
+			return decodeErr(p, "table", lv)
+		}
+		n := tbl.Len()
+		slice := reflect.MakeSlice(rv.Type(), n, n)
+		for i := 1; i <= n; i++ {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", p, i), tbl.RawGetInt(i), slice.Index(i-1), seen); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	case reflect.Array:
+		tbl, ok := lv.(*lua.LTable)
+		if !ok {
+			return decodeErr(p, "table", lv)
+		}
+		if tbl.Len() > rv.Len() {
+			return &CodecError{Path: p, Msg: fmt.Sprintf("expected at most %d elements, got %d", rv.Len(), tbl.Len())}
+		}
+		for i := 1; i <= rv.Len(); i++ {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", p, i), tbl.RawGetInt(i), rv.Index(i-1), seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		tbl, ok := lv.(*lua.LTable)
+		if !ok {
+			return decodeErr(p, "table", lv)
+		}
+		m := reflect.MakeMap(rv.Type())
+		var err error
+		tbl.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			key := reflect.New(rv.Type().Key()).Elem()
+			if err = decodeValue(p, k, key, seen); err != nil {
+				return
+			}
+			val := reflect.New(rv.Type().Elem()).Elem()
+			if err = decodeValue(joinPath(p, k), v, val, seen); err != nil {
+				return
+			}
+			m.SetMapIndex(key, val)
+		})
+		if err != nil {
+			return err
+		}
+		rv.Set(m)
+	case reflect.Struct:
+		tbl, ok := lv.(*lua.LTable)
+		if !ok {
+			return decodeErr(p, "table", lv)
+		}
+		for _, f := range structFields(rv.Type()) {
+			var v lua.LValue = lua.LNil
+			for _, name := range f.names() {
+				if v = tbl.RawGetString(name); v != lua.LNil {
+					break
+				}
+			}
+			if err := decodeValue(joinPath(p, lua.LString(f.name)), v, rv.FieldByIndex(f.field.Index), seen); err != nil {
+				return err
+			}
+		}
+	default:
+		return &CodecError{Path: p, Msg: fmt.Sprintf("unsupported type %s", rv.Type())}
+	}
+	return nil
+}
+
+func decodeErr(p, want string, got lua.LValue) error {
+	return &CodecError{Path: p, Msg: fmt.Sprintf("expected %s, got %s", want, got.Type())}
+}
+
+func joinPath(p string, k lua.LValue) string {
+	if n, ok := k.(lua.LNumber); ok {
+		return fmt.Sprintf("%s[%v]", p, n)
+	}
+	if len(p) == 0 {
+		return k.String()
+	}
+	return p + "." + k.String()
+}
+
+var luaKeywords = []string{
+	"and", "break", "do", "else", "elseif", "end", "false", "for", "function", "if",
+	"in", "local", "nil", "not", "or", "repeat", "return", "then", "true", "until", "while",
+}
+
+// luaIdentifier returns whether s is a valid name of lua, which could be written as t.s
+func luaIdentifier(s string) bool {
+	if len(s) == 0 || containStr(luaKeywords, s) {
+		return false
+	}
+	for i, c := range s {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// toGoValue converts lua value into natural go value,
+// and table is converted into []any when it's array-like, otherwise map[string]any.
+// It returns CodecError when table is cyclic.
+func toGoValue(p string, lv lua.LValue) (any, error) {
+	return toGoValueSeen(p, lv, make(map[*lua.LTable]bool))
+}
+
+// toGoValueSeen converts lv, and seen is tables being converted to detect cycle
+func toGoValueSeen(p string, lv lua.LValue, seen map[*lua.LTable]bool) (any, error) {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if seen[v] {
+			return nil, &CodecError{Path: p, Msg: "cyclic table can't be converted"}
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		if n := v.Len(); n > 0 && isArray(v, n) {
+			arr := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := toGoValueSeen(fmt.Sprintf("%s[%d]", p, i), v.RawGetInt(i), seen)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, item)
+			}
+			return arr, nil
+		}
+		dict := make(map[string]any)
+		var err error
+		v.ForEach(func(k, val lua.LValue) {
+			if err != nil {
+				return
+			}
+			dict[k.String()], err = toGoValueSeen(joinPath(p, k), val, seen)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return dict, nil
+	case *lua.LUserData:
+		return v.Value, nil
+	case *lua.LNilType:
+		return nil, nil
+	}
+	return lv, nil
+}
+
+// isArray returns whether all keys of table are sequence from 1 to n
+func isArray(tbl *lua.LTable, n int) bool {
+	cnt := 0
+	tbl.ForEach(func(k, v lua.LValue) {
+		cnt++
+	})
+	return cnt == n
+}
+
+type codecField struct {
+	name      string
+	omitempty bool
+	field     reflect.StructField
+}
+
+// names returns keys matched to field, which is tag or field name and its first lower form without tag
+func (f codecField) names() []string {
+	if lower := utils.FirstLower(f.name); f.name == f.field.Name && lower != f.name {
+		return []string{f.name, lower}
+	}
+	return []string{f.name}
+}
+
+// structFields returns the exported fields of struct, and field tagged with `lua:"-"` is ignored.
+func structFields(rt reflect.Type) []codecField {
+	fields := []codecField{}
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		cf := codecField{name: f.Name, field: f}
+		if tag, ok := f.Tag.Lookup("lua"); ok {
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "-" {
+				continue
+			}
+			if len(name) > 0 {
+				cf.name = name
+			}
+			cf.omitempty = strings.Contains(opts, "omitempty")
+		}
+		fields = append(fields, cf)
+	}
+	return fields
+}
+
+// Encode to convert go value into lua value, and struct is encoded according to `lua` tag like Decode.
+func Encode(lvm *lua.LState, v any) (lua.LValue, error) {
+	if v == nil {
+		return lua.LNil, nil
+	}
+	return encodeValue(lvm, "", reflect.ValueOf(v), make(map[encodeRef]bool))
+}
+
+// encodeRef identifies pointer, map or slice being encoded to detect cycle,
+// and length distinguishes slices sharing the same array.
+type encodeRef struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func encodeValue(lvm *lua.LState, p string, rv reflect.Value, seen map[encodeRef]bool) (lua.LValue, error) {
+	if !rv.IsValid() {
+		return lua.LNil, nil
+	}
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return lua.LNil, nil
+	}
+	if rv.CanInterface() {
+		if lv, ok := rv.Interface().(lua.LValue); ok {
+			return lv, nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if !rv.IsNil() {
+			ref := encodeRef{ptr: rv.Pointer(), typ: rv.Type()}
+			if rv.Kind() == reflect.Slice {
+				ref.len = rv.Len()
+			}
+			if seen[ref] {
+				return nil, &CodecError{Path: p, Msg: fmt.Sprintf("cyclic %s can't be encoded", rv.Type())}
+			}
+			seen[ref] = true
+			defer delete(seen, ref)
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		return encodeValue(lvm, p, rv.Elem(), seen)
+	case reflect.Bool:
+		return lua.LBool(rv.Bool()), nil
+	case reflect.String:
+		return lua.LString(rv.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return lua.LNumber(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float()), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return lua.LString(rv.Bytes()), nil
+		}
+		tbl := lvm.CreateTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			v, err := encodeValue(lvm, fmt.Sprintf("%s[%d]", p, i+1), rv.Index(i), seen)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSetInt(i+1, v)
+		}
+		return tbl, nil
+	case reflect.Map:
+		tbl := lvm.CreateTable(0, rv.Len())
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			k, err := encodeValue(lvm, p, key, seen)
+			if err != nil {
+				return nil, err
+			}
+			v, err := encodeValue(lvm, joinPath(p, k), rv.MapIndex(key), seen)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSet(k, v)
+		}
+		return tbl, nil
+	case reflect.Struct:
+		tbl := lvm.NewTable()
+		for _, f := range structFields(rv.Type()) {
+			fv := rv.FieldByIndex(f.field.Index)
+			if f.omitempty && fv.IsZero() {
+				continue
+			}
+			v, err := encodeValue(lvm, joinPath(p, lua.LString(f.name)), fv, seen)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSetString(f.name, v)
+		}
+		return tbl, nil
+	}
+	return nil, &CodecError{Path: p, Msg: fmt.Sprintf("unsupported type %s", rv.Type())}
+}
+
+// CallInto calls global function with arguments to be encoded, and decodes its first return value into T.
+func CallInto[T any](vm VirtualMachine, fn string, args ...any) (T, error) {
+	return EvalFuncInto[T](vm, vm.GetGlobalVar(fn), args...)
+}
+
+// EvalFuncInto executes function with arguments to be encoded, and decodes its first return value into T.
+func EvalFuncInto[T any](vm VirtualMachine, fn lua.LValue, args ...any) (T, error) {
+	var out T
+	largs := []lua.LValue{}
+	for _, arg := range args {
+		larg, err := Encode(vm.Interp(), arg)
+		if err != nil {
+			return out, err
+		}
+		largs = append(largs, larg)
+	}
+	ret, err := vm.EvalFunc(fn, largs)
+	if err != nil {
+		return out, err
+	}
+	if len(ret) == 0 {
+		return out, nil
+	}
+	lv, _ := ret[0].(lua.LValue)
+	err = Decode(lv, &out)
+	return out, err
+}
+
+// GetGlobalInto decodes global variable into T, and the path of error is prefixed with name.
+func GetGlobalInto[T any](vm VirtualMachine, name string) (T, error) {
+	var out T
+	err := DecodeWithPath(name, vm.GetGlobalVar(name), &out)
+	return out, err
+}
@@ -0,0 +1,92 @@
+package runtime
+
+import (
+	"fmt"
+	"testing"
+)
+
+type codecServer struct {
+	Host string `lua:"host"`
+	Port int    `lua:"port"`
+	TLS  bool   `lua:"tls,omitempty"`
+}
+
+type codecConfig struct {
+	Name    string            `lua:"name"`
+	Servers []codecServer     `lua:"servers"`
+	Labels  map[string]string `lua:"labels,omitempty"`
+	Extra   any               `lua:"extra"`
+	secret  string
+}
+
+func TestCodec(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+config = {
+	name = "cushion",
+	servers = { { host = "a", port = 80 }, { host = "b", port = 443, tls = true } },
+	extra = { 1, 2, 3 },
+}
+function merge(conf)
+	conf.name = conf.name .. "!"
+	return conf
+end
+bad = { servers = { { port = 1 }, { port = "8080" } } }
+cyclic = { name = "cyclic" }
+cyclic.extra = { parent = cyclic }
+shared = { 1 }
+twice = { name = "twice", extra = { a = shared, b = shared } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := GetGlobalInto[codecConfig](vm, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Servers) != 2 || conf.Servers[1].Port != 443 || !conf.Servers[1].TLS {
+		t.Fatalf("%+v", conf)
+	}
+	merged, err := CallInto[codecConfig](vm, "merge", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Name != "cushion!" || merged.Servers[0].Host != "a" || len(merged.Extra.([]any)) != 3 {
+		t.Fatalf("%+v", merged)
+	}
+	_, err = GetGlobalInto[codecConfig](vm, "bad")
+	if err == nil || err.Error() != "bad.servers[2].port: expected number, got string" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Println(err)
+	_, err = GetGlobalInto[codecConfig](vm, "cyclic")
+	if err == nil || err.Error() != "cyclic.extra.parent.extra: cyclic table can't be converted" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Println(err)
+	if _, err = GetGlobalInto[codecConfig](vm, "twice"); err != nil {
+		t.Fatal(err)
+	}
+	type node struct {
+		Next *node `lua:"next"`
+	}
+	loop := &node{}
+	loop.Next = loop
+	if _, err = Encode(vm.(*LuaVM).state, loop); err == nil {
+		t.Fatal("cyclic pointer shouldn't be encoded")
+	}
+	fmt.Println(err)
+	vm.Eval(`ring = {} ring.next = { next = ring }`)
+	if _, err = GetGlobalInto[node](vm, "ring"); err == nil || err.Error() != "ring.next.next: cyclic table can't be decoded" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Println(err)
+	m := map[string]any{}
+	m["self"] = m
+	if _, err = Encode(vm.(*LuaVM).state, m); err == nil {
+		t.Fatal("cyclic map shouldn't be encoded")
+	}
+	list := []codecServer{{Host: "a"}}
+	if _, err = Encode(vm.(*LuaVM).state, map[string]any{"a": list, "b": list}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,329 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Coverage records executed lines of chunks, which is passed to vm by LuaVMOpt.Coverage.
+// It's safe to be shared by several vms, and coverage of different runs could be merged by LCOV file.
+// Note that chunks without file (such as Eval) aren't recorded.
+type Coverage struct {
+	mutex  sync.Mutex
+	files  map[string]map[int]int64
+	protos map[*lua.FunctionProto]struct{}
+}
+
+// CoverageSummary is the line coverage of a file
+type CoverageSummary struct {
+	File    string
+	Lines   int
+	Covered int
+}
+
+// Percent returns the percentage of covered lines
+func (s CoverageSummary) Percent() float64 {
+	if s.Lines == 0 {
+		return 0
+	}
+	return float64(s.Covered) * 100 / float64(s.Lines)
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{
+		files:  make(map[string]map[int]int64),
+		protos: make(map[*lua.FunctionProto]struct{}),
+	}
+}
+
+// Files returns sorted files which are recorded
+func (c *Coverage) Files() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	files := []string{}
+	for file := range c.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Hits returns how many times the line of file is executed, and ok is false when line isn't executable.
+func (c *Coverage) Hits(file string, line int) (hits int64, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hits, ok = c.files[file][line]
+	return
+}
+
+// Merge to add hits of other coverage
+func (c *Coverage) Merge(other *Coverage) {
+	if c == other {
+		return
+	}
+	other.mutex.Lock()
+	files := make(map[string]map[int]int64)
+	for file, lines := range other.files {
+		files[file] = make(map[int]int64)
+		for line, hits := range lines {
+			files[file][line] = hits
+		}
+	}
+	other.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for file, lines := range files {
+		for line, hits := range lines {
+			c.lines(file)[line] += hits
+		}
+	}
+}
+
+// Summary returns the line coverage of every file
+func (c *Coverage) Summary() []CoverageSummary {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	summaries := []CoverageSummary{}
+	for file, lines := range c.files {
+		summary := CoverageSummary{File: file, Lines: len(lines)}
+		for _, hits := range lines {
+			if hits > 0 {
+				summary.Covered++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].File < summaries[j].File
+	})
+	return summaries
+}
+
+// WriteSummary to write the table of line coverage
+func (c *Coverage) WriteSummary(w io.Writer) error {
+	lines, covered := 0, 0
+	for _, s := range c.Summary() {
+		lines += s.Lines
+		covered += s.Covered
+		if _, err := fmt.Fprintf(w, "%s\t%d/%d\t%.1f%%\n", s.File, s.Covered, s.Lines, s.Percent()); err != nil {
+			return err
+		}
+	}
+	total := CoverageSummary{Lines: lines, Covered: covered}
+	_, err := fmt.Fprintf(w, "total\t%d/%d\t%.1f%%\n", covered, lines, total.Percent())
+	return err
+}
+
+// WriteLCOV to write coverage in LCOV format
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	files := c.Files()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, file := range files {
+		lines := []int{}
+		for line := range c.files[file] {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", file)
+		hit := 0
+		for _, line := range lines {
+			hits := c.files[file][line]
+			if hits > 0 {
+				hit++
+			}
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, hits)
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+	}
+	return bw.Flush()
+}
+
+// ReadLCOV reads line coverage from LCOV, and other records are ignored
+func ReadLCOV(r io.Reader) (*Coverage, error) {
+	c := NewCoverage()
+	file := ""
+	scanner := bufio.NewScanner(r)
+	for no := 1; scanner.Scan(); no++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(text, "SF:"):
+			file = strings.TrimPrefix(text, "SF:")
+			c.lines(file)
+		case strings.HasPrefix(text, "DA:"):
+			fields := strings.Split(strings.TrimPrefix(text, "DA:"), ",")
+			if len(fields) < 2 || len(file) == 0 {
+				return nil, fmt.Errorf("lcov: invalid record at line %d", no)
+			}
+			line, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("lcov: invalid record at line %d", no)
+			}
+			hits, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("lcov: invalid record at line %d", no)
+			}
+			c.lines(file)[line] += hits
+		case text == "end_of_record":
+			file = ""
+		}
+	}
+	return c, scanner.Err()
+}
+
+// MergeLCOVFile to merge coverage into LCOV file, and file is created when it isn't exist.
+// It's useful to collect coverage of several packages in `go test` as one report.
+// The file is locked by file.lock while merging, so that it could be merged by several processes.
+func (c *Coverage) MergeLCOVFile(file string) error {
+	if err := utils.SafeMkdirs(filepath.Dir(file)); err != nil {
+		return err
+	}
+	unlock, err := lockFile(file+".lock", coverageLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	merged := NewCoverage()
+	if fp, err := os.Open(file); err == nil {
+		old, err := ReadLCOV(fp)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+		merged.Merge(old)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	merged.Merge(c)
+	tmp := file + "." + utils.RandString(8)
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = merged.WriteLCOV(fp); err == nil {
+		err = fp.Close()
+	} else {
+		fp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// coverageLockTimeout is how long MergeLCOVFile waits for lock,
+// and lock older than it is regarded as stale one left by crashed process.
+const coverageLockTimeout = 30 * time.Second
+
+// lockFile creates lock exclusively, and it waits until lock is removed by other process or timeout
+func lockFile(lock string, timeout time.Duration) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fp, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			fp.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > timeout {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout to lock %s", lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *Coverage) lines(file string) map[int]int64 {
+	lines, ok := c.files[file]
+	if !ok {
+		lines = make(map[int]int64)
+		c.files[file] = lines
+	}
+	return lines
+}
+
+// register to record executable lines of proto and its nested functions
+func (c *Coverage) register(file string, proto *lua.FunctionProto) {
+	if _, ok := c.protos[proto]; ok {
+		return
+	}
+	c.protos[proto] = struct{}{}
+	lines := c.lines(file)
+	positions := proto.DbgSourcePositions
+	// the last instruction is the implicit return added by compiler, whose line is end of function
+	if n := len(positions); n > 0 && !containInt(positions[:n-1], positions[n-1]) {
+		positions = positions[:n-1]
+	}
+	for _, line := range positions {
+		if _, ok := lines[line]; !ok && line > 0 {
+			lines[line] = 0
+		}
+	}
+	for _, p := range proto.FunctionPrototypes {
+		c.register(file, p)
+	}
+}
+
+var _ vmHook = &coverageHook{}
+
+type coverageHook struct {
+	coverage *Coverage
+	// last is the line executed by previous instruction, which avoids counting the same line repeatedly
+	lastProto *lua.FunctionProto
+	lastLine  int
+}
+
+func newCoverageHook(coverage *Coverage) *coverageHook {
+	return &coverageHook{coverage: coverage}
+}
+
+func (hook *coverageHook) begin() {
+	hook.lastProto = nil
+	hook.lastLine = 0
+}
+
+func (hook *coverageHook) step(state *lua.LState) error {
+	dbg, ok := state.GetStack(0)
+	if !ok {
+		return nil
+	}
+	fn, err := state.GetInfo("Slf", dbg, lua.LNil)
+	if err != nil {
+		return nil
+	}
+	lfn, ok := fn.(*lua.LFunction)
+	if !ok || lfn.IsG || len(dbg.Source) == 0 || strings.HasPrefix(dbg.Source, "<") || strings.HasPrefix(dbg.Source, "=") {
+		return nil
+	}
+	if lfn.Proto == hook.lastProto && dbg.CurrentLine == hook.lastLine {
+		return nil
+	}
+	hook.lastProto, hook.lastLine = lfn.Proto, dbg.CurrentLine
+	c := hook.coverage
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.register(dbg.Source, lfn.Proto)
+	if _, ok := c.files[dbg.Source][dbg.CurrentLine]; ok {
+		c.files[dbg.Source][dbg.CurrentLine]++
+	}
+	return nil
+}
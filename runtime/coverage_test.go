@@ -0,0 +1,117 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCoverage(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "cover.lua")
+	err := os.WriteFile(script, []byte(`local function check(n)
+	if n > 0 then
+		return "positive"
+	end
+	return "negative"
+end
+for i = 1, 2 do
+	check(arg)
+end`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(arg int) *Coverage {
+		coverage := NewCoverage()
+		vm := NewVirtualMachineWithOpt(LuaVMOpt{Coverage: coverage, Cache: NewCompileCache("")}).Default()
+		vm.SetGlobalVar("arg", lua.LNumber(arg))
+		if err := vm.EvalFile(script); err != nil {
+			t.Fatal(err)
+		}
+		return coverage
+	}
+	positive, negative := run(1), run(-1)
+	if hits, _ := positive.Hits(script, 3); hits != 2 {
+		t.Fatalf("want 2 hits, got %d", hits)
+	}
+	if hits, ok := positive.Hits(script, 5); hits != 0 || !ok {
+		t.Fatalf("want line 5 to be executable without hits, got %d", hits)
+	}
+	lcov := filepath.Join(dir, "lcov.info")
+	if err := positive.MergeLCOVFile(lcov); err != nil {
+		t.Fatal(err)
+	}
+	if err := negative.MergeLCOVFile(lcov); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.Open(lcov)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	merged, err := ReadLCOV(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line, want := range map[int]int64{3: 2, 5: 2, 8: 4} {
+		if hits, _ := merged.Hits(script, line); hits != want {
+			t.Errorf("line %d: want %d hits, got %d", line, want, hits)
+		}
+	}
+	summary := merged.Summary()
+	if len(summary) != 1 || summary[0].Covered != summary[0].Lines {
+		t.Fatal(summary)
+	}
+	buf := &bytes.Buffer{}
+	if err := merged.WriteSummary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "100.0%") {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestCoverageMergeConcurrently(t *testing.T) {
+	lcov := filepath.Join(t.TempDir(), "lcov.info")
+	wg := sync.WaitGroup{}
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := ReadLCOV(strings.NewReader(fmt.Sprintf("SF:a.lua\nDA:%d,1\nend_of_record\n", i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := c.MergeLCOVFile(lcov); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	fp, err := os.Open(lcov)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	merged, err := ReadLCOV(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 8; i++ {
+		if hits, _ := merged.Hits("a.lua", i); hits != 1 {
+			t.Errorf("line %d: want 1 hit, got %d", i, hits)
+		}
+	}
+	if ok, _ := utils.PathIsExist(lcov + ".lock"); ok {
+		t.Fatal("lock isn't removed")
+	}
+}
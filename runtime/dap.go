@@ -0,0 +1,310 @@
+package runtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// dapMessage is the message of Debug Adapter Protocol, which could be request, response or event
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+// dapMaxContentLength is the max size of message body sent by client
+const dapMaxContentLength = 16 << 20
+
+// readDAPMessage reads message which is framed by Content-Length header
+func readDAPMessage(reader *bufio.Reader) (*dapMessage, error) {
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("dap: invalid Content-Length: %s", err)
+	}
+	if length < 0 || length > dapMaxContentLength {
+		return nil, fmt.Errorf("dap: Content-Length %d is out of range [0, %d]", length, dapMaxContentLength)
+	}
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(reader, raw); err != nil {
+		return nil, err
+	}
+	msg := &dapMessage{}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDAPMessage writes message with Content-Length header
+func writeDAPMessage(w io.Writer, msg *dapMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(raw), raw)
+	return err
+}
+
+// dapSession is the connection of DAP client
+type dapSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+	seq    int
+}
+
+func newDAPSession(conn net.Conn) *dapSession {
+	return &dapSession{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (s *dapSession) send(msg *dapMessage, body any) error {
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		msg.Body = raw
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	msg.Seq = s.seq
+	return writeDAPMessage(s.conn, msg)
+}
+
+func (s *dapSession) respond(req *dapMessage, body any, err error) error {
+	msg := &dapMessage{Type: "response", Command: req.Command, RequestSeq: req.Seq, Success: err == nil}
+	if err != nil {
+		msg.Message = err.Error()
+	}
+	return s.send(msg, body)
+}
+
+func (d *Debugger) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		// only one client is served at the same time
+		d.handle(conn)
+	}
+}
+
+func (d *Debugger) handle(conn net.Conn) {
+	session := newDAPSession(conn)
+	d.mutex.Lock()
+	d.session = session
+	d.mutex.Unlock()
+	defer func() {
+		conn.Close()
+		d.detach()
+	}()
+	for {
+		req, err := readDAPMessage(session.reader)
+		if err != nil {
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !d.dispatch(session, req) {
+			return
+		}
+	}
+}
+
+func (d *Debugger) event(name string, body any) {
+	d.mutex.Lock()
+	session := d.session
+	d.mutex.Unlock()
+	if session != nil {
+		session.send(&dapMessage{Type: "event", Event: name}, body)
+	}
+}
+
+// dispatch handles request, and returns false when session should be closed
+func (d *Debugger) dispatch(session *dapSession, req *dapMessage) bool {
+	var (
+		body any
+		err  error
+	)
+	switch req.Command {
+	case "initialize":
+		session.respond(req, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil)
+		d.event("initialized", nil)
+		return true
+	case "launch", "attach":
+	case "configurationDone":
+		d.configOnce.Do(func() { close(d.configured) })
+	case "setBreakpoints":
+		body, err = d.dapSetBreakpoints(req.Arguments)
+	case "threads":
+		body = map[string]any{"threads": []map[string]any{{"id": 1, "name": "main"}}}
+	case "stackTrace":
+		body, err = d.dapStackTrace()
+	case "scopes":
+		body, err = d.dapScopes(req.Arguments)
+	case "variables":
+		body, err = d.dapVariables(req.Arguments)
+	case "evaluate":
+		body, err = d.dapEvaluate(req.Arguments)
+	case "continue":
+		body, err = map[string]any{"allThreadsContinued": true}, d.resume(debugContinue)
+	case "next":
+		err = d.resume(debugStepOver)
+	case "stepIn":
+		err = d.resume(debugStepIn)
+	case "stepOut":
+		err = d.resume(debugStepOut)
+	case "pause":
+		d.Pause()
+	case "disconnect":
+		session.respond(req, nil, nil)
+		return false
+	default:
+		err = fmt.Errorf("dap: unsupported command %s", req.Command)
+	}
+	session.respond(req, body, err)
+	return true
+}
+
+func (d *Debugger) dapSetBreakpoints(raw json.RawMessage) (any, error) {
+	args := struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	lines := []int{}
+	bps := []map[string]any{}
+	for _, bp := range args.Breakpoints {
+		lines = append(lines, bp.Line)
+		bps = append(bps, map[string]any{"verified": true, "line": bp.Line})
+	}
+	d.SetBreakpoints(args.Source.Path, lines)
+	return map[string]any{"breakpoints": bps}, nil
+}
+
+func (d *Debugger) dapStackTrace() (any, error) {
+	frames := []map[string]any{}
+	err := d.inspect(func(state *lua.LState) {
+		for i, frame := range d.frames {
+			dbg := frame.dbg
+			name := dbg.Name
+			switch {
+			case dbg.What == "main":
+				name = "main chunk"
+			case len(name) == 0:
+				name = "?"
+			}
+			f := map[string]any{"id": i + 1, "name": name, "line": dbg.CurrentLine, "column": 1}
+			if dbg.What != "G" {
+				f["source"] = map[string]any{"name": filepath.Base(dbg.Source), "path": debugSource(dbg.Source)}
+			}
+			frames = append(frames, f)
+		}
+	})
+	return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}, err
+}
+
+func (d *Debugger) dapScopes(raw json.RawMessage) (any, error) {
+	args := struct {
+		FrameId int `json:"frameId"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	scopes := []map[string]any{}
+	err := d.inspect(func(state *lua.LState) {
+		if _, ok := d.frame(args.FrameId); !ok {
+			return
+		}
+		for _, kind := range []string{"locals", "upvalues"} {
+			scopes = append(scopes, map[string]any{
+				"name":               strings.ToUpper(kind[:1]) + kind[1:],
+				"variablesReference": d.reference(debugScope{frame: args.FrameId, kind: kind}),
+				"expensive":          false,
+			})
+		}
+		scopes = append(scopes, map[string]any{
+			"name":               "Globals",
+			"variablesReference": d.reference(debugScope{kind: "table", table: state.G.Global}),
+			"expensive":          true,
+		})
+	})
+	return map[string]any{"scopes": scopes}, err
+}
+
+func (d *Debugger) dapVariables(raw json.RawMessage) (any, error) {
+	args := struct {
+		VariablesReference int `json:"variablesReference"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	var vars []map[string]any
+	err := d.inspect(func(state *lua.LState) {
+		vars = d.variables(state, args.VariablesReference)
+	})
+	return map[string]any{"variables": vars}, err
+}
+
+func (d *Debugger) dapEvaluate(raw json.RawMessage) (any, error) {
+	args := struct {
+		Expression string `json:"expression"`
+		FrameId    int    `json:"frameId"`
+	}{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	var body map[string]any
+	var evalErr error
+	err := d.inspect(func(state *lua.LState) {
+		v, err := d.evaluate(state, args.FrameId, args.Expression)
+		if err != nil {
+			evalErr = err
+			return
+		}
+		ref := 0
+		if tbl, ok := v.(*lua.LTable); ok {
+			ref = d.reference(debugScope{kind: "table", table: tbl})
+		}
+		body = map[string]any{"result": debugValue(v), "type": v.Type().String(), "variablesReference": ref}
+	})
+	if err == nil {
+		err = evalErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,530 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DebugOpt is the option of Debugger
+type DebugOpt struct {
+	// Addr is the tcp address which DAP server listens, it defaults to 127.0.0.1:0
+	Addr string
+	// Wait blocks the first execution of vm until client sends configurationDone
+	Wait bool
+}
+
+const (
+	debugContinue = iota
+	debugStepIn
+	debugStepOver
+	debugStepOut
+)
+
+// ErrNotPaused is returned when inspecting vm which isn't paused by debugger
+var ErrNotPaused = errors.New("debugger: vm isn't paused")
+
+// Debugger supports line breakpoints, stepping, inspection of frames and evaluation in frame,
+// and it's exposed over local DAP (Debug Adapter Protocol) server so that editors are able to attach.
+// It should be passed to vm by LuaVMOpt.Debugger, and one debugger only serves one vm.
+type Debugger struct {
+	opt      DebugOpt
+	listener net.Listener
+
+	mutex       sync.Mutex
+	session     *dapSession
+	breakpoints map[string]map[int]bool
+	nbreak      atomic.Int32
+	pauseReq    atomic.Bool
+	configured  chan struct{}
+	configOnce  sync.Once
+	// cmds and resumed are created by vm when it's paused, and resumed is closed when vm is resumed.
+	// They're nil when vm isn't paused, and they're guarded by mutex.
+	cmds    chan debugCmd
+	resumed chan struct{}
+
+	// the followings are only accessed by the goroutine of vm
+	lines      []int
+	sources    map[string]string
+	mode       int
+	stepDepth  int
+	evaluating bool
+	frames     []debugFrame
+	scopes     []debugScope
+}
+
+type debugCmd struct {
+	// fn is executed on the goroutine of vm when it isn't nil, otherwise vm resumes with mode
+	fn   func(*lua.LState)
+	mode int
+	done chan struct{}
+}
+
+type debugFrame struct {
+	dbg *lua.Debug
+	fn  *lua.LFunction
+}
+
+// debugScope is referenced by variablesReference of DAP
+type debugScope struct {
+	frame int
+	kind  string
+	table *lua.LTable
+}
+
+var _ vmHook = &Debugger{}
+
+// NewDebugger creates debugger and starts DAP server in background
+func NewDebugger(opt DebugOpt) (*Debugger, error) {
+	if len(opt.Addr) == 0 {
+		opt.Addr = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", opt.Addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &Debugger{
+		opt:         opt,
+		listener:    listener,
+		breakpoints: make(map[string]map[int]bool),
+		configured:  make(chan struct{}),
+		sources:     make(map[string]string),
+	}
+	go d.serve()
+	return d, nil
+}
+
+// Addr returns the address which DAP server listens
+func (d *Debugger) Addr() string {
+	return d.listener.Addr().String()
+}
+
+// Close to stop DAP server, and paused vm will be resumed after client is disconnected
+func (d *Debugger) Close() error {
+	err := d.listener.Close()
+	d.mutex.Lock()
+	if d.session != nil {
+		d.session.conn.Close()
+	}
+	d.mutex.Unlock()
+	d.configOnce.Do(func() { close(d.configured) })
+	return err
+}
+
+// SetBreakpoints to replace breakpoints of source file
+func (d *Debugger) SetBreakpoints(source string, lines []int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	source = debugSource(source)
+	if len(lines) == 0 {
+		delete(d.breakpoints, source)
+	} else {
+		d.breakpoints[source] = make(map[int]bool)
+		for _, line := range lines {
+			d.breakpoints[source][line] = true
+		}
+	}
+	n := 0
+	for _, bps := range d.breakpoints {
+		n += len(bps)
+	}
+	d.nbreak.Store(int32(n))
+}
+
+// Pause to request vm to be paused before next line
+func (d *Debugger) Pause() {
+	d.pauseReq.Store(true)
+}
+
+func (d *Debugger) begin() {
+	if d.opt.Wait {
+		<-d.configured
+	}
+	d.lines = d.lines[:0]
+	d.mode = debugContinue
+}
+
+func (d *Debugger) step(state *lua.LState) error {
+	if d.evaluating {
+		return nil
+	}
+	if d.mode == debugContinue && d.nbreak.Load() == 0 && !d.pauseReq.Load() {
+		d.lines = d.lines[:0]
+		return nil
+	}
+	dbg, ok := state.GetStack(0)
+	if !ok {
+		return nil
+	}
+	if _, err := state.GetInfo("Sl", dbg, lua.LNil); err != nil {
+		return nil
+	}
+	depth := debugDepth(state)
+	newLine := d.track(depth, dbg.CurrentLine)
+	reason := ""
+	switch {
+	case d.pauseReq.Load() && newLine:
+		reason = "pause"
+	case d.mode == debugStepIn && newLine:
+		reason = "step"
+	case d.mode == debugStepOver && (depth < d.stepDepth || depth == d.stepDepth && newLine):
+		reason = "step"
+	case d.mode == debugStepOut && depth < d.stepDepth:
+		reason = "step"
+	case newLine && d.hitBreakpoint(dbg.Source, dbg.CurrentLine):
+		reason = "breakpoint"
+	}
+	if len(reason) > 0 {
+		d.stop(state, reason, depth)
+	}
+	return nil
+}
+
+// track records the current line of every depth, and returns whether a new line is reached
+func (d *Debugger) track(depth, line int) bool {
+	if len(d.lines) > depth {
+		d.lines = d.lines[:depth]
+	}
+	for len(d.lines) < depth {
+		d.lines = append(d.lines, -1)
+	}
+	if d.lines[depth-1] == line {
+		return false
+	}
+	d.lines[depth-1] = line
+	return true
+}
+
+func (d *Debugger) hitBreakpoint(source string, line int) bool {
+	if d.nbreak.Load() == 0 {
+		return false
+	}
+	src, ok := d.sources[source]
+	if !ok {
+		src = debugSource(source)
+		d.sources[source] = src
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.breakpoints[src][line]
+}
+
+// stop blocks vm and executes commands from DAP server until vm is resumed
+func (d *Debugger) stop(state *lua.LState, reason string, depth int) {
+	d.pauseReq.Store(false)
+	// session and paused state are changed together, so that detach either sees paused vm or
+	// vm sees detached session, and vm isn't blocked without client.
+	d.mutex.Lock()
+	if d.session == nil {
+		d.mutex.Unlock()
+		d.mode = debugContinue
+		return
+	}
+	cmds, resumed := make(chan debugCmd), make(chan struct{})
+	d.cmds, d.resumed = cmds, resumed
+	d.mutex.Unlock()
+	d.frames = debugFrames(state)
+	d.scopes = nil
+	d.event("stopped", map[string]any{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	for cmd := range cmds {
+		if cmd.fn != nil {
+			cmd.fn(state)
+			close(cmd.done)
+			continue
+		}
+		d.mutex.Lock()
+		d.cmds, d.resumed = nil, nil
+		d.mutex.Unlock()
+		close(resumed)
+		d.mode = cmd.mode
+		d.stepDepth = depth
+		d.frames = nil
+		d.scopes = nil
+		close(cmd.done)
+		return
+	}
+}
+
+// inspect executes fn on the goroutine of paused vm
+func (d *Debugger) inspect(fn func(*lua.LState)) error {
+	return d.send(debugCmd{fn: fn, done: make(chan struct{})})
+}
+
+// resume to continue paused vm with mode
+func (d *Debugger) resume(mode int) error {
+	return d.send(debugCmd{mode: mode, done: make(chan struct{})})
+}
+
+// send cmd to paused vm and wait for it, and ErrNotPaused is returned when vm isn't paused
+// or it's resumed by other command before cmd is received.
+func (d *Debugger) send(cmd debugCmd) error {
+	d.mutex.Lock()
+	cmds, resumed := d.cmds, d.resumed
+	d.mutex.Unlock()
+	if cmds == nil {
+		return ErrNotPaused
+	}
+	select {
+	case cmds <- cmd:
+		<-cmd.done
+		return nil
+	case <-resumed:
+		return ErrNotPaused
+	}
+}
+
+// detach to clear breakpoints and resume vm when client is disconnected
+func (d *Debugger) detach() {
+	d.mutex.Lock()
+	d.breakpoints = make(map[string]map[int]bool)
+	d.session = nil
+	d.mutex.Unlock()
+	d.nbreak.Store(0)
+	d.pauseReq.Store(false)
+	d.configOnce.Do(func() { close(d.configured) })
+	d.resume(debugContinue)
+}
+
+// frame returns the frame paused according to id of DAP
+func (d *Debugger) frame(id int) (debugFrame, bool) {
+	if id < 1 || id > len(d.frames) {
+		return debugFrame{}, false
+	}
+	return d.frames[id-1], true
+}
+
+// reference returns variablesReference of scope
+func (d *Debugger) reference(scope debugScope) int {
+	d.scopes = append(d.scopes, scope)
+	return len(d.scopes)
+}
+
+// variables returns the variables of scope which is referenced by ref
+func (d *Debugger) variables(state *lua.LState, ref int) []map[string]any {
+	vars := []map[string]any{}
+	if ref < 1 || ref > len(d.scopes) {
+		return vars
+	}
+	add := func(name string, v lua.LValue) {
+		variable := map[string]any{
+			"name":               name,
+			"value":              debugValue(v),
+			"type":               v.Type().String(),
+			"variablesReference": 0,
+		}
+		if tbl, ok := v.(*lua.LTable); ok {
+			variable["variablesReference"] = d.reference(debugScope{kind: "table", table: tbl})
+		}
+		vars = append(vars, variable)
+	}
+	scope := d.scopes[ref-1]
+	frame, _ := d.frame(scope.frame)
+	switch scope.kind {
+	case "locals":
+		names, values := debugLocals(state, frame)
+		for i, name := range names {
+			if !strings.HasPrefix(name, "(") {
+				add(name, values[i])
+			}
+		}
+	case "upvalues":
+		if frame.fn == nil {
+			break
+		}
+		for i := 1; i <= len(frame.fn.Upvalues); i++ {
+			name, v := state.GetUpvalue(frame.fn, i)
+			add(name, v)
+		}
+	case "table":
+		keys := []lua.LValue{}
+		scope.table.ForEach(func(k, _ lua.LValue) {
+			keys = append(keys, k)
+		})
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, k := range keys {
+			add(k.String(), scope.table.RawGet(k))
+		}
+	}
+	return vars
+}
+
+// evaluate executes expression in frame, whose locals and upvalues are visible.
+// Expression is executed by a new thread in order not to break the stack of paused vm.
+func (d *Debugger) evaluate(state *lua.LState, id int, expr string) (lua.LValue, error) {
+	proto, err := compileChunk([]byte("return "+expr), "=(eval)")
+	if err != nil {
+		if proto, err = compileChunk([]byte(expr), "=(eval)"); err != nil {
+			return nil, err
+		}
+	}
+	d.evaluating = true
+	defer func() { d.evaluating = false }()
+	thread, cancel := state.NewThread()
+	if cancel != nil {
+		defer cancel()
+	}
+	frame, _ := d.frame(id)
+	env := thread.NewTable()
+	meta := thread.NewTable()
+	meta.RawSetString("__index", thread.NewFunction(func(l *lua.LState) int {
+		l.Push(debugLookup(state, frame, l.CheckString(2)))
+		return 1
+	}))
+	thread.SetMetatable(env, meta)
+	fn := thread.NewFunctionFromProto(proto)
+	fn.Env = env
+	thread.Push(fn)
+	if err := thread.PCall(0, 1, nil); err != nil {
+		return nil, err
+	}
+	return thread.Get(-1), nil
+}
+
+// debugLookup resolves name as local, upvalue and global of frame in order
+func debugLookup(state *lua.LState, frame debugFrame, name string) lua.LValue {
+	names, values := debugLocals(state, frame)
+	for i := len(names) - 1; i >= 0; i-- {
+		if names[i] == name {
+			return values[i]
+		}
+	}
+	if frame.fn != nil {
+		for i := 1; i <= len(frame.fn.Upvalues); i++ {
+			if n, v := state.GetUpvalue(frame.fn, i); n == name {
+				return v
+			}
+		}
+	}
+	return state.G.Global.RawGetString(name)
+}
+
+// debugLocals returns names and values of active locals in frame.
+// LState.GetLocal can't see parameters at the first instruction of function,
+// so that locals are resolved from pc and registers of frame by reflection,
+// and they're got by GetLocal instead when internals of gopher-lua are changed.
+func debugLocals(state *lua.LState, frame debugFrame) ([]string, []lua.LValue) {
+	if frame.dbg == nil || frame.fn == nil || frame.fn.IsG {
+		return nil, nil
+	}
+	if names, values, err := debugRegLocals(state, frame); err == nil {
+		return names, values
+	}
+	return debugGetLocals(state, frame)
+}
+
+// debugGetLocals returns locals of frame by GetLocal
+func debugGetLocals(state *lua.LState, frame debugFrame) ([]string, []lua.LValue) {
+	names, values := []string{}, []lua.LValue{}
+	for n := 1; ; n++ {
+		name, v := state.GetLocal(frame.dbg, n)
+		if len(name) == 0 {
+			break
+		}
+		names = append(names, name)
+		values = append(values, v)
+	}
+	return names, values
+}
+
+// debugRegLocals resolves locals from registers of state by reflection,
+// and the panic of reflection is recovered as error.
+func debugRegLocals(state *lua.LState, frame debugFrame) (names []string, values []lua.LValue, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			names, values, err = nil, nil, fmt.Errorf("locals unavailable: %v", r)
+		}
+	}()
+	pc, base := debugFrameField(frame.dbg, "Pc")-1, debugFrameField(frame.dbg, "LocalBase")
+	if base < 0 {
+		return nil, nil, errors.New("locals unavailable: frame not found")
+	}
+	reg := utils.NewReflectObject(state).Get("reg").Interface()
+	regs, ok := utils.NewReflectObject(reg).Get("array").Interface().([]lua.LValue)
+	if !ok {
+		return nil, nil, errors.New("locals unavailable: registers not found")
+	}
+	names, values = []string{}, []lua.LValue{}
+	for _, local := range frame.fn.Proto.DbgLocals {
+		if local.StartPc > pc {
+			break
+		}
+		if pc >= local.EndPc {
+			continue
+		}
+		if idx := base + len(names); idx < len(regs) {
+			names = append(names, local.Name)
+			values = append(values, regs[idx])
+		}
+	}
+	return names, values, nil
+}
+
+// debugFrameField returns the integer field of call frame, such as Pc and LocalBase,
+// and it returns -1 when frame or field is unavailable.
+func debugFrameField(dbg *lua.Debug, field string) int {
+	cf := reflect.ValueOf(dbg).Elem().FieldByName("frame")
+	if cf.Kind() != reflect.Ptr || cf.IsNil() {
+		return -1
+	}
+	if v := cf.Elem().FieldByName(field); v.CanInt() {
+		return int(v.Int())
+	}
+	return -1
+}
+
+func debugFrames(state *lua.LState) []debugFrame {
+	frames := []debugFrame{}
+	for level := 0; ; level++ {
+		dbg, ok := state.GetStack(level)
+		if !ok {
+			break
+		}
+		fn, _ := state.GetInfo("nSlf", dbg, lua.LNil)
+		frame := debugFrame{dbg: dbg}
+		frame.fn, _ = fn.(*lua.LFunction)
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// debugDepth returns the depth of call stack
+func debugDepth(state *lua.LState) int {
+	depth := 0
+	for {
+		if _, ok := state.GetStack(depth); !ok {
+			return depth
+		}
+		depth++
+	}
+}
+
+// debugSource normalizes the path of source to match breakpoints
+func debugSource(source string) string {
+	if len(source) == 0 || strings.HasPrefix(source, "<") || strings.HasPrefix(source, "=") {
+		return source
+	}
+	if abs, err := filepath.Abs(source); err == nil {
+		source = abs
+	}
+	return filepath.Clean(source)
+}
+
+func debugValue(v lua.LValue) string {
+	if s, ok := v.(lua.LString); ok {
+		return strconv.Quote(string(s))
+	}
+	return v.String()
+}
@@ -0,0 +1,264 @@
+package runtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type dapClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    int
+	events []*dapMessage
+}
+
+func (c *dapClient) request(t *testing.T, command string, args any) json.RawMessage {
+	c.seq++
+	raw, _ := json.Marshal(args)
+	if err := writeDAPMessage(c.conn, &dapMessage{Seq: c.seq, Type: "request", Command: command, Arguments: raw}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := readDAPMessage(c.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.RequestSeq == c.seq {
+			if !msg.Success {
+				t.Fatalf("%s: %s", command, msg.Message)
+			}
+			return msg.Body
+		}
+	}
+}
+
+func (c *dapClient) wait(t *testing.T, event string) *dapMessage {
+	for {
+		if len(c.events) > 0 {
+			msg := c.events[0]
+			c.events = c.events[1:]
+			if msg.Event == event {
+				return msg
+			}
+			continue
+		}
+		msg, err := readDAPMessage(c.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.events = append(c.events, msg)
+	}
+}
+
+// stopAt waits stopped event, and returns the top frame whose line should be want
+func (c *dapClient) stopAt(t *testing.T, want int) int {
+	c.wait(t, "stopped")
+	body := struct {
+		StackFrames []struct {
+			Id   int `json:"id"`
+			Line int `json:"line"`
+		} `json:"stackFrames"`
+	}{}
+	json.Unmarshal(c.request(t, "stackTrace", map[string]any{"threadId": 1}), &body)
+	if len(body.StackFrames) == 0 || body.StackFrames[0].Line != want {
+		t.Fatalf("want line %d, got %v", want, body.StackFrames)
+	}
+	return body.StackFrames[0].Id
+}
+
+func TestDebugger(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "debug.lua")
+	err := os.WriteFile(script, []byte(`local base = 100
+local function add(a, b)
+	local sum = a + b + base
+	return sum
+end
+local total = 0
+for i = 1, 3 do
+	total = add(total, i)
+end
+result = total`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugger, err := NewDebugger(DebugOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer debugger.Close()
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Debugger: debugger}).Default()
+	conn, err := net.Dial("tcp", debugger.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &dapClient{conn: conn, reader: bufio.NewReader(conn)}
+	client.request(t, "initialize", map[string]any{"adapterID": "cushion"})
+	client.wait(t, "initialized")
+	client.request(t, "setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": script},
+		"breakpoints": []map[string]any{{"line": 3}},
+	})
+	client.request(t, "configurationDone", nil)
+	done := make(chan error)
+	go func() {
+		done <- vm.EvalFile(script)
+	}()
+
+	frame := client.stopAt(t, 3)
+	scopes := struct {
+		Scopes []struct {
+			Name               string `json:"name"`
+			VariablesReference int    `json:"variablesReference"`
+		} `json:"scopes"`
+	}{}
+	json.Unmarshal(client.request(t, "scopes", map[string]any{"frameId": frame}), &scopes)
+	vars := map[string]string{}
+	for _, scope := range scopes.Scopes[:2] {
+		body := struct {
+			Variables []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"variables"`
+		}{}
+		json.Unmarshal(client.request(t, "variables", map[string]any{"variablesReference": scope.VariablesReference}), &body)
+		for _, v := range body.Variables {
+			vars[scope.Name+"."+v.Name] = v.Value
+		}
+	}
+	if vars["Locals.a"] != "0" || vars["Locals.b"] != "1" || vars["Upvalues.base"] != "100" {
+		t.Fatal(vars)
+	}
+	eval := struct {
+		Result string `json:"result"`
+	}{}
+	json.Unmarshal(client.request(t, "evaluate", map[string]any{"frameId": frame, "expression": "(a + b) * 2 + base"}), &eval)
+	if eval.Result != "102" {
+		t.Fatal(eval.Result)
+	}
+
+	client.request(t, "next", map[string]any{"threadId": 1})
+	frame = client.stopAt(t, 4)
+	json.Unmarshal(client.request(t, "evaluate", map[string]any{"frameId": frame, "expression": "sum"}), &eval)
+	if eval.Result != "101" {
+		t.Fatal(eval.Result)
+	}
+	client.request(t, "stepOut", map[string]any{"threadId": 1})
+	client.stopAt(t, 8)
+	client.request(t, "next", map[string]any{"threadId": 1})
+	client.stopAt(t, 7)
+	client.request(t, "stepIn", map[string]any{"threadId": 1})
+	client.stopAt(t, 8)
+	client.request(t, "stepIn", map[string]any{"threadId": 1})
+	client.stopAt(t, 3)
+	client.request(t, "setBreakpoints", map[string]any{"source": map[string]any{"path": script}})
+	client.request(t, "continue", map[string]any{"threadId": 1})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.GetGlobalVar("result").String(); got != "306" {
+		t.Fatal(got)
+	}
+}
+
+func TestDebuggerDetach(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "detach.lua")
+	err := os.WriteFile(script, []byte(`local total = 0
+for i = 1, 1000 do
+	total = total + i
+end
+result = total`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		debugger, err := NewDebugger(DebugOpt{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm := NewVirtualMachineWithOpt(LuaVMOpt{Debugger: debugger}).Default()
+		conn, err := net.Dial("tcp", debugger.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &dapClient{conn: conn, reader: bufio.NewReader(conn)}
+		client.request(t, "initialize", map[string]any{"adapterID": "cushion"})
+		client.request(t, "setBreakpoints", map[string]any{
+			"source":      map[string]any{"path": script},
+			"breakpoints": []map[string]any{{"line": 3}},
+		})
+		client.request(t, "configurationDone", nil)
+		done := make(chan error)
+		go func() {
+			done <- vm.EvalFile(script)
+		}()
+		// client is disconnected when vm may be stopping at breakpoint
+		time.Sleep(time.Duration(i) * 50 * time.Microsecond)
+		conn.Close()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("vm is blocked after client is disconnected")
+		}
+		debugger.Close()
+	}
+}
+
+func TestReadDAPMessage(t *testing.T) {
+	for _, header := range []string{"Content-Length: -1", "Content-Length: 1099511627776", "Content-Length: x"} {
+		_, err := readDAPMessage(bufio.NewReader(strings.NewReader(header + "\r\n\r\n{}")))
+		if err == nil {
+			t.Fatalf("%s: error expected", header)
+		}
+		fmt.Println(err)
+	}
+	msg, err := readDAPMessage(bufio.NewReader(strings.NewReader("Content-Length: 16\r\n\r\n{\"type\":\"event\"}")))
+	if err != nil || msg.Type != "event" {
+		t.Fatal(msg, err)
+	}
+}
+
+func TestDebugLocals(t *testing.T) {
+	vm := NewVirtualMachine()
+	state := vm.Interp()
+	var regNames, getNames []string
+	state.SetGlobal("inspect", state.NewFunction(func(lvm *lua.LState) int {
+		frame := debugFrames(lvm)[1]
+		names, values, err := debugRegLocals(lvm, frame)
+		if err != nil {
+			t.Error(err)
+		}
+		regNames = names
+		getNames, _ = debugGetLocals(lvm, frame)
+		if len(values) != 2 || values[1].String() != "local" {
+			t.Errorf("unexpected values %v", values)
+		}
+		return 0
+	}))
+	if err := vm.Eval(`local function f(a) local b = "local" inspect() end f(1)`); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(regNames, ",") != "a,b" || strings.Join(getNames, ",") != "a,b" {
+		t.Fatalf("want a,b, got %v and %v", regNames, getNames)
+	}
+	// it degrades instead of panicking when frame isn't available
+	if _, _, err := debugRegLocals(state, debugFrame{dbg: &lua.Debug{}, fn: &lua.LFunction{Proto: &lua.FunctionProto{}}}); err == nil {
+		t.Fatal("error expected")
+	}
+}
@@ -0,0 +1,677 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// formats supported by cushion-encoding
+var encodingFormats = []string{"json", "yaml", "toml", "ini"}
+
+// Decoded objects of cushion-encoding carry the order of keys in the field __order of metatable,
+// and decoded empty arrays are marked by the field __array, so that they're encoded as it is.
+const (
+	encodingOrderKey = "__order"
+	encodingArrayKey = "__array"
+)
+
+// encodingOpt is the option of cushion-encoding.encode
+type encodingOpt struct {
+	// Pretty to indent JSON and tables of TOML
+	Pretty bool `lua:"pretty"`
+	// Indent is the number of spaces, it defaults to 2
+	Indent int `lua:"indent"`
+	// SortKeys to ignore the order of decoded keys
+	SortKeys bool `lua:"sort_keys"`
+}
+
+// orderedMap is the object of data format, which keeps keys in order of source
+type orderedMap struct {
+	keys   []string
+	values map[string]any
+}
+
+func newOrderedMap() *orderedMap {
+	return &orderedMap{values: make(map[string]any)}
+}
+
+func (m *orderedMap) set(k string, v any) {
+	if _, ok := m.values[k]; !ok {
+		m.keys = append(m.keys, k)
+	}
+	m.values[k] = v
+}
+
+// decodeFormat to parse data of format into orderedMap, []any and scalars
+func decodeFormat(format string, data []byte) (any, error) {
+	switch format {
+	case "json":
+		return decodeJSON(data)
+	case "yaml":
+		return decodeYAML(data)
+	case "toml":
+		return decodeTOML(data)
+	case "ini":
+		return decodeINI(data)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// encodeFormat to write value returned by encodingFromLua as format
+func encodeFormat(format string, v any, opt encodingOpt) ([]byte, error) {
+	if opt.Indent <= 0 {
+		opt.Indent = 2
+	}
+	switch format {
+	case "json":
+		return encodeJSON(v, opt)
+	case "yaml":
+		return encodeYAML(v, opt)
+	case "toml":
+		return encodeTOML(v, opt)
+	case "ini":
+		return encodeINI(v)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("json: invalid character after top-level value")
+	}
+	return v, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			m := newOrderedMap()
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				m.set(k.(string), v)
+			}
+			_, err = dec.Token()
+			return m, err
+		}
+		arr := []any{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err = dec.Token()
+		return arr, err
+	case json.Number:
+		return t.Float64()
+	}
+	return tok, nil
+}
+
+func encodeJSON(v any, opt encodingOpt) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := writeJSON(buf, v); err != nil {
+		return nil, err
+	}
+	if !opt.Pretty {
+		return buf.Bytes(), nil
+	}
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, buf.Bytes(), "", strings.Repeat(" ", opt.Indent)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func writeJSON(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case *orderedMap:
+		buf.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, k)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, v.values[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []any:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case string:
+		writeJSONString(buf, v)
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(raw)
+	}
+	return nil
+}
+
+// writeJSONString quotes s without escaping HTML characters
+func writeJSONString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	buf.Truncate(buf.Len() - 1)
+}
+
+func decodeYAML(data []byte) (any, error) {
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal(data, node); err != nil {
+		return nil, err
+	}
+	return yamlNodeValue(node)
+}
+
+func yamlNodeValue(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case 0:
+		return nil, nil
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlNodeValue(node.Alias)
+	case yaml.SequenceNode:
+		arr := []any{}
+		for _, item := range node.Content {
+			v, err := yamlNodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case yaml.MappingNode:
+		m := newOrderedMap()
+		merged := []*orderedMap{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v, err := yamlNodeValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if node.Content[i].Tag == "!!merge" {
+				// keys of merged mapping don't override keys of mapping itself
+				switch v := v.(type) {
+				case *orderedMap:
+					merged = append(merged, v)
+				case []any:
+					for _, item := range v {
+						if im, ok := item.(*orderedMap); ok {
+							merged = append(merged, im)
+						}
+					}
+				}
+				continue
+			}
+			m.set(node.Content[i].Value, v)
+		}
+		for _, mm := range merged {
+			for _, k := range mm.keys {
+				if _, ok := m.values[k]; !ok {
+					m.set(k, mm.values[k])
+				}
+			}
+		}
+		return m, nil
+	}
+	var v any
+	if err := node.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func encodeYAML(v any, opt encodingOpt) ([]byte, error) {
+	node, err := yamlNode(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(opt.Indent)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func yamlNode(v any) (*yaml.Node, error) {
+	switch v := v.(type) {
+	case *orderedMap:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		if len(v.keys) == 0 {
+			node.Style = yaml.FlowStyle
+		}
+		for _, k := range v.keys {
+			item, err := yamlNode(v.values[k])
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, item)
+		}
+		return node, nil
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		if len(v) == 0 {
+			node.Style = yaml.FlowStyle
+		}
+		for _, item := range v {
+			n, err := yamlNode(item)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, n)
+		}
+		return node, nil
+	}
+	node := &yaml.Node{}
+	err := node.Encode(v)
+	return node, err
+}
+
+// decodeTOML parses data by go-toml, whose keys are sorted because the order of table isn't kept
+func decodeTOML(data []byte) (any, error) {
+	doc := make(map[string]any)
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return sortedValue(doc), nil
+}
+
+func sortedValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m := newOrderedMap()
+		for _, k := range keys {
+			m.set(k, sortedValue(v[k]))
+		}
+		return m
+	case []any:
+		arr := make([]any, 0, len(v))
+		for _, item := range v {
+			arr = append(arr, sortedValue(item))
+		}
+		return arr
+	}
+	return v
+}
+
+func encodeTOML(v any, opt encodingOpt) ([]byte, error) {
+	m, ok := v.(*orderedMap)
+	if !ok {
+		return nil, errors.New("toml: table is expected")
+	}
+	buf := &bytes.Buffer{}
+	enc := toml.NewEncoder(buf)
+	if opt.Pretty {
+		enc.SetIndentTables(true)
+		enc.SetIndentSymbol(strings.Repeat(" ", opt.Indent))
+	}
+	if err := enc.Encode(plainValue(m)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// plainValue converts orderedMap into map[string]any, which is sorted by encoder of TOML
+func plainValue(v any) any {
+	switch v := v.(type) {
+	case *orderedMap:
+		m := make(map[string]any, len(v.keys))
+		for _, k := range v.keys {
+			m[k] = plainValue(v.values[k])
+		}
+		return m
+	case []any:
+		arr := make([]any, 0, len(v))
+		for _, item := range v {
+			arr = append(arr, plainValue(item))
+		}
+		return arr
+	}
+	return v
+}
+
+// decodeINI parses data by ini, and the keys of default section are placed in top level,
+// while other sections are tables. Values of ini are always string.
+func decodeINI(data []byte) (any, error) {
+	file, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	m := newOrderedMap()
+	for _, section := range file.Sections() {
+		target := m
+		if section.Name() != ini.DefaultSection {
+			target = newOrderedMap()
+			m.set(section.Name(), target)
+		}
+		for _, key := range section.Keys() {
+			target.set(key.Name(), key.Value())
+		}
+	}
+	return m, nil
+}
+
+func encodeINI(v any) ([]byte, error) {
+	m, ok := v.(*orderedMap)
+	if !ok {
+		return nil, errors.New("ini: table is expected")
+	}
+	file := ini.Empty()
+	for _, k := range m.keys {
+		if sm, ok := m.values[k].(*orderedMap); ok {
+			section, err := file.NewSection(k)
+			if err != nil {
+				return nil, err
+			}
+			for _, sk := range sm.keys {
+				if err := newINIKey(section, k+"."+sk, sk, sm.values[sk]); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := newINIKey(file.Section(""), k, k, m.values[k]); err != nil {
+			return nil, err
+		}
+	}
+	buf := &bytes.Buffer{}
+	if _, err := file.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newINIKey to add scalar into section, and array of scalars is joined with comma
+func newINIKey(section *ini.Section, p, name string, v any) error {
+	value, ok := iniScalar(v)
+	if arr, isArr := v.([]any); isArr {
+		items := []string{}
+		for _, item := range arr {
+			s, ok := iniScalar(item)
+			if !ok {
+				return &CodecError{Path: p, Msg: "array of ini should only contain scalars"}
+			}
+			items = append(items, s)
+		}
+		value, ok = strings.Join(items, ","), true
+	}
+	if !ok {
+		return &CodecError{Path: p, Msg: "ini only supports one level of section"}
+	}
+	_, err := section.NewKey(name, value)
+	return err
+}
+
+func iniScalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+// encodingToLua converts decoded value into lua value, and objects keep the order of keys in metatable
+func encodingToLua(lvm *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case time.Time:
+		return lua.LString(v.Format(time.RFC3339Nano))
+	case *orderedMap:
+		tbl := lvm.CreateTable(0, len(v.keys))
+		order := lvm.CreateTable(len(v.keys), 0)
+		for _, k := range v.keys {
+			tbl.RawSetString(k, encodingToLua(lvm, v.values[k]))
+			order.Append(lua.LString(k))
+		}
+		meta := lvm.NewTable()
+		meta.RawSetString(encodingOrderKey, order)
+		lvm.SetMetatable(tbl, meta)
+		return tbl
+	case []any:
+		tbl := lvm.CreateTable(len(v), 0)
+		for _, item := range v {
+			tbl.Append(encodingToLua(lvm, item))
+		}
+		if len(v) == 0 {
+			meta := lvm.NewTable()
+			meta.RawSetString(encodingArrayKey, lua.LTrue)
+			lvm.SetMetatable(tbl, meta)
+		}
+		return tbl
+	}
+	// such as local date and time of TOML
+	return lua.LString(fmt.Sprint(v))
+}
+
+// encodingFromLua converts lua value into orderedMap, []any and scalars.
+// Table is array when it's sequence or marked by __array, otherwise it's object whose keys
+// are ordered by __order at first, and the rest of keys are sorted.
+// Integral number is converted into int64, so that it isn't written as float.
+// It returns CodecError when table is cyclic.
+func encodingFromLua(p string, lv lua.LValue, sortKeys bool) (any, error) {
+	return encodingFromLuaSeen(p, lv, sortKeys, make(map[*lua.LTable]bool))
+}
+
+// encodingFromLuaSeen converts lv, and seen is tables being converted to detect cycle
+func encodingFromLuaSeen(p string, lv lua.LValue, sortKeys bool, seen map[*lua.LTable]bool) (any, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), nil
+		}
+		return f, nil
+	case *lua.LTable:
+		if seen[v] {
+			return nil, &CodecError{Path: p, Msg: "cyclic table can't be encoded"}
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		meta, _ := v.Metatable.(*lua.LTable)
+		n := v.Len()
+		if (n > 0 && isArray(v, n)) || (meta != nil && lua.LVAsBool(meta.RawGetString(encodingArrayKey)) && n == 0) {
+			arr := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := encodingFromLuaSeen(fmt.Sprintf("%s[%d]", p, i), v.RawGetInt(i), sortKeys, seen)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, item)
+			}
+			return arr, nil
+		}
+		keys := []string{}
+		if meta != nil && !sortKeys {
+			if order, ok := meta.RawGetString(encodingOrderKey).(*lua.LTable); ok {
+				order.ForEach(func(_, k lua.LValue) {
+					if v.RawGet(k) != lua.LNil && !containStr(keys, k.String()) {
+						keys = append(keys, k.String())
+					}
+				})
+			}
+		}
+		rest := []string{}
+		values := make(map[string]lua.LValue)
+		v.ForEach(func(k, val lua.LValue) {
+			values[k.String()] = val
+			if !containStr(keys, k.String()) {
+				rest = append(rest, k.String())
+			}
+		})
+		sort.Strings(rest)
+		m := newOrderedMap()
+		for _, k := range append(keys, rest...) {
+			item, err := encodingFromLuaSeen(joinPath(p, lua.LString(k)), values[k], sortKeys, seen)
+			if err != nil {
+				return nil, err
+			}
+			m.set(k, item)
+		}
+		return m, nil
+	}
+	return nil, &CodecError{Path: p, Msg: fmt.Sprintf("%s can't be encoded", lv.Type())}
+}
+
+func loadEncoding(lvm *lua.LState) int {
+	mod := lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+		"decode": encodingDecode,
+		"encode": encodingEncode,
+	})
+	for _, format := range encodingFormats {
+		mod.RawSetString(format, lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+			"decode": encodingFormatDecode(format),
+			"encode": encodingFormatEncode(format),
+		}))
+	}
+	lvm.Push(mod)
+	return 1
+}
+
+// encodingDecode returns the value decoded from text of format, or nil with error when text is malformed
+//
+//	local cfg, err = encoding.decode("yaml", text)
+func encodingDecode(lvm *lua.LState) int {
+	format := checkEncodingFormat(lvm, 1)
+	lvm.Remove(1)
+	return encodingFormatDecode(format)(lvm)
+}
+
+// encodingEncode returns the text of value as format, options are pretty, indent and sort_keys
+//
+//	local text, err = encoding.encode("json", cfg, { pretty = true })
+func encodingEncode(lvm *lua.LState) int {
+	format := checkEncodingFormat(lvm, 1)
+	lvm.Remove(1)
+	return encodingFormatEncode(format)(lvm)
+}
+
+func checkEncodingFormat(lvm *lua.LState, n int) string {
+	format := strings.ToLower(lvm.CheckString(n))
+	if !containStr(encodingFormats, format) {
+		raiseError(lvm, fmt.Errorf("unsupported format %q, expected %s", format, strings.Join(encodingFormats, ", ")))
+	}
+	return format
+}
+
+func encodingFormatDecode(format string) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		v, err := decodeFormat(format, []byte(lvm.CheckString(1)))
+		if err != nil {
+			lvm.Push(lua.LNil)
+			errHandle(lvm, err)
+			return 2
+		}
+		lvm.Push(encodingToLua(lvm, v))
+		lvm.Push(lua.LNil)
+		return 2
+	}
+}
+
+func encodingFormatEncode(format string) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		value := lvm.CheckAny(1)
+		opt := encodingOpt{}
+		if lvm.GetTop() >= 2 && lvm.Get(2) != lua.LNil {
+			if err := DecodeWithPath("opt", lvm.CheckTable(2), &opt); err != nil {
+				raiseError(lvm, err)
+			}
+		}
+		v, err := encodingFromLua("", value, opt.SortKeys)
+		if err != nil {
+			raiseError(lvm, err)
+		}
+		raw, err := encodeFormat(format, v, opt)
+		if err != nil {
+			lvm.Push(lua.LNil)
+			errHandle(lvm, err)
+			return 2
+		}
+		lvm.Push(lua.LString(raw))
+		lvm.Push(lua.LNil)
+		return 2
+	}
+}
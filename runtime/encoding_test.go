@@ -0,0 +1,65 @@
+package runtime
+
+import "testing"
+
+func TestEncoding(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+Import({"cushion-encoding"})
+local encoding = require("cushion-encoding")
+local cfg, err = encoding.decode("json", '{"name":"cushion","tags":[],"deps":{"zap":"1.21","lua":"1.1"},"port":8080}')
+assert(err == nil)
+local out = encoding.json.encode(cfg)
+print(out)
+assert(out == '{"name":"cushion","tags":[],"deps":{"zap":"1.21","lua":"1.1"},"port":8080}')
+print(encoding.encode("json", { b = 1, a = { 1, 2, 3 } }, { pretty = true }))
+
+local yml = encoding.yaml.encode(cfg, { indent = 4 })
+print(yml)
+local back = encoding.yaml.decode(yml)
+assert(back.deps.zap == "1.21" and back.port == 8080 and #back.tags == 0)
+assert(encoding.yaml.decode("base: &base {a: 1}\nchild:\n  <<: *base\n  b: 2").child.a == 1)
+
+local tml = encoding.toml.encode({ title = "cushion", server = { port = 8080, hosts = { "a", "b" } } }, { pretty = true })
+print(tml)
+assert(encoding.toml.decode(tml).server.hosts[2] == "b")
+
+local ini = encoding.ini.encode({ debug = true, server = { port = 8080, hosts = { "a", "b" } } })
+print(ini)
+local conf = encoding.ini.decode(ini)
+assert(conf.debug == "true" and conf.server.port == "8080" and conf.server.hosts == "a,b")
+
+local _, err = encoding.json.decode("{")
+assert(err ~= nil)
+assert(not pcall(encoding.decode, "xml", "<a/>"))
+assert(not pcall(encoding.json.encode, { f = print }))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodingTable(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+Import({"cushion-encoding"})
+local encoding = require("cushion-encoding")
+local t = { name = "cyclic" }
+t.children = { t }
+local ok, err = pcall(encoding.json.encode, t)
+print(err)
+assert(not ok and string.find(err, "children%[1%]: cyclic table"))
+assert(not pcall(encoding.yaml.encode, t))
+local shared = { 1 }
+assert(encoding.json.encode({ a = shared, b = shared }) == '{"a":[1],"b":[1]}')
+
+local sparse = {}
+sparse[1], sparse[3] = "a", "c"
+print(encoding.json.encode(sparse))
+assert(encoding.json.encode(sparse) == '{"1":"a","3":"c"}')
+local mixed = { "a", "b", name = "mixed" }
+print(encoding.json.encode(mixed))
+assert(encoding.json.encode(mixed) == '{"1":"a","2":"b","name":"mixed"}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
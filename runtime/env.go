@@ -0,0 +1,131 @@
+package runtime
+
+import (
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// envLoadOpt is the option of cushion-env.Load
+type envLoadOpt struct {
+	// Keys to be loaded, and all keys are loaded when it's empty
+	Keys []string `lua:"keys"`
+	// Safe to skip existed keys
+	Safe bool `lua:"safe"`
+}
+
+// loadEnv wraps EnvVar of platform, which is registry on windows and process enviroment on posix.
+//
+//	local env = require("cushion-env")
+//	env.SetPath("user")
+//	env.Set("PATH", { "C:\\bin", os.getenv("PATH") })
+func loadEnv(lvm *lua.LState) int {
+	var env utils.EnvVar = utils.NewEnvVar()
+	return LuaModuleLoader(lvm, LuaFuncs{
+		"SetPath":  envSetPath(env),
+		"Set":      envSet(env.Set),
+		"SafeSet":  envSet(env.SafeSet),
+		"Unset":    envUnset(env),
+		"SetL":     envSetL(env.SetL),
+		"SafeSetL": envSetL(env.SafeSetL),
+		"Export":   envExport(env),
+		"Load":     envLoad(env),
+		"Print":    envPrint(env),
+	})
+}
+
+// envSetPath sets target of global enviroment, sys or user, which only works on windows
+func envSetPath(env utils.EnvVar) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		if err := env.SetPath(lvm.CheckString(1)); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+// envSet sets global enviroment variable, and value is string, integer or array of strings
+func envSet(set func(string, any) error) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		k := lvm.CheckString(1)
+		var v any
+		switch lv := lvm.CheckAny(2).(type) {
+		case lua.LString:
+			v = string(lv)
+		case lua.LNumber:
+			if float64(lv) == float64(int(lv)) {
+				v = int(lv)
+			} else {
+				v = lv.String()
+			}
+		case *lua.LTable:
+			vs := []string{}
+			for i := 1; i <= lv.Len(); i++ {
+				vs = append(vs, lv.RawGetInt(i).String())
+			}
+			v = vs
+		default:
+			lvm.ArgError(2, "string, integer or array of strings expected")
+		}
+		if err := set(k, v); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+// envUnset deletes global enviroment variable
+func envUnset(env utils.EnvVar) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		if err := env.Unset(lvm.CheckString(1)); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+// envSetL sets enviroment variable of current process
+func envSetL(set func(string, string) error) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		if err := set(lvm.CheckString(1), lvm.CheckString(2)); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+// envExport exports enviroment into file, which could be loaded by Load
+func envExport(env utils.EnvVar) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		if err := env.Export(lvm.CheckString(1)); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+// envLoad loads enviroment exported by Export
+//
+//	env.Load("env.json", { keys = { "GOPATH" }, safe = true })
+func envLoad(env utils.EnvVar) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		file := lvm.CheckString(1)
+		opt := envLoadOpt{}
+		if tbl := lvm.OptTable(2, nil); tbl != nil {
+			if err := DecodeWithPath("opt", tbl, &opt); err != nil {
+				raiseError(lvm, err)
+			}
+		}
+		if err := env.Load(utils.EnvVarLoadOpt{File: file, Keys: opt.Keys, Safe: opt.Safe}); err != nil {
+			raiseError(lvm, err)
+		}
+		return 0
+	}
+}
+
+func envPrint(env utils.EnvVar) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		env.Print()
+		return 0
+	}
+}
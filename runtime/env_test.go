@@ -0,0 +1,41 @@
+package runtime
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("global enviroment is written into registry")
+	}
+	t.Setenv("CUSHION_ENV_A", "")
+	t.Setenv("CUSHION_ENV_B", "")
+	vm := NewVirtualMachine().Default()
+	vm.SetGlobalVar("root", lua.LString(t.TempDir()))
+	err := vm.Eval(`
+Import({"cushion-env"})
+local env = require("cushion-env")
+env.Set("CUSHION_ENV_A", { "/bin", "/usr/bin" })
+assert(os.getenv("CUSHION_ENV_A") == "/bin:/usr/bin")
+env.SafeSet("CUSHION_ENV_A", "skipped")
+assert(os.getenv("CUSHION_ENV_A") == "/bin:/usr/bin")
+env.SetL("CUSHION_ENV_B", "b")
+assert(not pcall(env.SafeSetL, "CUSHION_ENV_B", "c"))
+env.Export(root .. "/env.json")
+env.Unset("CUSHION_ENV_A")
+assert(os.getenv("CUSHION_ENV_A") == nil)
+env.Load(root .. "/env.json", { keys = { "CUSHION_ENV_A" } })
+assert(os.getenv("CUSHION_ENV_A") == "/bin:/usr/bin")
+local ok, err = pcall(env.Load, root .. "/not-found.json")
+assert(not ok and err:find("not%-found"), err)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("CUSHION_ENV_B") != "b" {
+		t.Fatal("CUSHION_ENV_B isn't set")
+	}
+}
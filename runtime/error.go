@@ -0,0 +1,289 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Builtins of cushion follow the same error convention:
+//   - invalid arguments (such as malformed version or pattern) raise lua error by raiseError,
+//     so that the script fails at the line calling builtin.
+//   - failures of operation (such as I/O) return nil values followed by the message of error,
+//     and the error is nil when the operation succeeds.
+
+// ScriptError is returned by Eval and Call when script raises error or fails to compile.
+// Cause is the go error raised by builtin or the syntax error of parser,
+// and both of Cause and the raw *lua.ApiError could be matched by errors.Is and errors.As.
+type ScriptError struct {
+	// Chunk is the name of chunk where error is raised, such as file path or <string>
+	Chunk string
+	// Line is one-based, and it's 0 when position is unknown
+	Line int
+	// Column is only known for syntax error, otherwise it's 0
+	Column int
+	// Message is the error without position
+	Message string
+	// Frames is the lua call stack from the innermost frame
+	Frames []ScriptFrame
+	Cause  error
+
+	raw    *lua.ApiError
+	source []byte
+}
+
+// ScriptFrame is the frame of lua traceback, and Source of go builtin is [G]
+type ScriptFrame struct {
+	Source   string
+	Line     int
+	Function string
+}
+
+func (err *ScriptError) Error() string {
+	switch {
+	case err.Line > 0 && err.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %s", err.Chunk, err.Line, err.Column, err.Message)
+	case err.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", err.Chunk, err.Line, err.Message)
+	}
+	return err.Message
+}
+
+// Unwrap returns the cause and the raw error of gopher-lua
+func (err *ScriptError) Unwrap() []error {
+	errs := []error{}
+	if err.Cause != nil {
+		errs = append(errs, err.Cause)
+	}
+	if err.raw != nil {
+		errs = append(errs, err.raw)
+	}
+	return errs
+}
+
+// Traceback returns frames formatted like lua traceback
+func (err *ScriptError) Traceback() string {
+	sb := strings.Builder{}
+	sb.WriteString("stack traceback:")
+	for _, f := range err.Frames {
+		if f.Line > 0 {
+			fmt.Fprintf(&sb, "\n\t%s:%d: in %s", f.Source, f.Line, f.Function)
+		} else {
+			fmt.Fprintf(&sb, "\n\t%s: in %s", f.Source, f.Function)
+		}
+	}
+	return sb.String()
+}
+
+// Source returns the script of chunk, which is read from file when it isn't evaluated from string
+func (err *ScriptError) Source() ([]byte, error) {
+	if err.source != nil {
+		return err.source, nil
+	}
+	if strings.HasPrefix(err.Chunk, "<") {
+		return nil, fmt.Errorf("source of %s isn't available", err.Chunk)
+	}
+	return os.ReadFile(err.Chunk)
+}
+
+// CodeFrameOpt is the option of RenderCodeFrame
+type CodeFrameOpt struct {
+	// Context is the number of lines around the error line, it defaults to 2
+	Context int
+	// Color to highlight the error line with ANSI escape code
+	Color bool
+	// Traceback to print lua traceback after code frame
+	Traceback bool
+}
+
+// RenderCodeFrame to print error with the source lines around it, and the error line is marked by >.
+// The column is pointed by ^ when it's known, otherwise the whole line is underlined.
+// Only the message is printed when err isn't ScriptError or its source isn't available.
+func RenderCodeFrame(w io.Writer, err error, opt CodeFrameOpt) error {
+	if opt.Context <= 0 {
+		opt.Context = 2
+	}
+	se := &ScriptError{}
+	if !errors.As(err, &se) {
+		_, e := fmt.Fprintf(w, "error: %s\n", err)
+		return e
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "error: %s\n", se.Message)
+	if se.Line > 0 {
+		pos := fmt.Sprintf("%s:%d", se.Chunk, se.Line)
+		if se.Column > 0 {
+			pos += ":" + strconv.Itoa(se.Column)
+		}
+		fmt.Fprintf(buf, "  --> %s\n", pos)
+		if source, e := se.Source(); e == nil {
+			renderLines(buf, strings.Split(strings.TrimRight(string(source), "\n"), "\n"), se.Line, se.Column, opt)
+		}
+	}
+	if opt.Traceback && len(se.Frames) > 0 {
+		buf.WriteString(se.Traceback())
+		buf.WriteByte('\n')
+	}
+	_, e := w.Write(buf.Bytes())
+	return e
+}
+
+func renderLines(buf *bytes.Buffer, lines []string, line, column int, opt CodeFrameOpt) {
+	if line > len(lines) {
+		return
+	}
+	from, to := line-opt.Context, line+opt.Context
+	if from < 1 {
+		from = 1
+	}
+	if to > len(lines) {
+		to = len(lines)
+	}
+	width := len(strconv.Itoa(to))
+	for no := from; no <= to; no++ {
+		text := strings.TrimRight(strings.ReplaceAll(lines[no-1], "\t", "    "), "\r")
+		if no != line {
+			fmt.Fprintf(buf, "  %*d | %s\n", width, no, text)
+			continue
+		}
+		if opt.Color {
+			text = "\x1b[1;31m" + text + "\x1b[0m"
+		}
+		fmt.Fprintf(buf, "> %*d | %s\n", width, no, text)
+		raw := strings.ReplaceAll(lines[no-1], "\t", "    ")
+		var marker string
+		if column > 0 {
+			// column counts tab as one character
+			end := column - 1
+			if end > len(lines[no-1]) {
+				end = len(lines[no-1])
+			}
+			prefix := lines[no-1][:end]
+			indent := len(strings.ReplaceAll(prefix, "\t", "    "))
+			marker = strings.Repeat(" ", indent) + "^"
+		} else {
+			trimmed := strings.TrimLeft(raw, " ")
+			marker = strings.Repeat(" ", len(raw)-len(trimmed)) + strings.Repeat("^", len(strings.TrimRight(trimmed, " \r")))
+		}
+		fmt.Fprintf(buf, "  %*s | %s\n", width, "", marker)
+	}
+}
+
+var (
+	scriptPosition = regexp.MustCompile(`(?s)^(.*?):(\d+): (.*)$`)
+	scriptFrame    = regexp.MustCompile(`^(.*?):(\d+): in (.*)$`)
+)
+
+// newScriptError converts the error of gopher-lua into ScriptError, and other errors are returned as it is
+func newScriptError(err error) error {
+	var raw *lua.ApiError
+	if err == nil || !errors.As(err, &raw) {
+		return err
+	}
+	if se := (&ScriptError{}); errors.As(err, &se) {
+		return err
+	}
+	se := &ScriptError{raw: raw, Cause: raw.Cause}
+	perr := &parse.Error{}
+	if errors.As(raw.Cause, &perr) {
+		se.Chunk, se.Line, se.Column = perr.Pos.Source, perr.Pos.Line, perr.Pos.Column
+		se.Message = perr.Message
+		if len(perr.Token) > 0 {
+			se.Message = fmt.Sprintf("%s near '%s'", perr.Message, perr.Token)
+		}
+		if se.Line == parse.EOF {
+			se.Line, se.Column = 0, 0
+			se.Message += " at EOF"
+		}
+		return se
+	}
+	msg := ""
+	if raw.Object != nil {
+		msg = raw.Object.String()
+	}
+	se.Message = msg
+	if m := scriptPosition.FindStringSubmatch(msg); m != nil {
+		se.Chunk, se.Message = m[1], m[3]
+		se.Line, _ = strconv.Atoi(m[2])
+	}
+	for _, line := range strings.Split(raw.StackTrace, "\n") {
+		line = strings.TrimPrefix(line, "\t")
+		switch {
+		case strings.HasPrefix(line, "[G]: in "):
+			se.Frames = append(se.Frames, ScriptFrame{Source: "[G]", Function: strings.TrimPrefix(line, "[G]: in ")})
+		case scriptFrame.MatchString(line):
+			m := scriptFrame.FindStringSubmatch(line)
+			no, _ := strconv.Atoi(m[2])
+			se.Frames = append(se.Frames, ScriptFrame{Source: m[1], Line: no, Function: m[3]})
+		}
+	}
+	// error raised with non-string value has no position, which is located by the innermost lua frame
+	if se.Line == 0 {
+		for _, f := range se.Frames {
+			if f.Line > 0 {
+				se.Chunk, se.Line = f.Source, f.Line
+				break
+			}
+		}
+	}
+	return se
+}
+
+// withSource attaches script to ScriptError raised by the chunk of script
+func withSource(err error, chunk, script string) error {
+	if se, ok := err.(*ScriptError); ok && se.Chunk == chunk {
+		se.source = []byte(script)
+	}
+	return err
+}
+
+const scriptCauseKey = "_CUSHION_CAUSE"
+
+// scriptCause is the go error raised by builtin, which is matched with lua error by message
+type scriptCause struct {
+	msg string
+	err error
+}
+
+// raiseError raises lua error with position of caller like RaiseError,
+// and err is kept as the Cause of ScriptError returned by vm.
+func raiseError(lvm *lua.LState, err error) {
+	msg := err.Error()
+	// the position is the innermost lua frame like RaiseError, because builtin may be called by pcall
+	for level := 1; ; level++ {
+		dbg, ok := lvm.GetStack(level)
+		if !ok {
+			break
+		}
+		if _, e := lvm.GetInfo("Sl", dbg, lua.LNil); e == nil && dbg.What != "G" {
+			msg = fmt.Sprintf("%s:%d: %s", dbg.Source, dbg.CurrentLine, msg)
+			break
+		}
+	}
+	ud := lvm.NewUserData()
+	ud.Value = &scriptCause{msg: msg, err: err}
+	lvm.G.Registry.RawSetString(scriptCauseKey, ud)
+	lvm.Error(lua.LString(msg), 0)
+}
+
+// takeScriptCause sets the cause raised by builtin into ScriptError, and the cause is cleared.
+func takeScriptCause(state *lua.LState, err error) error {
+	ud, ok := state.G.Registry.RawGetString(scriptCauseKey).(*lua.LUserData)
+	if !ok {
+		return err
+	}
+	state.G.Registry.RawSetString(scriptCauseKey, lua.LNil)
+	cause := ud.Value.(*scriptCause)
+	if se, ok := err.(*ScriptError); ok && se.Cause == nil && se.raw.Object.String() == cause.msg {
+		se.Cause = cause.err
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScriptError(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`Import({"cushion-check"}) local check = require("cushion-check")
+local function parse(v)
+	return check.CheckVersion(v, "1.0")
+end
+parse("not a version")`)
+	se := &ScriptError{}
+	if !errors.As(err, &se) || se.Chunk != "<string>" || se.Line != 3 || se.Cause == nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	buf := &bytes.Buffer{}
+	RenderCodeFrame(buf, err, CodeFrameOpt{Traceback: true})
+	fmt.Print(buf.String())
+	if !strings.Contains(buf.String(), "> 3 |     return") || !strings.Contains(buf.String(), "  --> <string>:3") {
+		t.Fatal("code frame should point at line 3")
+	}
+
+	sandbox := NewVirtualMachineWithOpt(LuaVMOpt{Sandbox: &Capabilities{}}).Default()
+	err = sandbox.Eval(`os.execute("ls")`)
+	perm := &PermissionError{}
+	if !errors.As(err, &perm) {
+		t.Fatalf("want PermissionError, got %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "syntax.lua")
+	os.WriteFile(file, []byte("local a = 1\nlocal b = = 2\n"), 0666)
+	err = vm.EvalFile(file)
+	if !errors.As(err, &se) || se.Line != 2 || se.Column == 0 {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	buf.Reset()
+	RenderCodeFrame(buf, err, CodeFrameOpt{})
+	fmt.Print(buf.String())
+}
@@ -0,0 +1,231 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// lifecycle events emitted by host, and host could emit any other name as well
+const (
+	EventBeforeCommand = "before-command"
+	EventAfterCommand  = "after-command"
+	EventExit          = "on-exit"
+)
+
+// Event is the result of Emit, which carries the payload modified by handlers
+type Event struct {
+	Name string
+	// Payload is the final payload converted into natural go value,
+	// and table is converted into []any or map[string]any.
+	Payload any
+	// Vetoed is true when some handler returns false, and the rest of handlers aren't called
+	Vetoed bool
+	// Reason is the second return value of handler vetoing the event
+	Reason string
+	// Handled is the number of handlers to be called
+	Handled int
+
+	payload lua.LValue
+}
+
+// Decode to convert the final payload into out, such as struct of payload
+func (e *Event) Decode(out any) error {
+	return DecodeWithPath(e.Name, e.payload, out)
+}
+
+// EventError aggregates the errors raised by handlers of event,
+// and every error could be matched by errors.Is and errors.As.
+type EventError struct {
+	Event string
+	Errs  []error
+}
+
+func (err *EventError) Error() string {
+	msgs := []string{}
+	for _, e := range err.Errs {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Sprintf("event %s: %d handler(s) failed: %s", err.Event, len(err.Errs), strings.Join(msgs, "; "))
+}
+
+func (err *EventError) Unwrap() []error {
+	return err.Errs
+}
+
+// eventBus stores handlers subscribed by cushion-event.on
+type eventBus struct {
+	handlers map[string][]*eventHandler
+	nextID   int
+}
+
+type eventHandler struct {
+	id       int
+	fn       *lua.LFunction
+	priority int
+	once     bool
+}
+
+// eventOpt is the option of cushion-event.on
+type eventOpt struct {
+	Priority int  `lua:"priority"`
+	Once     bool `lua:"once"`
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{handlers: make(map[string][]*eventHandler)}
+}
+
+// clone returns the copy of bus, whose handlers could be changed independently
+func (bus *eventBus) clone() *eventBus {
+	handlers := make(map[string][]*eventHandler, len(bus.handlers))
+	for name, hs := range bus.handlers {
+		handlers[name] = append([]*eventHandler{}, hs...)
+	}
+	return &eventBus{handlers: handlers, nextID: bus.nextID}
+}
+
+// subscribe to add handler, and handlers are sorted by priority in descending order.
+// The handlers with the same priority are called in order of subscribing.
+func (bus *eventBus) subscribe(name string, fn *lua.LFunction, opt eventOpt) int {
+	bus.nextID++
+	handlers := append(bus.handlers[name], &eventHandler{id: bus.nextID, fn: fn, priority: opt.Priority, once: opt.Once})
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return handlers[i].priority > handlers[j].priority
+	})
+	bus.handlers[name] = handlers
+	return bus.nextID
+}
+
+// unsubscribe to remove handler by id, and it returns false when handler isn't found
+func (bus *eventBus) unsubscribe(id int) bool {
+	for name, handlers := range bus.handlers {
+		for i, h := range handlers {
+			if h.id != id {
+				continue
+			}
+			bus.handlers[name] = append(handlers[:i:i], handlers[i+1:]...)
+			if len(bus.handlers[name]) == 0 {
+				delete(bus.handlers, name)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Emit to call handlers of event in order of priority, which must be called by the goroutine of vm.
+// Payload is encoded as lua value by Encode, and handler is called with payload and name of event.
+// Handler could modify the payload in place or return new payload for later handlers,
+// or return false with reason to veto the event. Errors of handlers don't stop the event,
+// and they're returned as EventError. It stops when ctx is cancelled.
+func (vm *LuaVM) Emit(ctx context.Context, name string, payload any) (*Event, error) {
+	lv, err := Encode(vm.state, payload)
+	if err != nil {
+		return nil, err
+	}
+	event := &Event{Name: name, payload: lv}
+	// handlers subscribed or unsubscribed by handler take effect on next emitting
+	handlers := append([]*eventHandler{}, vm.events.handlers[name]...)
+	errs := []error{}
+	for _, h := range handlers {
+		if h.once {
+			vm.events.unsubscribe(h.id)
+		}
+		event.Handled++
+		ret, err := vm.EvalFuncContext(ctx, h.fn, []lua.LValue{event.payload, lua.LString(name)})
+		if errors.Is(err, ErrCancelled) || errors.Is(err, ErrDeadline) {
+			errs = append(errs, err)
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(ret) == 0 {
+			continue
+		}
+		switch v := ret[0].(lua.LValue); v {
+		case lua.LNil, lua.LTrue:
+		case lua.LFalse:
+			event.Vetoed = true
+			if len(ret) > 1 && ret[1].(lua.LValue) != lua.LNil {
+				event.Reason = ret[1].(lua.LValue).String()
+			}
+		default:
+			event.payload = v
+		}
+		if event.Vetoed {
+			break
+		}
+	}
+	if event.Payload, err = toGoValue("payload", event.payload); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return event, &EventError{Event: name, Errs: errs}
+	}
+	return event, nil
+}
+
+// EmitInto emits event with typed payload, and decodes the final payload into T
+func EmitInto[T any](ctx context.Context, vm VirtualMachine, name string, payload T) (T, *Event, error) {
+	var out T
+	event, err := vm.Emit(ctx, name, payload)
+	if event == nil {
+		return out, nil, err
+	}
+	if derr := event.Decode(&out); derr != nil {
+		return out, event, errors.Join(err, derr)
+	}
+	return out, event, err
+}
+
+// loadEvent returns the loader of cushion-event
+func loadEvent(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		return LuaModuleLoader(lvm, LuaFuncs{
+			"on":       eventOn(vm, false),
+			"once":     eventOn(vm, true),
+			"off":      eventOff(vm),
+			"handlers": eventHandlers(vm),
+		})
+	}
+}
+
+// eventOn subscribes handler with name and option such as {priority = 10}, and returns id of handler
+func eventOn(vm *LuaVM, once bool) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		name := lvm.CheckString(1)
+		fn := lvm.CheckFunction(2)
+		opt := eventOpt{}
+		if lvm.GetTop() >= 3 && lvm.Get(3) != lua.LNil {
+			if err := DecodeWithPath("opt", lvm.CheckTable(3), &opt); err != nil {
+				raiseError(lvm, err)
+			}
+		}
+		opt.Once = opt.Once || once
+		lvm.Push(lua.LNumber(vm.events.subscribe(name, fn, opt)))
+		return 1
+	}
+}
+
+// eventOff unsubscribes handler by id, and returns whether it's found
+func eventOff(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		lvm.Push(lua.LBool(vm.events.unsubscribe(lvm.CheckInt(1))))
+		return 1
+	}
+}
+
+// eventHandlers returns the number of handlers subscribing event
+func eventHandlers(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		lvm.Push(lua.LNumber(len(vm.events.handlers[lvm.CheckString(1)])))
+		return 1
+	}
+}
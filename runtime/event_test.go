@@ -0,0 +1,58 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type commandEvent struct {
+	Name string   `lua:"name"`
+	Args []string `lua:"args"`
+}
+
+func TestEvent(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+Import({"cushion-event"})
+local event = require("cushion-event")
+event.on("before-command", function(cmd)
+	table.insert(cmd.args, "--verbose")
+end)
+event.on("before-command", function(cmd)
+	return { name = cmd.name, args = { "--dry-run" } }
+end, { priority = 10 })
+event.on("before-command", function(cmd)
+	if cmd.name == "rm" then
+		return false, "rm is disabled"
+	end
+end, { priority = 5 })
+event.once("on-exit", function() error("exit hook fails") end)
+event.on("on-exit", function() end)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, event, err := EmitInto(context.Background(), vm, EventBeforeCommand, commandEvent{Name: "build", Args: []string{"-o"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(cmd, event.Handled)
+	if event.Vetoed || fmt.Sprint(cmd.Args) != "[--dry-run --verbose]" {
+		t.Fatal("unexpected payload")
+	}
+	_, event, err = EmitInto(context.Background(), vm, EventBeforeCommand, commandEvent{Name: "rm"})
+	if err != nil || !event.Vetoed || event.Reason != "rm is disabled" || event.Handled != 2 {
+		t.Fatal("event should be vetoed")
+	}
+	_, err = vm.Emit(context.Background(), EventExit, nil)
+	eerr := &EventError{}
+	se := &ScriptError{}
+	if !errors.As(err, &eerr) || len(eerr.Errs) != 1 || !errors.As(err, &se) {
+		t.Fatal(err)
+	}
+	fmt.Println(err)
+	if _, err = vm.Emit(context.Background(), EventExit, nil); err != nil {
+		t.Fatal("once handler should be removed")
+	}
+}
@@ -0,0 +1,158 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// execOpt is the option of cushion-exec.run
+type execOpt struct {
+	Cwd   string            `lua:"cwd"`
+	Env   map[string]string `lua:"env"`
+	Stdin string            `lua:"stdin"`
+	// Timeout is milliseconds to kill process
+	Timeout int `lua:"timeout"`
+	// Encoding is the charset of output, such as gb18030, and output is kept as it is by default
+	Encoding string `lua:"encoding"`
+}
+
+// shellCharset returns the charset of output of shell, which is GB18030 for chinese windows
+func shellCharset() utils.Charset {
+	if runtime.GOOS == "windows" {
+		return utils.GB18030
+	}
+	return utils.UTF8
+}
+
+func loadExec(lvm *lua.LState) int {
+	return LuaModuleLoader(lvm, LuaFuncs{
+		"run":   execRun,
+		"shell": execShell,
+	})
+}
+
+// execRun runs argv or script of shell, and returns result table {code, stdout, stderr}.
+// It returns nil with error when process fails to start or is killed by timeout, and non-zero code isn't error.
+// on_stdout and on_stderr of option are called with every line of output.
+//
+//	local res, err = exec.run({ "git", "commit", "-m", "fix: a b" }, { cwd = repo, timeout = 5000 })
+func execRun(lvm *lua.LState) int {
+	var cmd *utils.Command
+	switch v := lvm.CheckAny(1).(type) {
+	case lua.LString:
+		cmd = utils.NewShellCommand(string(v))
+	case *lua.LTable:
+		argv := []string{}
+		for i := 1; i <= v.Len(); i++ {
+			argv = append(argv, v.RawGetInt(i).String())
+		}
+		if len(argv) == 0 {
+			lvm.ArgError(1, "argv shouldn't be empty")
+		}
+		cmd = utils.NewCommand(argv[0], argv[1:]...)
+	default:
+		lvm.ArgError(1, "argv table or script string expected")
+	}
+	return runCommand(lvm, cmd, lvm.OptTable(2, nil))
+}
+
+// execShell runs script of shell, which is the same as run with string
+func execShell(lvm *lua.LState) int {
+	return runCommand(lvm, utils.NewShellCommand(lvm.CheckString(1)), lvm.OptTable(2, nil))
+}
+
+// execLine is the line of output to be passed to callback on the goroutine of vm
+type execLine struct {
+	fn   *lua.LFunction
+	line string
+}
+
+func runCommand(lvm *lua.LState, cmd *utils.Command, tbl *lua.LTable) int {
+	opt := execOpt{}
+	var onStdout, onStderr *lua.LFunction
+	if tbl != nil {
+		if err := DecodeWithPath("opt", tbl, &opt); err != nil {
+			raiseError(lvm, err)
+		}
+		onStdout, _ = tbl.RawGetString("on_stdout").(*lua.LFunction)
+		onStderr, _ = tbl.RawGetString("on_stderr").(*lua.LFunction)
+	}
+	cmd.Dir(opt.Cwd)
+	for k, v := range opt.Env {
+		cmd.Env(k, v)
+	}
+	if len(opt.Stdin) > 0 {
+		cmd.Stdin(strings.NewReader(opt.Stdin))
+	}
+	if opt.Timeout > 0 {
+		cmd.Timeout(time.Duration(opt.Timeout) * time.Millisecond)
+	}
+	// process is killed when callback raises error, and hooks of vm aren't run by other goroutines
+	ctx := goContext(lvm)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// callbacks of lua must be called by the goroutine of vm, so lines are sent back by channel
+	lines := make(chan execLine, 64)
+	// stop avoids blocking the process when callback raises error
+	stop := make(chan struct{})
+	defer close(stop)
+	send := func(fn *lua.LFunction) func(string) {
+		return func(line string) {
+			select {
+			case lines <- execLine{fn, line}:
+			case <-stop:
+			}
+		}
+	}
+	if onStdout != nil {
+		cmd.OnStdout(send(onStdout))
+	}
+	if onStderr != nil {
+		cmd.OnStderr(send(onStderr))
+	}
+	type result struct {
+		res *utils.CommandResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := cmd.Run(ctx)
+		done <- result{res, err}
+	}()
+	charset := utils.Charset(strings.ToUpper(opt.Encoding))
+	for {
+		select {
+		case l := <-lines:
+			lvm.CallByParam(lua.P{Fn: l.fn}, lua.LString(utils.ConvertByte2String([]byte(l.line), charset)))
+			continue
+		case r := <-done:
+			// the rest of lines have been sent before Run returns
+			for len(lines) > 0 {
+				l := <-lines
+				lvm.CallByParam(lua.P{Fn: l.fn}, lua.LString(utils.ConvertByte2String([]byte(l.line), charset)))
+			}
+			if r.err != nil {
+				lvm.Push(lua.LNil)
+				lvm.Push(lua.LString(fmt.Sprintf("%s: %s", strings.Join(cmd.Args(), " "), r.err)))
+				return 2
+			}
+			tbl := lvm.NewTable()
+			tbl.RawSetString("code", lua.LNumber(r.res.Code))
+			tbl.RawSetString("stdout", lua.LString(utils.ConvertByte2String(r.res.Stdout, charset)))
+			tbl.RawSetString("stderr", lua.LString(utils.ConvertByte2String(r.res.Stderr, charset)))
+			lvm.Push(tbl)
+			lvm.Push(lua.LNil)
+			return 2
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh isn't available")
+	}
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+Import({"cushion-exec"})
+local exec = require("cushion-exec")
+local lines = {}
+local res, err = exec.run({ "sh", "-c", 'printf "%s\n" "$1" "$NAME"; echo oops >&2; exit 2', "sh", "a 'quoted' arg" }, {
+	env = { NAME = "cushion" },
+	on_stdout = function(line) table.insert(lines, line) end,
+})
+assert(err == nil, err)
+assert(res.code == 2 and res.stderr == "oops\n")
+assert(lines[1] == "a 'quoted' arg" and lines[2] == "cushion")
+
+res = exec.shell("cat; pwd", { stdin = "in\n", cwd = "/" })
+assert(res.code == 0 and res.stdout == "in\n/\n")
+
+res, err = exec.run("sleep 5", { timeout = 50 })
+assert(res == nil and err:find("deadline"))
+res, err = exec.run({ "cushion-command-not-found" })
+assert(res == nil and err ~= nil)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecCallbackError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh isn't available")
+	}
+	vm := NewVirtualMachine().Default()
+	pidfile := filepath.Join(t.TempDir(), "pid")
+	vm.SetGlobalVar("pidfile", lua.LString(pidfile))
+	err := vm.Eval(`
+Import({"cushion-exec"})
+local exec = require("cushion-exec")
+exec.run({ "sh", "-c", 'echo $$ > "$1"; echo a; sleep 7', "sh", pidfile }, {
+	on_stdout = function(line) error("stop") end,
+})`)
+	if err == nil {
+		t.Fatal("callback should raise error")
+	}
+	raw, _ := os.ReadFile(pidfile)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
+	for i := 0; i < 100; i++ {
+		if p, err := os.FindProcess(pid); err != nil || p.Signal(syscall.Signal(0)) != nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("process %d is still running", pid)
+}
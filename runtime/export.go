@@ -1,44 +1,474 @@
 package runtime
 
-var luaExport ArkExport
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
-func init() {
-	luaExport = &LuaExport{
-		raws:    make([]string, 0),
-		formats: make(map[string]string),
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v3"
+)
+
+// ExportRegistry stores values exported by script with cushion-vm.Export, which is owned by vm.
+// Values are kept in order of exporting, and they're normalized as nil, bool, float64, string,
+// []any and map[string]any, so that the registry could be serialized to JSON, YAML or lua source
+// and loaded again to restore state of previous run.
+type ExportRegistry struct {
+	// vm evaluates lua chunk loaded by LoadLua, and it's nil when registry is created by NewExportRegistry
+	vm     *LuaVM
+	mutex  sync.RWMutex
+	names  []string
+	values map[string]any
+}
+
+func NewExportRegistry() *ExportRegistry {
+	return &ExportRegistry{values: make(map[string]any)}
+}
+
+// Set to export value with name, and value is normalized by JSON encoding.
+// The order of name isn't changed when it's exported again.
+func (e *ExportRegistry) Set(name string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+	e.set(name, value)
+	return nil
+}
+
+// snapshot returns the copy of names and values
+func (e *ExportRegistry) snapshot() ([]string, map[string]any) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	values := make(map[string]any, len(e.values))
+	for name, value := range e.values {
+		values[name] = value
+	}
+	return append([]string{}, e.names...), values
+}
+
+// restore to replace names and values with snapshot
+func (e *ExportRegistry) restore(names []string, values map[string]any) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.names = append([]string{}, names...)
+	e.values = make(map[string]any, len(values))
+	for name, value := range values {
+		e.values[name] = value
+	}
+}
+
+func (e *ExportRegistry) set(name string, value any) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.values[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.values[name] = value
+}
+
+// Get returns the value exported with name
+func (e *ExportRegistry) Get(name string) (any, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	v, ok := e.values[name]
+	return v, ok
+}
+
+// Delete to remove the value exported with name
+func (e *ExportRegistry) Delete(name string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.values[name]; !ok {
+		return
+	}
+	delete(e.values, name)
+	for i, n := range e.names {
+		if n == name {
+			e.names = append(e.names[:i], e.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Names returns names in order of exporting
+func (e *ExportRegistry) Names() []string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return append([]string{}, e.names...)
+}
+
+// Reset to clear all exports
+func (e *ExportRegistry) Reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.names = nil
+	e.values = make(map[string]any)
+}
+
+// each calls fn with name and value in order under read lock
+func (e *ExportRegistry) each(fn func(name string, value any) error) error {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, name := range e.names {
+		if err := fn(name, e.values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes exports as JSON object in order of exporting
+func (e *ExportRegistry) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	err := e.each(func(name string, value any) error {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(name)
+		v, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON to load exports from JSON object, and existed exports with same name are replaced
+func (e *ExportRegistry) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return fmt.Errorf("export: JSON object is expected")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		e.set(tok.(string), value)
+	}
+	return nil
+}
+
+// MarshalYAML encodes exports as YAML mapping in order of exporting
+func (e *ExportRegistry) MarshalYAML() (any, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	err := e.each(func(name string, value any) error {
+		v := &yaml.Node{}
+		if err := v.Encode(value); err != nil {
+			return err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// UnmarshalYAML to load exports from YAML mapping, and existed exports with same name are replaced
+func (e *ExportRegistry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("export: YAML mapping is expected")
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		var value any
+		if err := node.Content[i+1].Decode(&value); err != nil {
+			return err
+		}
+		if err := e.Set(node.Content[i].Value, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JSON returns exports encoded as indented JSON
+func (e *ExportRegistry) JSON() ([]byte, error) {
+	raw, err := e.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Indent(buf, raw, "", "  "); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// YAML returns exports encoded as YAML
+func (e *ExportRegistry) YAML() ([]byte, error) {
+	return yaml.Marshal(e)
+}
+
+// Lua returns exports as lua chunk, which returns the table of exports
+func (e *ExportRegistry) Lua() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteString("return {\n")
+	err := e.each(func(name string, value any) error {
+		buf.WriteString("  ")
+		buf.WriteString(exportLuaKey(name))
+		buf.WriteString(" = ")
+		if err := writeExportLua(buf, value, "  "); err != nil {
+			return err
+		}
+		buf.WriteString(",\n")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// LoadJSON to load exports from JSON
+func (e *ExportRegistry) LoadJSON(data []byte) error {
+	return e.UnmarshalJSON(data)
+}
+
+// LoadYAML to load exports from YAML
+func (e *ExportRegistry) LoadYAML(data []byte) error {
+	return yaml.Unmarshal(data, e)
+}
+
+// LoadLua to load exports from lua chunk returning table, which is generated by Lua.
+// The chunk is evaluated without globals by the owner vm with its hooks and budget,
+// or by isolated interpreter without libs when registry isn't owned by vm.
+// Exports are loaded in order of sorted names because order of lua table is lost.
+func (e *ExportRegistry) LoadLua(data []byte) error {
+	var (
+		ret lua.LValue
+		err error
+	)
+	if e.vm != nil {
+		ret, err = e.vm.evalExports(data)
+	} else {
+		ret, err = evalExports(data)
+	}
+	if err != nil {
+		return err
 	}
+	tbl, ok := ret.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("export: lua chunk should return table")
+	}
+	exports := make(map[string]any)
+	names := []string{}
+	var convErr error
+	tbl.ForEach(func(k, v lua.LValue) {
+		if convErr != nil {
+			return
+		}
+		name := k.String()
+		exports[name], convErr = exportValue(name, v)
+		names = append(names, name)
+	})
+	if convErr != nil {
+		return convErr
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e.set(name, exports[name])
+	}
+	return nil
 }
 
-func GetExport() ArkExport {
-	return luaExport
+// evalExports evaluates lua chunk of exports by isolated interpreter without libs
+func evalExports(data []byte) (lua.LValue, error) {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer state.Close()
+	fn, err := state.Load(bytes.NewReader(data), "<export>")
+	if err != nil {
+		return nil, err
+	}
+	if err := state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+		return nil, err
+	}
+	return state.Get(-1), nil
 }
 
-type ArkExport interface {
-	Raw() []string
-	Format() []string
-	Set(raw string, format string)
+// evalExports evaluates lua chunk of exports with empty environment,
+// so that it can't access globals of vm but is still limited by hooks and budget of vm.
+func (vm *LuaVM) evalExports(data []byte) (lua.LValue, error) {
+	fn, err := vm.state.Load(bytes.NewReader(data), "<export>")
+	if err != nil {
+		return nil, err
+	}
+	fn.Env = vm.state.NewTable()
+	ret := lua.LValue(lua.LNil)
+	err = vm.exec(nil, func() error {
+		top := vm.state.GetTop()
+		defer vm.state.SetTop(top)
+		if err := vm.state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+			return err
+		}
+		ret = vm.state.Get(-1)
+		return nil
+	})
+	return ret, err
 }
 
-type LuaExport struct {
-	raws    []string
-	formats map[string]string
+// exportValue converts lua value into normalized value of registry,
+// and it returns CodecError when value is function, userdata, thread, cyclic table, NaN or Inf.
+func exportValue(p string, lv lua.LValue) (any, error) {
+	return exportValueSeen(p, lv, make(map[*lua.LTable]bool))
 }
 
-func (luaExport *LuaExport) Raw() []string {
-	return luaExport.raws
+// exportValueSeen converts lv, and seen is tables being converted to detect cycle
+func exportValueSeen(p string, lv lua.LValue, seen map[*lua.LTable]bool) (any, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, &CodecError{Path: p, Msg: fmt.Sprintf("%v can't be exported", v)}
+		}
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if seen[v] {
+			return nil, &CodecError{Path: p, Msg: "cyclic table can't be exported"}
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		if n := v.Len(); n > 0 && isArray(v, n) {
+			arr := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := exportValueSeen(fmt.Sprintf("%s[%d]", p, i), v.RawGetInt(i), seen)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, item)
+			}
+			return arr, nil
+		}
+		dict := make(map[string]any)
+		var err error
+		v.ForEach(func(k, val lua.LValue) {
+			if err != nil {
+				return
+			}
+			dict[k.String()], err = exportValueSeen(joinPath(p, k), val, seen)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return dict, nil
+	}
+	return nil, &CodecError{Path: p, Msg: fmt.Sprintf("%s can't be exported", lv.Type())}
+}
+
+func exportLuaKey(key string) string {
+	if luaIdentifier(key) {
+		return key
+	}
+	return "[" + exportLuaString(key) + "]"
 }
 
-func (luaExport *LuaExport) Format() []string {
-	var exports []string
-	for _, key := range luaExport.raws {
-		if value, ok := luaExport.formats[key]; ok {
-			exports = append(exports, value)
+// exportLuaString quotes s as lua string literal, and control characters are escaped in decimal
+func exportLuaString(s string) string {
+	sb := strings.Builder{}
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&sb, "\\%03d", c)
+			} else {
+				sb.WriteByte(c)
+			}
 		}
 	}
-	return exports
+	sb.WriteByte('"')
+	return sb.String()
 }
 
-func (luaExport *LuaExport) Set(k, v string) {
-	luaExport.raws = append(luaExport.raws, k)
-	luaExport.formats[k] = v
+func writeExportLua(buf *bytes.Buffer, value any, indent string) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("nil")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("export: %v can't be written as lua number", v)
+		}
+		buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case string:
+		buf.WriteString(exportLuaString(v))
+	case []any:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		buf.WriteString("{\n")
+		for _, item := range v {
+			buf.WriteString(indent + "  ")
+			if err := writeExportLua(buf, item, indent+"  "); err != nil {
+				return err
+			}
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(indent + "}")
+	case map[string]any:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("{\n")
+		for _, k := range keys {
+			buf.WriteString(indent + "  " + exportLuaKey(k) + " = ")
+			if err := writeExportLua(buf, v[k], indent+"  "); err != nil {
+				return err
+			}
+			buf.WriteString(",\n")
+		}
+		buf.WriteString(indent + "}")
+	default:
+		return fmt.Errorf("export: unsupported type %T", value)
+	}
+	return nil
 }
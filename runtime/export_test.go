@@ -1,15 +1,76 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
-	"github.com/ansurfen/cushion/utils"
 	"testing"
 )
 
 func TestExport(t *testing.T) {
-	GetExport().Set(utils.RandString(8), "Ark")
-	raws, formats := GetExport().Raw(), GetExport().Format()
-	for i := 0; i < len(raws); i++ {
-		fmt.Printf("%s -> %s\n", raws[i], formats[i])
+	vm1, vm2 := NewVirtualMachine().Default(), NewVirtualMachine().Default()
+	err := vm1.Eval(`
+Import({"cushion-vm"})
+local vm = require("cushion-vm")
+vm.Export("config", { name = "ark", ports = { 80, 443 }, ["log level"] = "info", tls = false })
+vm.Export("count", 3)
+assert(not pcall(vm.Export, "fn", { callback = print }))
+local t = {}
+t.self = t
+local ok, err = pcall(vm.Export, "cyclic", t)
+assert(not ok and string.find(err, "cyclic"))
+assert(not pcall(vm.Export, "nan", { ratio = 0/0 }))
+assert(not pcall(vm.Export, "inf", 1/0))
+local shared = { 1 }
+vm.Export("shared", { a = shared, b = shared })`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vm2.Exports().Names()) != 0 {
+		t.Fatal("exports of vms shouldn't be shared")
+	}
+	exports := vm1.Exports()
+	for _, dump := range []func() ([]byte, error){exports.JSON, exports.YAML, exports.Lua} {
+		raw, err := dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println(string(raw))
+	}
+	raw, _ := exports.Lua()
+	if err := vm2.Exports().LoadLua(raw); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = exports.YAML()
+	yml := NewExportRegistry()
+	if err := yml.LoadYAML(raw); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = yml.MarshalJSON()
+	want, _ := exports.MarshalJSON()
+	if string(raw) != string(want) {
+		t.Fatalf("YAML round trip: %s != %s", raw, want)
+	}
+	err = vm2.Eval(`
+Import({"cushion-vm"})
+local vm = require("cushion-vm")
+local config = vm.Exported("config")
+assert(config.ports[2] == 443 and config["log level"] == "info" and vm.Exported("count") == 3)
+assert(vm.Exported("none") == nil)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportLoadLuaBudget(t *testing.T) {
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Budget: &Budget{MaxInstructions: 10000}})
+	exceeded := &BudgetExceededError{}
+	if err := vm.Exports().LoadLua([]byte(`while true do end return {}`)); !errors.As(err, &exceeded) {
+		t.Fatalf("want budget exceeded, got %v", err)
+	}
+	if err := vm.Exports().LoadLua([]byte(`return { isolated = print == nil and string == nil }`)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := vm.Exports().Get("isolated"); v != true {
+		t.Fatalf("chunk shouldn't access globals of vm, got %v", v)
 	}
 }
@@ -0,0 +1,362 @@
+package runtime
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// fsWalkOpt is the option of cushion-fs.walk
+type fsWalkOpt struct {
+	// Pattern matches the base name, or the relative path when it contains /, and ** is supported
+	Pattern string `lua:"pattern"`
+	// Type only keeps file or dir, and both are kept when it's empty
+	Type string `lua:"type"`
+	// MaxDepth limits the depth of directory, and children of root are depth 1
+	MaxDepth int `lua:"max_depth"`
+	// Hidden to walk into hidden files and directories starting with dot
+	Hidden bool `lua:"hidden"`
+	// Exclude skips files and directories matching any patterns like Pattern
+	Exclude []string `lua:"exclude"`
+}
+
+func loadFS(lvm *lua.LState) int {
+	return LuaModuleLoader(lvm, LuaFuncs{
+		"read":         fsRead,
+		"read_bytes":   fsReadBytes,
+		"read_lines":   fsReadLines,
+		"write":        fsWrite,
+		"write_bytes":  fsWriteBytes,
+		"safe_write":   fsSafeWrite,
+		"atomic_write": fsAtomicWrite,
+		"append":       fsAppend,
+		"exists":       fsExists,
+		"stat":         fsStat,
+		"chmod":        fsChmod,
+		"mkdirs":       fsMkdirs,
+		"remove":       fsRemove,
+		"list":         fsList,
+		"walk":         fsWalk,
+		"glob":         fsGlob,
+		"copy":         fsCopy,
+		"move":         fsMove,
+		"temp_dir":     fsTempDir,
+		"temp_file":    fsTempFile,
+	})
+}
+
+// fsResult pushes v when err is nil, otherwise pushes nil with error
+func fsResult(lvm *lua.LState, v lua.LValue, err error) int {
+	if err != nil {
+		lvm.Push(lua.LNil)
+	} else {
+		lvm.Push(v)
+	}
+	errHandle(lvm, err)
+	return 2
+}
+
+// fsRead returns text of file
+//
+//	local text, err = fs.read("config.yaml")
+func fsRead(lvm *lua.LState) int {
+	raw, err := utils.ReadStraemFromFile(lvm.CheckString(1))
+	return fsResult(lvm, lua.LString(raw), err)
+}
+
+// fsReadBytes returns bytes of file as array of numbers
+func fsReadBytes(lvm *lua.LState) int {
+	raw, err := utils.ReadStraemFromFile(lvm.CheckString(1))
+	if err != nil {
+		return fsResult(lvm, nil, err)
+	}
+	tbl := lvm.CreateTable(len(raw), 0)
+	for _, b := range raw {
+		tbl.Append(lua.LNumber(b))
+	}
+	return fsResult(lvm, tbl, nil)
+}
+
+// fsReadLines returns lines of file without line breaks
+func fsReadLines(lvm *lua.LState) int {
+	lines := []string{}
+	_, err := utils.ReadLineFromFile(lvm.CheckString(1), func(line string) string {
+		lines = append(lines, line)
+		return ""
+	})
+	return fsResult(lvm, strSlice2Table(lines), err)
+}
+
+// fsWrite to write text into file, and parent directory is created when it isn't exist
+func fsWrite(lvm *lua.LState) int {
+	file := lvm.CheckString(1)
+	data := lvm.CheckString(2)
+	errHandle(lvm, fsWriteFile(file, []byte(data), utils.WriteFile))
+	return 1
+}
+
+// fsWriteBytes to write array of numbers into file
+func fsWriteBytes(lvm *lua.LState) int {
+	file := lvm.CheckString(1)
+	data := checkBytes(lvm, 2)
+	errHandle(lvm, fsWriteFile(file, data, utils.WriteFile))
+	return 1
+}
+
+// fsSafeWrite to write text into file only when file isn't exist
+func fsSafeWrite(lvm *lua.LState) int {
+	file := lvm.CheckString(1)
+	data := lvm.CheckString(2)
+	errHandle(lvm, fsWriteFile(file, []byte(data), utils.SafeWriteFile))
+	return 1
+}
+
+// fsAtomicWrite to write text into temporary file and rename it to file,
+// so that file is either old or new content when the script fails.
+func fsAtomicWrite(lvm *lua.LState) int {
+	file := lvm.CheckString(1)
+	data := lvm.CheckString(2)
+	errHandle(lvm, fsWriteFile(file, []byte(data), func(file string, data []byte) error {
+		return utils.AtomicWriteFile(file, data, 0666)
+	}))
+	return 1
+}
+
+// fsAppend to append text to file, and file is created when it isn't exist
+func fsAppend(lvm *lua.LState) int {
+	file := lvm.CheckString(1)
+	data := lvm.CheckString(2)
+	errHandle(lvm, fsWriteFile(file, []byte(data), utils.AppendFile))
+	return 1
+}
+
+func fsWriteFile(file string, data []byte, write func(string, []byte) error) error {
+	if err := utils.SafeMkdirs(filepath.Dir(file)); err != nil {
+		return err
+	}
+	return write(file, data)
+}
+
+func checkBytes(lvm *lua.LState, n int) []byte {
+	tbl := lvm.CheckTable(n)
+	data := make([]byte, 0, tbl.Len())
+	for i := 1; i <= tbl.Len(); i++ {
+		b, ok := tbl.RawGetInt(i).(lua.LNumber)
+		if !ok || b < 0 || b > 255 {
+			lvm.ArgError(n, fmt.Sprintf("[%d] should be byte, got %s", i, tbl.RawGetInt(i).String()))
+		}
+		data = append(data, byte(b))
+	}
+	return data
+}
+
+// fsExists returns whether path exists
+func fsExists(lvm *lua.LState) int {
+	ok, err := utils.PathIsExist(lvm.CheckString(1))
+	return fsResult(lvm, lua.LBool(ok), err)
+}
+
+// fsStat returns name, size, mode, perm, is_dir, is_link and mod_time of path,
+// and it follows symbolic link except is_link.
+func fsStat(lvm *lua.LState) int {
+	p := lvm.CheckString(1)
+	linfo, err := os.Lstat(p)
+	if err != nil {
+		return fsResult(lvm, nil, err)
+	}
+	info := linfo
+	if linfo.Mode()&fs.ModeSymlink != 0 {
+		if info, err = os.Stat(p); err != nil {
+			return fsResult(lvm, nil, err)
+		}
+	}
+	tbl := lvm.NewTable()
+	tbl.RawSetString("name", lua.LString(info.Name()))
+	tbl.RawSetString("size", lua.LNumber(info.Size()))
+	tbl.RawSetString("mode", lua.LString(info.Mode().String()))
+	tbl.RawSetString("perm", lua.LNumber(info.Mode().Perm()))
+	tbl.RawSetString("is_dir", lua.LBool(info.IsDir()))
+	tbl.RawSetString("is_link", lua.LBool(linfo.Mode()&fs.ModeSymlink != 0))
+	tbl.RawSetString("mod_time", lua.LNumber(info.ModTime().Unix()))
+	return fsResult(lvm, tbl, nil)
+}
+
+// fsChmod to change permission of path, and mode is number or octal string such as "0755"
+func fsChmod(lvm *lua.LState) int {
+	p := lvm.CheckString(1)
+	var mode fs.FileMode
+	switch v := lvm.CheckAny(2).(type) {
+	case lua.LNumber:
+		mode = fs.FileMode(v)
+	case lua.LString:
+		m, err := strconv.ParseUint(string(v), 8, 32)
+		if err != nil {
+			raiseError(lvm, fmt.Errorf("invalid mode %q", string(v)))
+		}
+		mode = fs.FileMode(m)
+	default:
+		lvm.ArgError(2, "mode should be number or octal string")
+	}
+	errHandle(lvm, os.Chmod(p, mode&fs.ModePerm))
+	return 1
+}
+
+func fsMkdirs(lvm *lua.LState) int {
+	errHandle(lvm, utils.SafeMkdirs(lvm.CheckString(1)))
+	return 1
+}
+
+// fsRemove to remove file or empty directory, and directory is removed recursively with { recursive = true }
+func fsRemove(lvm *lua.LState) int {
+	p := lvm.CheckString(1)
+	if opt := lvm.OptTable(2, nil); opt != nil && lua.LVAsBool(opt.RawGetString("recursive")) {
+		errHandle(lvm, os.RemoveAll(p))
+		return 1
+	}
+	errHandle(lvm, os.Remove(p))
+	return 1
+}
+
+// fsList returns sorted names of directory entries
+func fsList(lvm *lua.LState) int {
+	entries, err := os.ReadDir(lvm.CheckString(1))
+	if err != nil {
+		return fsResult(lvm, nil, err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return fsResult(lvm, strSlice2Table(names), nil)
+}
+
+// fsWalk returns paths under root recursively in lexical order, which could be filtered by option
+// and the function filter(path, is_dir), whose false result skips the path and children of directory.
+//
+//	local files = fs.walk("src", { pattern = "*.go", type = "file", exclude = { "vendor" } })
+func fsWalk(lvm *lua.LState) int {
+	root := lvm.CheckString(1)
+	opt := fsWalkOpt{}
+	var filter *lua.LFunction
+	if tbl := lvm.OptTable(2, nil); tbl != nil {
+		if err := DecodeWithPath("opt", tbl, &opt); err != nil {
+			raiseError(lvm, err)
+		}
+		if fn, ok := tbl.RawGetString("filter").(*lua.LFunction); ok {
+			filter = fn
+		}
+	}
+	if len(opt.Type) > 0 && opt.Type != "file" && opt.Type != "dir" {
+		raiseError(lvm, fmt.Errorf("invalid type %q, expected file or dir", opt.Type))
+	}
+	for _, pattern := range append([]string{opt.Pattern}, opt.Exclude...) {
+		if _, err := utils.MatchPath(pattern, ""); err != nil {
+			raiseError(lvm, fmt.Errorf("invalid pattern %q", pattern))
+		}
+	}
+	paths := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		skip := filepath.SkipDir
+		if !d.IsDir() {
+			skip = nil
+		}
+		if (!opt.Hidden && strings.HasPrefix(d.Name(), ".")) || fsWalkMatchAny(opt.Exclude, rel) {
+			return skip
+		}
+		if filter != nil {
+			// error of filter is raised to caller
+			lvm.CallByParam(lua.P{Fn: filter, NRet: 1}, lua.LString(p), lua.LBool(d.IsDir()))
+			ok := lua.LVAsBool(lvm.Get(-1))
+			lvm.Pop(1)
+			if !ok {
+				return skip
+			}
+		}
+		depth := strings.Count(rel, "/") + 1
+		if (len(opt.Pattern) == 0 || fsWalkMatch(opt.Pattern, rel)) &&
+			(len(opt.Type) == 0 || (opt.Type == "dir") == d.IsDir()) {
+			paths = append(paths, p)
+		}
+		if d.IsDir() && opt.MaxDepth > 0 && depth >= opt.MaxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return fsResult(lvm, strSlice2Table(paths), err)
+}
+
+func fsWalkMatch(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") && !strings.Contains(pattern, "**") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	ok, _ := utils.MatchPath(pattern, rel)
+	return ok
+}
+
+func fsWalkMatchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if fsWalkMatch(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// fsGlob returns paths matching pattern, and ** matches any number of directories
+//
+//	local scripts = fs.glob("scripts/**/*.lua")
+func fsGlob(lvm *lua.LState) int {
+	matches, err := utils.Glob(lvm.CheckString(1))
+	if err == filepath.ErrBadPattern {
+		raiseError(lvm, fmt.Errorf("invalid pattern %q", lvm.CheckString(1)))
+	}
+	return fsResult(lvm, strSlice2Table(matches), err)
+}
+
+// fsCopy to copy file or directory recursively
+func fsCopy(lvm *lua.LState) int {
+	errHandle(lvm, utils.Copy(lvm.CheckString(1), lvm.CheckString(2)))
+	return 1
+}
+
+// fsMove to move file or directory, which works across devices
+func fsMove(lvm *lua.LState) int {
+	errHandle(lvm, utils.Move(lvm.CheckString(1), lvm.CheckString(2)))
+	return 1
+}
+
+// fsTempDir creates temporary directory with pattern in dir, and dir defaults to temporary directory of os
+func fsTempDir(lvm *lua.LState) int {
+	dir, err := os.MkdirTemp(lvm.OptString(2, ""), lvm.OptString(1, "cushion-*"))
+	return fsResult(lvm, lua.LString(dir), err)
+}
+
+// fsTempFile creates empty temporary file with pattern in dir, and returns its path
+func fsTempFile(lvm *lua.LState) int {
+	fp, err := os.CreateTemp(lvm.OptString(2, ""), lvm.OptString(1, "cushion-*"))
+	if err != nil {
+		return fsResult(lvm, nil, err)
+	}
+	fp.Close()
+	return fsResult(lvm, lua.LString(fp.Name()), nil)
+}
@@ -0,0 +1,52 @@
+package runtime
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestFS(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	vm.SetGlobalVar("root", lua.LString(t.TempDir()))
+	err := vm.Eval(`
+Import({"cushion-fs"})
+local fs = require("cushion-fs")
+assert(fs.write(root .. "/src/a/main.lua", "print(1)\nprint(2)") == nil)
+assert(fs.write_bytes(root .. "/src/a/b/data.bin", { 0, 255, 10 }) == nil)
+assert(fs.write(root .. "/src/.hidden/x.lua", "") == nil)
+assert(fs.append(root .. "/src/a/main.lua", "\nprint(3)") == nil)
+assert(#fs.read_lines(root .. "/src/a/main.lua") == 3)
+assert(fs.read_bytes(root .. "/src/a/b/data.bin")[2] == 255)
+assert(fs.safe_write(root .. "/src/a/main.lua", "overwritten") == nil)
+assert(fs.read(root .. "/src/a/main.lua"):find("print%(3%)"))
+assert(fs.atomic_write(root .. "/src/a/main.lua", "return 1") == nil)
+assert(fs.read(root .. "/src/a/main.lua") == "return 1")
+
+local files = fs.walk(root .. "/src", { type = "file" })
+assert(#files == 2, #files)
+assert(#fs.walk(root .. "/src", { pattern = "*.lua", hidden = true }) == 2)
+assert(#fs.walk(root .. "/src", { max_depth = 1 }) == 1)
+assert(#fs.walk(root .. "/src", { exclude = { "a/b" } }) == 2)
+assert(#fs.walk(root .. "/src", { filter = function(p, is_dir) return not is_dir or not p:find("/b$") end }) == 2)
+assert(#fs.glob(root .. "/src/**/*.bin") == 1)
+
+assert(fs.chmod(root .. "/src/a/main.lua", "0600") == nil)
+local info = fs.stat(root .. "/src/a/main.lua")
+assert(info.perm == 384 and info.size == 8 and not info.is_dir)
+
+assert(fs.copy(root .. "/src", root .. "/copy") == nil)
+assert(fs.stat(root .. "/copy/a/main.lua").perm == 384)
+assert(fs.move(root .. "/copy", root .. "/moved/copy") == nil)
+assert(not fs.exists(root .. "/copy") and fs.exists(root .. "/moved/copy/a/b/data.bin"))
+assert(fs.remove(root .. "/moved") ~= nil)
+assert(fs.remove(root .. "/moved", { recursive = true }) == nil)
+
+local tmp = fs.temp_dir("fs-test-*", root)
+assert(fs.list(root)[1] == tmp:match("[^/]+$"))
+local _, err = fs.read(root .. "/missing")
+assert(err ~= nil)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,132 @@
+package runtime
+
+import (
+	"context"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// vmHook is invoked before every instruction when vm is executing,
+// which is the basis of budget and other instrumentations.
+type vmHook interface {
+	// begin is called when a top-level Eval or Call starts
+	begin()
+	// step is called before every instruction, and the execution will be aborted when it returns error
+	step(*lua.LState) error
+}
+
+// hookContext is the context of an execution with hooks, which is shared by the vm and its coroutines.
+// It's safe to be used by other goroutines, because Done is a plain channel accessor,
+// and hooks are driven by stepContext on the goroutine executing lua.
+type hookContext struct {
+	context.Context
+	cancel context.CancelCauseFunc
+	hooks  []vmHook
+	// err is the error of hook, which is only written by the goroutine executing lua
+	err error
+}
+
+func newHookContext(ctx context.Context, hooks []vmHook) *hookContext {
+	hctx := &hookContext{hooks: hooks}
+	hctx.Context, hctx.cancel = context.WithCancelCause(ctx)
+	return hctx
+}
+
+// Err returns the error of hook firstly
+func (ctx *hookContext) Err() error {
+	if err := ctx.Context.Err(); err != nil {
+		return context.Cause(ctx.Context)
+	}
+	return nil
+}
+
+// abort records the error of hook and cancels the execution
+func (ctx *hookContext) abort(err error) {
+	ctx.err = err
+	ctx.cancel(err)
+}
+
+// convert returns the error of hook or the error caused by parent context instead of the raw error
+func (ctx *hookContext) convert(err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.err != nil {
+		return ctx.err
+	}
+	return contextErr(ctx.Context, err)
+}
+
+// stepContext is attached to the interpreter of vm or coroutine.
+// gopher-lua checks Done of context before every instruction,
+// so that hooks are able to observe the execution of every thread.
+// It mustn't leave the goroutine executing lua, see goContext.
+type stepContext struct {
+	// Context is the hookContext, or the child of it for coroutine
+	context.Context
+	hctx  *hookContext
+	state *lua.LState
+}
+
+// Done runs hooks with the executing thread, and returns channel closed when any hook aborts the execution
+func (ctx *stepContext) Done() <-chan struct{} {
+	if ctx.hctx.err == nil {
+		for _, hook := range ctx.hctx.hooks {
+			if err := hook.step(ctx.state); err != nil {
+				ctx.hctx.abort(err)
+				break
+			}
+		}
+	}
+	return ctx.Context.Done()
+}
+
+// attachThread shares hooks of lvm with thread, whose context is derived from lvm by NewThread
+func attachThread(lvm, thread *lua.LState) {
+	if sctx, ok := lvm.Context().(*stepContext); ok {
+		ctx := thread.Context()
+		if ctx == nil {
+			ctx = sctx.hctx
+		}
+		thread.SetContext(&stepContext{Context: ctx, hctx: sctx.hctx, state: thread})
+	}
+}
+
+// goContext returns the context of lvm which could be passed to other goroutines.
+// The hooks aren't run by it, and it's nil when lvm hasn't context.
+func goContext(lvm *lua.LState) context.Context {
+	if sctx, ok := lvm.Context().(*stepContext); ok {
+		return sctx.Context
+	}
+	return lvm.Context()
+}
+
+// hookCoroutines wraps create and wrap of coroutine library,
+// so that instructions executed by coroutines are observed by hooks.
+func hookCoroutines(state *lua.LState) {
+	co, ok := state.GetGlobal(lua.CoroutineLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	if create, ok := co.RawGetString("create").(*lua.LFunction); ok && create.IsG {
+		co.RawSetString("create", state.NewFunction(func(lvm *lua.LState) int {
+			n := create.GFunction(lvm)
+			if thread, ok := lvm.Get(-1).(*lua.LState); ok {
+				attachThread(lvm, thread)
+			}
+			return n
+		}))
+	}
+	if wrap, ok := co.RawGetString("wrap").(*lua.LFunction); ok && wrap.IsG {
+		co.RawSetString("wrap", state.NewFunction(func(lvm *lua.LState) int {
+			n := wrap.GFunction(lvm)
+			// the thread is the upvalue of wrapped function
+			if fn, ok := lvm.Get(-1).(*lua.LFunction); ok && len(fn.Upvalues) > 0 {
+				if thread, ok := fn.Upvalues[0].Value().(*lua.LState); ok {
+					attachThread(lvm, thread)
+				}
+			}
+			return n
+		}))
+	}
+}
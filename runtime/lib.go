@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"fmt"
 	"path"
 	"regexp"
 	"runtime"
@@ -16,16 +17,20 @@ import (
 	luar "layeh.com/gopher-luar"
 )
 
-func loadVM(lvm *lua.LState) int {
-	return LuaModuleLoader(lvm, LuaFuncs{
-		"Eval":      vmEval,
-		"EvalFile":  vmEvalFile,
-		"SetGlobal": vmSetGlobal,
-		"Export":    vmExport,
-		"OS":        vmOS,
-		"Arch":      vmArch,
-		"Workdir":   vmWorkdir,
-	})
+func loadVM(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		return LuaModuleLoader(lvm, LuaFuncs{
+			"Eval":      vmEval,
+			"EvalFile":  vmEvalFile,
+			"SetGlobal": vmSetGlobal,
+			"Export":    vmExport(vm),
+			"Exported":  vmExported(vm),
+			"Persist":   vmPersist(vm),
+			"OS":        vmOS,
+			"Arch":      vmArch,
+			"Workdir":   vmWorkdir,
+		})
+	}
 }
 
 func vmWorkdir(lvm *lua.LState) int {
@@ -43,13 +48,35 @@ func vmArch(lvm *lua.LState) int {
 	return 1
 }
 
-func vmExport(lvm *lua.LState) int {
-	key := utils.FirstUpper(utils.RandString(8))
-	value := lvm.CheckString(1)
-	tbl := lvm.CheckAny(2)
-	lvm.SetGlobal(key, tbl)
-	GetExport().Set(key, value)
-	return 0
+// vmExport to store value into export registry of vm with name,
+// and it raises error when value contains function, userdata or thread.
+func vmExport(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		name := lvm.CheckString(1)
+		value, err := exportValue(name, lvm.CheckAny(2))
+		if err != nil {
+			raiseError(lvm, err)
+		}
+		vm.exports.set(name, value)
+		return 0
+	}
+}
+
+// vmExported returns the value exported with name, which may be loaded from previous run
+func vmExported(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		value, ok := vm.exports.Get(lvm.CheckString(1))
+		if !ok {
+			lvm.Push(lua.LNil)
+			return 1
+		}
+		lv, err := Encode(lvm, value)
+		if err != nil {
+			raiseError(lvm, err)
+		}
+		lvm.Push(lv)
+		return 1
+	}
 }
 
 func vmEval(lvm *lua.LState) int {
@@ -81,9 +108,10 @@ func loadTui(lvm *lua.LState) int {
 }
 
 func tuiSpinner(lvm *lua.LState) int {
+	ctx, fn := lvm.Context(), lvm.CheckFunction(1)
 	components.UseSpinner(components.DefaultSpinnerStyle(), &components.SpinnerPayLoad{
 		Callback: func() {
-			LuaDoFunc(lvm, lvm.CheckFunction(1))
+			LuaDoFuncContext(ctx, lvm, fn)
 		},
 	})
 	return 0
@@ -92,9 +120,10 @@ func tuiSpinner(lvm *lua.LState) int {
 func tuiFancyList(lvm *lua.LState) int {
 	items := []list.Item{}
 	lvm.CheckTable(1).ForEach(func(idx, item lua.LValue) {
+		tbl := checkTableItem(lvm, 1, idx, item)
 		items = append(items, components.FancyListItem{
-			ChoiceTitle:  item.(*lua.LTable).RawGetString("title").String(),
-			ChoiceDetail: item.(*lua.LTable).RawGetString("detail").String(),
+			ChoiceTitle:  tbl.RawGetString("title").String(),
+			ChoiceDetail: tbl.RawGetString("detail").String(),
 		})
 	})
 	choice := components.UseFancyList(components.DefaultFancyListStyle(), &components.FancyListPayLoad{
@@ -112,7 +141,7 @@ func tuiSimpleList(lvm *lua.LState) int {
 		case "title":
 			payload.Title = l2.String()
 		case "choices":
-			l2.(*lua.LTable).ForEach(func(l1, l2 lua.LValue) {
+			checkTableItem(lvm, 1, l1, l2).ForEach(func(l1, l2 lua.LValue) {
 				payload.Choices = append(payload.Choices, l2.String())
 			})
 		}
@@ -127,7 +156,7 @@ func tuiSimpleList(lvm *lua.LState) int {
 func tuiTextInput(lvm *lua.LState) int {
 	texts := []components.TextInputFormat{}
 	lvm.CheckTable(1).ForEach(func(idx, tbl lua.LValue) {
-		text := tbl.(*lua.LTable)
+		text := checkTableItem(lvm, 1, idx, tbl)
 		echomode := false
 		switch text.RawGetString("echomode").String() {
 		case "true":
@@ -157,7 +186,7 @@ func tuiMultiSelect(lvm *lua.LState) int {
 	tbl := lvm.CheckTable(1)
 	title := tbl.RawGetString("title").String()
 	choices := []string{}
-	tbl.RawGetString("choices").(*lua.LTable).ForEach(func(idx, choice lua.LValue) {
+	checkTableItem(lvm, 1, lua.LString("choices"), tbl.RawGetString("choices")).ForEach(func(idx, choice lua.LValue) {
 		choices = append(choices, choice.String())
 	})
 	if len(choices) > 0 {
@@ -176,12 +205,18 @@ func tuiMultiSelect(lvm *lua.LState) int {
 }
 
 func tuiBatchSpinner(lvm *lua.LState) int {
+	ctx := lvm.Context()
 	tasks := []components.BatchTask{}
-	lvm.CheckTable(1).ForEach(func(idx, tbl lua.LValue) {
+	lvm.CheckTable(1).ForEach(func(idx, item lua.LValue) {
+		tbl := checkTableItem(lvm, 1, idx, item)
+		callback, ok := tbl.RawGetString("callback").(*lua.LFunction)
+		if !ok {
+			lvm.ArgError(1, fmt.Sprintf("callback of task %s should be function", idx))
+		}
 		tasks = append(tasks, components.BatchTask{
-			Name: tbl.(*lua.LTable).RawGetString("name").String(),
+			Name: tbl.RawGetString("name").String(),
 			Callback: func() bool {
-				if err := LuaDoFunc(lvm, tbl.(*lua.LTable).RawGetString("callback").(*lua.LFunction)); err != nil {
+				if err := LuaDoFuncContext(ctx, lvm, callback); err != nil {
 					return false
 				}
 				return true
@@ -191,7 +226,16 @@ func tuiBatchSpinner(lvm *lua.LState) int {
 	components.UseBatchSpinner(components.DefaultBatchSpinnerStyle(), &components.BatchSpinnerPayLoad{
 		Task: tasks,
 	})
-	return 1
+	return 0
+}
+
+// checkTableItem returns item of table argument, and it raises argument error when item isn't table
+func checkTableItem(lvm *lua.LState, n int, key, item lua.LValue) *lua.LTable {
+	tbl, ok := item.(*lua.LTable)
+	if !ok {
+		lvm.ArgError(n, fmt.Sprintf("%s should be table, got %s", key, item.Type()))
+	}
+	return tbl
 }
 
 func LoadCheck(lvm *lua.LState) int {
@@ -203,8 +247,14 @@ func LoadCheck(lvm *lua.LState) int {
 }
 
 func checkVersion(lvm *lua.LState) int {
-	want := utils.NewCheckedVersion(lvm.CheckString(1))
-	got := utils.NewCheckedVersion(lvm.CheckString(2))
+	want, err := checkedVersion(lvm.CheckString(1))
+	if err != nil {
+		raiseError(lvm, err)
+	}
+	got, err := checkedVersion(lvm.CheckString(2))
+	if err != nil {
+		raiseError(lvm, err)
+	}
 	if want.Compare(got) {
 		lvm.Push(lua.LTrue)
 	} else {
@@ -227,7 +277,7 @@ func checkFormatVersion(lvm *lua.LState) int {
 		}
 		curVersion += string(ch)
 	}
-	if curVersionLen := len(curVersion); curVersion[curVersionLen-1] == '.' {
+	if curVersionLen := len(curVersion); curVersionLen > 0 && curVersion[curVersionLen-1] == '.' {
 		curVersion = curVersion[:curVersionLen-1]
 	}
 	lvm.Push(lua.LString(curVersion))
@@ -236,13 +286,13 @@ func checkFormatVersion(lvm *lua.LState) int {
 
 func checkEnv(lvm *lua.LState) int {
 	cmd := lvm.CheckString(1)
-	out, err := utils.Exec(cmd)
-	res := ""
+	reg, err := regexp.Compile(lvm.CheckString(2))
 	if err != nil {
-		res = ""
-	} else {
-		filter := lvm.CheckString(2)
-		reg := regexp.MustCompile(filter)
+		raiseError(lvm, err)
+	}
+	out, err := utils.ExecStr(cmd)
+	res := ""
+	if err == nil {
 		regRes := reg.FindStringSubmatch(string(out))
 		if len(regRes) > 1 {
 			res = regRes[1]
@@ -287,18 +337,52 @@ func ioMkdirs(lvm *lua.LState) int {
 
 func ioExec(lvm *lua.LState) int {
 	out, err := utils.ExecStr(lvm.CheckString(1))
-	lvm.Push(lua.LString(utils.ConvertByte2String(out, utils.GB18030)))
+	if err != nil {
+		lvm.Push(lua.LNil)
+	} else {
+		lvm.Push(lua.LString(utils.ConvertByte2String(out, shellCharset())))
+	}
 	errHandle(lvm, err)
 	return 2
 }
 
-func ioFetch(lvm *lua.LState) int {
-	_, err := utils.FetchFile(lvm.CheckString(1), lvm.CheckString(2))
-	if err != nil {
-		lvm.Push(lua.LString(err.Error()))
-	} else {
-		lvm.Push(lua.LNil)
+// fetchOpt is the option of cushion-io.Fetch and cushion-async.fetch
+type fetchOpt struct {
+	// Checksum is sha256:<hex> or md5:<hex>
+	Checksum string   `lua:"checksum"`
+	Mirrors  []string `lua:"mirrors"`
+	Retries  int      `lua:"retries"`
+	// Cache is the directory of content-addressed cache
+	Cache string `lua:"cache"`
+}
+
+// checkDownloadOpt converts the option table at n into utils.DownloadOpt,
+// and on_progress(downloaded, total) is called on the goroutine of vm when progress is true.
+func checkDownloadOpt(lvm *lua.LState, n int, progress bool) utils.DownloadOpt {
+	tbl := lvm.OptTable(n, nil)
+	if tbl == nil {
+		return utils.DownloadOpt{}
+	}
+	opt := fetchOpt{}
+	if err := DecodeWithPath("opt", tbl, &opt); err != nil {
+		raiseError(lvm, err)
+	}
+	dopt := utils.DownloadOpt{Checksum: opt.Checksum, Mirrors: opt.Mirrors, Retries: opt.Retries, CacheDir: opt.Cache}
+	if fn, ok := tbl.RawGetString("on_progress").(*lua.LFunction); ok && progress {
+		dopt.Progress = func(p utils.DownloadProgress) {
+			lvm.CallByParam(lua.P{Fn: fn}, lua.LNumber(p.Downloaded), lua.LNumber(p.Total))
+		}
 	}
+	return dopt
+}
+
+// ioFetch to download url into dst, which is resumed and retried, and verified by checksum of option
+//
+//	local err = io.Fetch(url, "pkg.zip", { checksum = "sha256:...", mirrors = { mirror }, cache = ".cache" })
+func ioFetch(lvm *lua.LState) int {
+	url, dst := lvm.CheckString(1), lvm.CheckString(2)
+	_, err := utils.Download(goContext(lvm), url, dst, checkDownloadOpt(lvm, 3, true))
+	errHandle(lvm, err)
 	return 1
 }
 
@@ -321,8 +405,12 @@ func tmplCompile(lvm *lua.LState) int {
 	})
 	tmpl := build.NewTemplate()
 	out, err := tmpl.OnceParse(lvm.CheckString(1), dict)
-	lvm.Push(lua.LString(out))
-	lvm.Push(luar.New(lvm, err))
+	if err != nil {
+		lvm.Push(lua.LNil)
+	} else {
+		lvm.Push(lua.LString(out))
+	}
+	errHandle(lvm, err)
 	return 2
 }
 
@@ -413,9 +501,11 @@ func pathMatch(lvm *lua.LState) int {
 	pattern := lvm.CheckString(1)
 	name := lvm.CheckString(2)
 	matched, err := path.Match(pattern, name)
+	if err != nil {
+		raiseError(lvm, err)
+	}
 	lvm.Push(lua.LBool(matched))
-	errHandle(lvm, err)
-	return 2
+	return 1
 }
 
 func pathFilename(lvm *lua.LState) int {
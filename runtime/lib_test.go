@@ -0,0 +1,31 @@
+package runtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestFetchWithHooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("cushion", 1<<14)))
+	}))
+	defer srv.Close()
+	// the context passed to http mustn't run hooks on other goroutines, which is checked by -race
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Budget: &Budget{MaxInstructions: 1e6}}).Default()
+	vm.SetGlobalVar("url", lua.LString(srv.URL))
+	vm.SetGlobalVar("root", lua.LString(t.TempDir()))
+	err := vm.Eval(`
+Import({"cushion-io"})
+local io = require("cushion-io")
+local received = 0
+local err = io.Fetch(url, root .. "/data", { on_progress = function(n, total) received = n end })
+assert(err == nil, err)
+assert(received == 7 * 16384, received)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
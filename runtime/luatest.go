@@ -0,0 +1,504 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// LuaTestCase is the case declared by `it` of cushion-test
+type LuaTestCase struct {
+	// Name is the names of describe blocks and case joined by /
+	Name string
+	File string
+	Line int
+	Skip bool
+	Only bool
+
+	fn    *lua.LFunction
+	suite *luaTestSuite
+}
+
+// LuaTestResult is the result of LuaTestCase, and Err is nil when case passes or is skipped
+type LuaTestResult struct {
+	Case    *LuaTestCase
+	Skipped bool
+	Err     error
+}
+
+// luaTestSuite is the block declared by describe
+type luaTestSuite struct {
+	name   string
+	parent *luaTestSuite
+	before []*lua.LFunction
+	after  []*lua.LFunction
+	skip   bool
+	only   bool
+}
+
+// chain returns suites from root to s
+func (s *luaTestSuite) chain() []*luaTestSuite {
+	suites := []*luaTestSuite{}
+	for ; s != nil; s = s.parent {
+		suites = append([]*luaTestSuite{s}, suites...)
+	}
+	return suites
+}
+
+// luaTests collects cases of vm
+type luaTests struct {
+	root    *luaTestSuite
+	current *luaTestSuite
+	cases   []*LuaTestCase
+}
+
+func newLuaTests() *luaTests {
+	root := &luaTestSuite{}
+	return &luaTests{root: root, current: root}
+}
+
+// hasOnly returns whether some case is marked as only
+func (tests *luaTests) hasOnly() bool {
+	for _, c := range tests.cases {
+		if c.Only {
+			return true
+		}
+	}
+	return false
+}
+
+// run to call before_each hooks from outer to inner, the case and after_each hooks from inner to outer.
+// The after_each hooks are always called, and the first error is returned.
+func (tests *luaTests) run(lvm *lua.LState, c *LuaTestCase) error {
+	call := func(fn *lua.LFunction) error {
+		return lvm.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true})
+	}
+	suites := c.suite.chain()
+	var err error
+	for _, suite := range suites {
+		for _, fn := range suite.before {
+			if err = call(fn); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = call(c.fn)
+	}
+	for i := len(suites) - 1; i >= 0; i-- {
+		for j := len(suites[i].after) - 1; j >= 0; j-- {
+			if e := call(suites[i].after[j]); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s:%d: %s", c.File, c.Line, luaTestStripPosition(luaTestMessage(err), c.File))
+	}
+	return nil
+}
+
+// runAll runs cases in order of declaration, and cases without only mark are skipped when some case has it
+func (tests *luaTests) runAll(lvm *lua.LState) []LuaTestResult {
+	only := tests.hasOnly()
+	results := []LuaTestResult{}
+	for _, c := range tests.cases {
+		if c.Skip || (only && !c.Only) {
+			results = append(results, LuaTestResult{Case: c, Skipped: true})
+			continue
+		}
+		results = append(results, LuaTestResult{Case: c, Err: tests.run(lvm, c)})
+	}
+	return results
+}
+
+// luaTestMessage returns the message of lua error without traceback
+func luaTestMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok && apiErr.Object != nil {
+		return apiErr.Object.String()
+	}
+	return err.Error()
+}
+
+// luaTestStripPosition removes the position of file raising error, which is replaced by position of case.
+// The position of other file is kept, such as error raised by required module.
+func luaTestStripPosition(msg, file string) string {
+	rest, ok := strings.CutPrefix(msg, file+":")
+	if !ok {
+		return msg
+	}
+	line, rest, ok := strings.Cut(rest, ": ")
+	if _, err := strconv.Atoi(line); !ok || err != nil {
+		return msg
+	}
+	return rest
+}
+
+// tests returns the cases collector of vm
+func (vm *LuaVM) tests() *luaTests {
+	if vm.testCases == nil {
+		vm.testCases = newLuaTests()
+	}
+	return vm.testCases
+}
+
+// RunLuaTests to run lua test files, and each case declared by cushion-test is mapped to subtest of t.
+// Every file is evaluated by a new vm, and the failure of case is reported with file and line of it.
+func RunLuaTests(t *testing.T, files ...string) {
+	t.Helper()
+	RunLuaTestsWithOpt(t, LuaVMOpt{}, files...)
+}
+
+// RunLuaTestsWithOpt is the same as RunLuaTests, but vm is created according to opt
+func RunLuaTestsWithOpt(t *testing.T, opt LuaVMOpt, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		file := file
+		t.Run(file, func(t *testing.T) {
+			vm := NewVirtualMachineWithOpt(opt).Default().(*LuaVM)
+			defer vm.Interp().Close()
+			// cushion-test is available without Import for test files
+			if mcb, ok := vm.mat.MCB("cushion-test")["cushion-test"]; ok {
+				vm.state.PreloadModule("cushion-test", mcb.loader())
+				mcb.Mark()
+			}
+			if err := vm.EvalFile(file); err != nil {
+				t.Fatalf("%s: %s", file, err)
+			}
+			tests := vm.tests()
+			only := tests.hasOnly()
+			for _, c := range tests.cases {
+				c := c
+				t.Run(c.Name, func(t *testing.T) {
+					if c.Skip || (only && !c.Only) {
+						t.Skipf("%s:%d: skipped", c.File, c.Line)
+					}
+					var err error
+					if e := vm.exec(nil, func() error {
+						err = tests.run(vm.state, c)
+						return nil
+					}); e != nil {
+						err = e
+					}
+					if err != nil {
+						t.Error(err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// loadTest returns the loader of cushion-test, which declares cases for RunLuaTests or run
+func loadTest(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		mod := lvm.NewTable()
+		mod.RawSetString("describe", testCallable(lvm, testDescribe(vm)))
+		mod.RawSetString("it", testCallable(lvm, testIt(vm)))
+		lvm.SetFuncs(mod, LuaFuncs{
+			"before_each": testHook(vm, false),
+			"after_each":  testHook(vm, true),
+			"run":         testRun(vm),
+		})
+		mod.RawSetString("assert", lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+			"equal":     testEqual,
+			"not_equal": testNotEqual,
+			"truthy":    testTruthy,
+			"falsy":     testFalsy,
+			"is_nil":    testIsNil,
+			"not_nil":   testNotNil,
+			"error":     testError,
+		}))
+		lvm.Push(mod)
+		return 1
+	}
+}
+
+// testMark is the mark of describe or it
+type testMark int
+
+const (
+	testNormal testMark = iota
+	testSkip
+	testOnly
+)
+
+// testCallable returns the table which is callable as fn(name, func),
+// and its skip and only fields mark the block to be skipped or exclusive.
+func testCallable(lvm *lua.LState, fn func(testMark) lua.LGFunction) *lua.LTable {
+	tbl := lvm.NewTable()
+	tbl.RawSetString("skip", lvm.NewFunction(fn(testSkip)))
+	tbl.RawSetString("only", lvm.NewFunction(fn(testOnly)))
+	normal := fn(testNormal)
+	meta := lvm.NewTable()
+	meta.RawSetString("__call", lvm.NewFunction(func(lvm *lua.LState) int {
+		// the first argument is the table itself
+		lvm.Remove(1)
+		return normal(lvm)
+	}))
+	lvm.SetMetatable(tbl, meta)
+	return tbl
+}
+
+func testDescribe(vm *LuaVM) func(testMark) lua.LGFunction {
+	return func(mark testMark) lua.LGFunction {
+		return func(lvm *lua.LState) int {
+			name := lvm.CheckString(1)
+			fn := lvm.CheckFunction(2)
+			tests := vm.tests()
+			parent := tests.current
+			tests.current = &luaTestSuite{
+				name:   name,
+				parent: parent,
+				skip:   parent.skip || mark == testSkip,
+				only:   parent.only || mark == testOnly,
+			}
+			defer func() { tests.current = parent }()
+			lvm.Push(fn)
+			lvm.Call(0, 0)
+			return 0
+		}
+	}
+}
+
+func testIt(vm *LuaVM) func(testMark) lua.LGFunction {
+	return func(mark testMark) lua.LGFunction {
+		return func(lvm *lua.LState) int {
+			name := lvm.CheckString(1)
+			fn := lvm.CheckFunction(2)
+			tests := vm.tests()
+			names := []string{}
+			for _, suite := range tests.current.chain()[1:] {
+				names = append(names, suite.name)
+			}
+			c := &LuaTestCase{
+				Name:  strings.Join(append(names, name), "/"),
+				Skip:  tests.current.skip || mark == testSkip,
+				Only:  tests.current.only || mark == testOnly,
+				fn:    fn,
+				suite: tests.current,
+			}
+			if dbg, ok := lvm.GetStack(1); ok {
+				if _, err := lvm.GetInfo("Sl", dbg, lua.LNil); err == nil {
+					c.File, c.Line = dbg.Source, dbg.CurrentLine
+				}
+			}
+			tests.cases = append(tests.cases, c)
+			return 0
+		}
+	}
+}
+
+func testHook(vm *LuaVM, after bool) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		fn := lvm.CheckFunction(1)
+		suite := vm.tests().current
+		if after {
+			suite.after = append(suite.after, fn)
+		} else {
+			suite.before = append(suite.before, fn)
+		}
+		return 0
+	}
+}
+
+// testRun runs the declared cases in script, and returns the table of
+// passed, failed, skipped counts and failures list whose item has name and message.
+func testRun(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		passed, failed, skipped := 0, 0, 0
+		failures := lvm.NewTable()
+		for _, result := range vm.tests().runAll(lvm) {
+			switch {
+			case result.Skipped:
+				skipped++
+			case result.Err != nil:
+				failed++
+				failure := lvm.NewTable()
+				failure.RawSetString("name", lua.LString(result.Case.Name))
+				failure.RawSetString("message", lua.LString(result.Err.Error()))
+				failures.Append(failure)
+			default:
+				passed++
+			}
+		}
+		ret := lvm.NewTable()
+		ret.RawSetString("passed", lua.LNumber(passed))
+		ret.RawSetString("failed", lua.LNumber(failed))
+		ret.RawSetString("skipped", lua.LNumber(skipped))
+		ret.RawSetString("failures", failures)
+		lvm.Push(ret)
+		return 1
+	}
+}
+
+// testFail raises assertion error with optional message of user, which is the argument at idx
+func testFail(lvm *lua.LState, idx int, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if custom := lvm.OptString(idx, ""); len(custom) > 0 {
+		msg = custom + ": " + msg
+	}
+	raiseError(lvm, errors.New(msg))
+}
+
+func testEqual(lvm *lua.LState) int {
+	expected, actual := lvm.CheckAny(1), lvm.CheckAny(2)
+	if diffs := testDiff("", expected, actual, nil, map[[2]lua.LValue]bool{}); len(diffs) > 0 {
+		testFail(lvm, 3, "values are not equal:\n  %s", strings.Join(diffs, "\n  "))
+	}
+	return 0
+}
+
+func testNotEqual(lvm *lua.LState) int {
+	expected, actual := lvm.CheckAny(1), lvm.CheckAny(2)
+	if len(testDiff("", expected, actual, nil, map[[2]lua.LValue]bool{})) == 0 {
+		testFail(lvm, 3, "values are equal: %s", testInspect(actual, 2))
+	}
+	return 0
+}
+
+func testTruthy(lvm *lua.LState) int {
+	if v := lvm.Get(1); !lua.LVAsBool(v) {
+		testFail(lvm, 2, "expected truthy value, got %s", testInspect(v, 2))
+	}
+	return 0
+}
+
+func testFalsy(lvm *lua.LState) int {
+	if v := lvm.Get(1); lua.LVAsBool(v) {
+		testFail(lvm, 2, "expected falsy value, got %s", testInspect(v, 2))
+	}
+	return 0
+}
+
+func testIsNil(lvm *lua.LState) int {
+	if v := lvm.Get(1); v != lua.LNil {
+		testFail(lvm, 2, "expected nil, got %s", testInspect(v, 2))
+	}
+	return 0
+}
+
+func testNotNil(lvm *lua.LState) int {
+	if lvm.Get(1) == lua.LNil {
+		testFail(lvm, 2, "expected non-nil value")
+	}
+	return 0
+}
+
+// testError asserts fn raises error, and the message should contain pattern when it's specified
+func testError(lvm *lua.LState) int {
+	fn := lvm.CheckFunction(1)
+	pattern := lvm.OptString(2, "")
+	err := lvm.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true})
+	if err == nil {
+		testFail(lvm, 3, "expected error, but function returned")
+	}
+	if msg := luaTestMessage(err); !strings.Contains(msg, pattern) {
+		testFail(lvm, 3, "expected error containing %q, got %q", pattern, msg)
+	}
+	return 0
+}
+
+// testDiff compares values deeply, and returns the differences with path of value.
+// The visited pairs of table are recorded to avoid infinite recursion of cyclic table.
+func testDiff(path string, expected, actual lua.LValue, diffs []string, visited map[[2]lua.LValue]bool) []string {
+	name := path
+	if len(name) == 0 {
+		name = "value"
+	}
+	et, eok := expected.(*lua.LTable)
+	at, aok := actual.(*lua.LTable)
+	if !eok || !aok {
+		if expected != actual {
+			diffs = append(diffs, fmt.Sprintf("%s: expected %s, got %s", name, testInspect(expected, 2), testInspect(actual, 2)))
+		}
+		return diffs
+	}
+	if et == at || visited[[2]lua.LValue{et, at}] {
+		return diffs
+	}
+	visited[[2]lua.LValue{et, at}] = true
+	for _, key := range testKeys(et) {
+		sub := path + testKeyPath(key)
+		av := at.RawGet(key)
+		if av == lua.LNil {
+			diffs = append(diffs, fmt.Sprintf("%s: missing, expected %s", sub, testInspect(et.RawGet(key), 2)))
+			continue
+		}
+		diffs = testDiff(sub, et.RawGet(key), av, diffs, visited)
+	}
+	for _, key := range testKeys(at) {
+		if et.RawGet(key) == lua.LNil {
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", path+testKeyPath(key), testInspect(at.RawGet(key), 2)))
+		}
+	}
+	return diffs
+}
+
+// testKeys returns keys of table, numbers are ordered before others
+func testKeys(tbl *lua.LTable) []lua.LValue {
+	keys := []lua.LValue{}
+	tbl.ForEach(func(k, _ lua.LValue) {
+		keys = append(keys, k)
+	})
+	sort.SliceStable(keys, func(i, j int) bool {
+		ni, iok := keys[i].(lua.LNumber)
+		nj, jok := keys[j].(lua.LNumber)
+		if iok && jok {
+			return ni < nj
+		}
+		if iok != jok {
+			return iok
+		}
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// testKeyPath formats key as the accessor of table, such as .name, [1] and ["a b"]
+func testKeyPath(key lua.LValue) string {
+	switch k := key.(type) {
+	case lua.LNumber:
+		return "[" + k.String() + "]"
+	case lua.LString:
+		if luaIdentifier(string(k)) {
+			return "." + string(k)
+		}
+		return "[" + strconv.Quote(string(k)) + "]"
+	}
+	return "[" + key.String() + "]"
+}
+
+// testInspect formats value in lua syntax, and nested tables deeper than depth are abbreviated
+func testInspect(v lua.LValue, depth int) string {
+	switch val := v.(type) {
+	case lua.LString:
+		return strconv.Quote(string(val))
+	case *lua.LTable:
+		if depth <= 0 {
+			return "{...}"
+		}
+		items := []string{}
+		for _, key := range testKeys(val) {
+			if n, ok := key.(lua.LNumber); ok && int(n) == len(items)+1 && float64(n) == float64(int(n)) {
+				items = append(items, testInspect(val.RawGet(key), depth-1))
+				continue
+			}
+			if s, ok := key.(lua.LString); ok && luaIdentifier(string(s)) {
+				items = append(items, string(s)+" = "+testInspect(val.RawGet(key), depth-1))
+				continue
+			}
+			items = append(items, "["+testInspect(key, 0)+"] = "+testInspect(val.RawGet(key), depth-1))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return v.String()
+}
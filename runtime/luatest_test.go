@@ -0,0 +1,54 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuaTest(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+Import({"cushion-test"})
+local test = require("cushion-test")
+local describe, it = test.describe, test.it
+local log = {}
+describe("server", function()
+	test.before_each(function() table.insert(log, "before") end)
+	test.after_each(function() table.insert(log, "after") end)
+	it("starts", function()
+		test.assert.equal({ host = "localhost", ports = { 80, 443 } }, { host = "localhost", ports = { 80, 443 } })
+	end)
+	it("listens", function()
+		test.assert.equal({ host = "localhost", ports = { 80, 443 } }, { host = "0.0.0.0", ports = { 80 }, tls = true })
+	end)
+	it.skip("stops", function() error("unreachable") end)
+end)
+it("fails", function()
+	test.assert.error(function() error("boom") end, "boom")
+	test.assert.error(function() end)
+end)
+local ret = test.run()
+assert(ret.passed == 1 and ret.failed == 2 and ret.skipped == 1)
+assert(table.concat(log, ",") == "before,after,before,after")
+assert(ret.failures[1].name == "server/listens")
+Message = ret.failures[1].message .. "\n" .. ret.failures[2].message`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := vm.Interp().GetGlobal("Message").String()
+	t.Log(msg)
+	for _, want := range []string{
+		`<string>:12: values are not equal:`,
+		`.host: expected "localhost", got "0.0.0.0"`,
+		`.ports[2]: missing, expected 443`,
+		`.tls: unexpected true`,
+		`<string>:17: expected error, but function returned`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("%q isn't found in failures", want)
+		}
+	}
+	if strings.Contains(msg, "<string>:13:") {
+		t.Fatal("position of assertion is repeated")
+	}
+}
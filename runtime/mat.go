@@ -1,18 +1,32 @@
 package runtime
 
-import lua "github.com/yuin/gopher-lua"
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
 
 // MAT is abbreviation for module allocate table,
 // which is used to load module into virtual machine with lazy.
 type MAT interface {
 	// Mount to add MCB to MAT
 	Mount(LuaFuncs) MAT
+	// MountDesc to add MCB with version, dependencies and hooks to MAT
+	MountDesc(map[string]ModuleDesc) MAT
 	// Unmount to remove MCB from MAT
 	Unmount(string) MAT
 	// Collect to converge specify mcb according to cluster.
 	Collect(string, []string) MAT
 	// MCB returns mcb list
 	MCB(string) map[string]*luaMCB
+	// Clusters returns mids of every cluster
+	Clusters() map[string][]string
+	// Mids returns sorted mids of all modules
+	Mids() []string
+	// Resolve returns mids of cluster or mid and their dependencies in topological order
+	Resolve(string) ([]string, error)
 }
 
 // MCB is abbreviation for module control block,
@@ -22,6 +36,23 @@ type MCB interface {
 	Mark()
 	// Used returns whether mcb is used
 	Used() bool
+	// Version returns version of module
+	Version() string
+	// Deps returns mids which module depends on
+	Deps() []string
+}
+
+// ModuleDesc describes module to be mounted into MAT
+type ModuleDesc struct {
+	Version string
+	// Deps are mids to be loaded before module
+	Deps []string
+	// Loader is called by require, which pushes module onto stack
+	Loader lua.LGFunction
+	// OnLoad is called after module is loaded by require
+	OnLoad func(*lua.LState) error
+	// OnUnload is called when loaded module is unregistered
+	OnUnload func(*lua.LState)
 }
 
 var (
@@ -77,6 +108,92 @@ func (mat *LuaMAT) Mount(funcs LuaFuncs) MAT {
 	return mat
 }
 
+// MountDesc to add MCB with version, dependencies and hooks to MAT
+func (mat *LuaMAT) MountDesc(descs map[string]ModuleDesc) MAT {
+	for mid, desc := range descs {
+		_, ok := mat.mcbs[mid]
+		if ok {
+			continue
+		}
+		_, ok = mat.cluster[mid]
+		if ok {
+			continue
+		}
+		mcb := NewLuaMCB(desc.Loader)
+		mcb.version = desc.Version
+		mcb.deps = desc.Deps
+		mcb.onLoad = desc.OnLoad
+		mcb.onUnload = desc.OnUnload
+		mat.mcbs[mid] = mcb
+	}
+	return mat
+}
+
+// Clusters returns mids of every cluster
+func (mat *LuaMAT) Clusters() map[string][]string {
+	ret := make(map[string][]string)
+	for cluster, mids := range mat.cluster {
+		ret[cluster] = append([]string{}, mids...)
+	}
+	return ret
+}
+
+// Mids returns sorted mids of all modules
+func (mat *LuaMAT) Mids() []string {
+	mids := []string{}
+	for mid := range mat.mcbs {
+		mids = append(mids, mid)
+	}
+	sort.Strings(mids)
+	return mids
+}
+
+// Resolve returns mids of cluster or mid and their dependencies in topological order,
+// and it returns error when dependency is missing or cyclic.
+func (mat *LuaMAT) Resolve(name string) ([]string, error) {
+	mids := []string{}
+	if cluster, ok := mat.cluster[name]; ok {
+		for _, mid := range cluster {
+			if _, ok := mat.mcbs[mid]; ok {
+				mids = append(mids, mid)
+			}
+		}
+	} else if _, ok := mat.mcbs[name]; ok {
+		mids = append(mids, name)
+	}
+	ret := []string{}
+	// 1 means visiting, and 2 means visited
+	state := make(map[string]int)
+	var visit func(mid string, path []string) error
+	visit = func(mid string, path []string) error {
+		path = append(path, mid)
+		switch state[mid] {
+		case 1:
+			return fmt.Errorf("module %s has cyclic dependency: %s", mid, strings.Join(path, " -> "))
+		case 2:
+			return nil
+		}
+		state[mid] = 1
+		for _, dep := range mat.mcbs[mid].deps {
+			if _, ok := mat.mcbs[dep]; !ok {
+				return fmt.Errorf("module %s depends on missing module %s", mid, dep)
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[mid] = 2
+		ret = append(ret, mid)
+		return nil
+	}
+	for _, mid := range mids {
+		if err := visit(mid, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
 // Unmount to remove MCB from MAT
 func (mat *LuaMAT) Unmount(mid string) MAT {
 	delete(mat.mcbs, mid)
@@ -97,8 +214,13 @@ func (mat *LuaMAT) Collect(cluster string, mids []string) MAT {
 // MCB is abbreviation for module control block,
 // which store and control module meta.
 type luaMCB struct {
-	fun  lua.LGFunction
-	used bool
+	fun      lua.LGFunction
+	used     bool
+	version  string
+	deps     []string
+	onLoad   func(*lua.LState) error
+	onUnload func(*lua.LState)
+	loaded   bool
 }
 
 func NewLuaMCB(fun lua.LGFunction) *luaMCB {
@@ -122,3 +244,42 @@ func (mcb *luaMCB) Used() bool {
 func (mcb *luaMCB) Mark() {
 	mcb.used = true
 }
+
+// Version returns version of module
+func (mcb *luaMCB) Version() string {
+	return mcb.version
+}
+
+// Deps returns mids which module depends on
+func (mcb *luaMCB) Deps() []string {
+	return mcb.deps
+}
+
+// Loaded returns whether module is loaded by require
+func (mcb *luaMCB) Loaded() bool {
+	return mcb.loaded
+}
+
+// loader wraps fun to require dependencies firstly and call OnLoad hook
+func (mcb *luaMCB) loader() lua.LGFunction {
+	if len(mcb.deps) == 0 && mcb.onLoad == nil && mcb.onUnload == nil {
+		return mcb.fun
+	}
+	return func(lvm *lua.LState) int {
+		for _, dep := range mcb.deps {
+			lvm.CallByParam(lua.P{
+				Fn:      lvm.GetGlobal("require"),
+				NRet:    0,
+				Protect: false,
+			}, lua.LString(dep))
+		}
+		n := mcb.fun(lvm)
+		mcb.loaded = true
+		if mcb.onLoad != nil {
+			if err := mcb.onLoad(lvm); err != nil {
+				raiseError(lvm, err)
+			}
+		}
+		return n
+	}
+}
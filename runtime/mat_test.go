@@ -2,7 +2,10 @@ package runtime
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 func TestMAT(t *testing.T) {
@@ -11,7 +14,7 @@ func TestMAT(t *testing.T) {
 		"cushion-io":     loadIO,
 		"cushion-tmpl":   loadTmpl,
 		"cushion-tui":    loadTui,
-		"cushion-vm":     loadVM,
+		"cushion-vm":     loadVM(nil),
 		"cushion-crypto": loadCrypto,
 		"cushion-time":   loadTime,
 	}).Collect("cushion", []string{
@@ -51,3 +54,71 @@ func TestMAT(t *testing.T) {
 		fmt.Println("TestMAT UNPASS")
 	}
 }
+
+func TestModuleDesc(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	loads := []string{}
+	newDesc := func(mid string, deps ...string) ModuleDesc {
+		return ModuleDesc{
+			Version: "1.0.0",
+			Deps:    deps,
+			Loader: func(lvm *lua.LState) int {
+				lvm.Push(lvm.SetFuncs(lvm.NewTable(), LuaFuncs{}))
+				return 1
+			},
+			OnLoad: func(l *lua.LState) error {
+				loads = append(loads, mid)
+				return nil
+			},
+			OnUnload: func(l *lua.LState) {
+				loads = append(loads, "-"+mid)
+			},
+		}
+	}
+	vm.RegisterModuleDesc(map[string]ModuleDesc{
+		"mod-a":     newDesc("mod-a", "mod-b", "mod-c"),
+		"mod-b":     newDesc("mod-b", "mod-c"),
+		"mod-c":     newDesc("mod-c"),
+		"mod-cycle": newDesc("mod-cycle", "mod-loop"),
+		"mod-loop":  newDesc("mod-loop", "mod-cycle"),
+		"mod-miss":  newDesc("mod-miss", "mod-none"),
+	})
+	if err := vm.Eval(`Import({"mod-a"}) require("mod-a")`); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(loads, ","); got != "mod-c,mod-b,mod-a" {
+		t.Fatal(got)
+	}
+	vm.UnregisterModule("mod-a")
+	if err := vm.Eval(`assert(package.loaded["mod-a"] == nil and package.preload["mod-a"] == nil)`); err != nil {
+		t.Fatal(err)
+	}
+	if loads[len(loads)-1] != "-mod-a" {
+		t.Fatal(loads)
+	}
+	testDataset := map[string]string{
+		`Import({"mod-cycle"})`: "cyclic dependency: mod-cycle -> mod-loop -> mod-cycle",
+		`Import({"mod-miss"})`:  "depends on missing module mod-none",
+	}
+	for script, want := range testDataset {
+		if err := vm.Eval(script); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want %s, got %v", script, want, err)
+		}
+	}
+}
+
+func TestModuleDescSandbox(t *testing.T) {
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Sandbox: &Capabilities{Libs: []string{"base"}, Modules: []string{"mod-app"}}}).Default()
+	loader := func(lvm *lua.LState) int {
+		lvm.Push(lvm.NewTable())
+		return 1
+	}
+	vm.RegisterModuleDesc(map[string]ModuleDesc{
+		"mod-app":    {Loader: loader, Deps: []string{"mod-secret"}},
+		"mod-secret": {Loader: loader},
+	})
+	err := vm.Eval(`Import({"mod-app"})`)
+	if err == nil || !strings.Contains(err.Error(), "module:mod-secret") {
+		t.Fatalf("dependency should be checked, got %v", err)
+	}
+}
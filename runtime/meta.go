@@ -0,0 +1,137 @@
+package runtime
+
+import (
+	"fmt"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// loadMeta returns the loader of cushion-meta, which is used to introspect modules and globals of vm
+func loadMeta(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		return LuaModuleLoader(lvm, LuaFuncs{
+			"Clusters": metaClusters(vm),
+			"Modules":  metaModules(vm),
+			"Loaded":   metaLoaded,
+			"Exports":  metaExports(vm),
+			"Globals":  metaGlobals,
+		})
+	}
+}
+
+// metaClusters returns the table which maps cluster to its mids
+func metaClusters(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		tbl := lvm.NewTable()
+		for cluster, mids := range vm.mat.Clusters() {
+			tbl.RawSetString(cluster, strSlice2Table(mids))
+		}
+		lvm.Push(tbl)
+		return 1
+	}
+}
+
+// metaModules returns the list of module info sorted by name,
+// and only modules of cluster are listed when cluster is specified.
+func metaModules(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		var mids []string
+		if cluster := lvm.OptString(1, ""); len(cluster) > 0 {
+			for mid := range vm.mat.MCB(cluster) {
+				mids = append(mids, mid)
+			}
+			sort.Strings(mids)
+		} else {
+			mids = vm.mat.Mids()
+		}
+		tbl := lvm.NewTable()
+		for _, mid := range mids {
+			mcb := vm.mat.MCB(mid)[mid]
+			info := lvm.NewTable()
+			info.RawSetString("name", lua.LString(mid))
+			info.RawSetString("version", lua.LString(mcb.Version()))
+			info.RawSetString("deps", strSlice2Table(mcb.Deps()))
+			info.RawSetString("used", lua.LBool(mcb.Used()))
+			info.RawSetString("loaded", lua.LBool(metaLoadedModule(lvm, mid) != lua.LNil))
+			tbl.Append(info)
+		}
+		lvm.Push(tbl)
+		return 1
+	}
+}
+
+func metaLoaded(lvm *lua.LState) int {
+	lvm.Push(lua.LBool(metaLoadedModule(lvm, lvm.CheckString(1)) != lua.LNil))
+	return 1
+}
+
+// metaExports returns sorted names of functions exported by module.
+// Module isn't required when it isn't loaded, and its loader is called by a temporary state
+// so that module of vm isn't loaded bypassing Import. Sandbox still requires module to be declared.
+func metaExports(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		mid := lvm.CheckString(1)
+		mod := metaLoadedModule(lvm, mid)
+		if mod == lua.LNil {
+			mcb, ok := vm.mat.MCB(mid)[mid]
+			if !ok {
+				raiseError(lvm, fmt.Errorf("module %s isn't registered", mid))
+			}
+			if vm.sandbox != nil {
+				if err := vm.sandbox.checkImport(mid, mid); err != nil {
+					raiseError(lvm, err)
+				}
+			}
+			var err error
+			if mod, err = metaTempModule(vm, mid, mcb.Fun()); err != nil {
+				raiseError(lvm, err)
+			}
+		}
+		names := []string{}
+		if tbl, ok := mod.(*lua.LTable); ok {
+			tbl.ForEach(func(k, v lua.LValue) {
+				if v.Type() == lua.LTFunction {
+					names = append(names, k.String())
+				}
+			})
+		}
+		sort.Strings(names)
+		lvm.Push(strSlice2Table(names))
+		return 1
+	}
+}
+
+// metaTempModule calls loader by a temporary state with the same libraries of vm, and returns the module
+func metaTempModule(vm *LuaVM, mid string, loader lua.LGFunction) (lua.LValue, error) {
+	state := lua.NewState(lua.Options{SkipOpenLibs: vm.sandbox != nil})
+	defer state.Close()
+	if vm.sandbox != nil {
+		openSandboxLibs(state, vm.sandbox)
+	}
+	if err := state.CallByParam(lua.P{
+		Fn:      state.NewFunction(loader),
+		NRet:    1,
+		Protect: true,
+	}, lua.LString(mid)); err != nil {
+		return nil, err
+	}
+	return state.Get(-1), nil
+}
+
+// metaGlobals returns the table which maps global name to its type
+func metaGlobals(lvm *lua.LState) int {
+	tbl := lvm.NewTable()
+	lvm.G.Global.ForEach(func(k, v lua.LValue) {
+		tbl.RawSet(k, lua.LString(v.Type().String()))
+	})
+	lvm.Push(tbl)
+	return 1
+}
+
+func metaLoadedModule(lvm *lua.LState, mid string) lua.LValue {
+	if loaded, ok := lvm.GetField(lvm.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+		return loaded.RawGetString(mid)
+	}
+	return lua.LNil
+}
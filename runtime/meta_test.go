@@ -0,0 +1,49 @@
+package runtime
+
+import "testing"
+
+func TestMeta(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	err := vm.Eval(`
+Import({"cushion-meta", "cushion-path"})
+local meta = require("cushion-meta")
+local path = require("cushion-path")
+local clusters = meta.Clusters()
+assert(#clusters["cushion"] > 0)
+local found = false
+for _, mod in ipairs(meta.Modules("cushion")) do
+	if mod.name == "cushion-path" then
+		assert(mod.used and mod.loaded)
+		found = true
+	elseif mod.name == "cushion-io" then
+		assert(not mod.used and not mod.loaded)
+	end
+end
+assert(found)
+assert(meta.Loaded("cushion-meta") and not meta.Loaded("cushion-io"))
+local exports = table.concat(meta.Exports("cushion-strings"), ",")
+assert(exports == "Contains,Cut,HasPrefix,HasSuffix,Split", exports)
+assert(not meta.Loaded("cushion-strings") and package.loaded["cushion-strings"] == nil)
+local globals = meta.Globals()
+assert(globals["Import"] == "function" and globals["_G"] == "table")
+assert(not pcall(meta.Exports, "cushion-none"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaSandbox(t *testing.T) {
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Sandbox: &Capabilities{
+		Libs:    []string{"base", "string"},
+		Modules: []string{"cushion-meta", "cushion-strings"},
+	}}).Default()
+	err := vm.Eval(`
+Import({"cushion-meta"})
+local meta = require("cushion-meta")
+assert(#meta.Exports("cushion-strings") > 0)
+local ok, err = pcall(meta.Exports, "cushion-io")
+assert(not ok and string.find(err, "module:cushion-io", 1, true), err)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,203 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const metaTableTypeName = "cushion-meta-table.table"
+
+// loadMetaTable wraps MetaTable of platform, which is regedit on windows and plist on others.
+//
+//	local mt = require("cushion-meta-table")
+//	local app = mt.Create("LOCAL_MACHINE/SOFTWARE/cushion")
+//	app:SetValue({ version = "1.0.0", paths = { "bin", "lib" } })
+//	app:CreateSubTable("plugins"):SetValue({ enabled = true })
+//	app:Write()
+//	app:Close()
+func loadMetaTable(lvm *lua.LState) int {
+	return LuaModuleLoader(lvm, LuaFuncs{
+		"Create": metaTableOpen(utils.CreateMetaTable),
+		"Open":   metaTableOpen(utils.OpenMetaTable),
+	})
+}
+
+// metaTableOpen returns the function to create or open MetaTable by path
+func metaTableOpen(open func(string) (utils.MetaTable, error)) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		tbl, err := open(lvm.CheckString(1))
+		if err != nil {
+			raiseError(lvm, err)
+		}
+		lvm.Push(metaTableValue(lvm, tbl))
+		return 1
+	}
+}
+
+func metaTableValue(lvm *lua.LState, tbl utils.MetaTable) *lua.LUserData {
+	ud := lvm.NewUserData()
+	ud.Value = tbl
+	meta, ok := lvm.GetTypeMetatable(metaTableTypeName).(*lua.LTable)
+	if !ok {
+		meta = lvm.NewTypeMetatable(metaTableTypeName)
+		meta.RawSetString("__index", lvm.SetFuncs(lvm.NewTable(), LuaFuncs{
+			"GetValue":       metaTableGetValue,
+			"SetValue":       metaTableSetValue(false),
+			"SafeSetValue":   metaTableSetValue(true),
+			"CreateSubTable": metaTableCreateSubTable,
+			"Write":          metaTableWrite,
+			"Backup":         metaTableBackup,
+			"Close":          metaTableClose,
+		}))
+	}
+	lvm.SetMetatable(ud, meta)
+	return ud
+}
+
+func checkMetaTable(lvm *lua.LState, n int) utils.MetaTable {
+	if ud, ok := lvm.Get(n).(*lua.LUserData); ok {
+		if tbl, ok := ud.Value.(utils.MetaTable); ok {
+			return tbl
+		}
+	}
+	lvm.ArgError(n, "meta table expected")
+	return nil
+}
+
+// metaTableGetValue returns value of key, and it's nil when key isn't exist
+func metaTableGetValue(lvm *lua.LState) int {
+	lvm.Push(metaValueToLua(lvm, checkMetaTable(lvm, 1).GetValue(lvm.CheckString(2))))
+	return 1
+}
+
+// metaTableSetValue sets value of table, and entries of table are merged into MetaTable.
+// The safe version only sets keys which aren't exist.
+func metaTableSetValue(safe bool) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		tbl := checkMetaTable(lvm, 1)
+		v := metaValueFromLua(lvm.CheckAny(2), true)
+		if safe {
+			tbl.SafeSetValue(v)
+		} else {
+			tbl.SetValue(v)
+		}
+		return 0
+	}
+}
+
+// metaTableCreateSubTable creates or opens sub table by name
+func metaTableCreateSubTable(lvm *lua.LState) int {
+	lvm.Push(metaTableValue(lvm, checkMetaTable(lvm, 1).CreateSubTable(lvm.CheckString(2))))
+	return 1
+}
+
+// metaTableWrite persists MetaTable, which is required for plist
+func metaTableWrite(lvm *lua.LState) int {
+	if err := checkMetaTable(lvm, 1).Write(); err != nil {
+		raiseError(lvm, err)
+	}
+	return 0
+}
+
+func metaTableBackup(lvm *lua.LState) int {
+	if err := checkMetaTable(lvm, 1).Backup(); err != nil {
+		raiseError(lvm, err)
+	}
+	return 0
+}
+
+func metaTableClose(lvm *lua.LState) int {
+	checkMetaTable(lvm, 1).Close()
+	return 0
+}
+
+// metaValueFromLua converts lua value into MetaValue. Integral number is converted into int,
+// and array of strings is converted into []string, which is required by regedit.
+// The top table is MetaMap or MetaArr.
+func metaValueFromLua(lv lua.LValue, top bool) utils.MetaValue {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		if float64(v) == float64(int(v)) {
+			return int(v)
+		}
+		return float64(v)
+	case *lua.LTable:
+		if n := v.Len(); n > 0 && isArray(v, n) {
+			strs, arr := make([]string, 0, n), make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				item := v.RawGetInt(i)
+				if s, ok := item.(lua.LString); ok && len(strs) == len(arr) {
+					strs = append(strs, string(s))
+				}
+				arr = append(arr, metaValueFromLua(item, false))
+			}
+			if len(strs) == n {
+				return strs
+			}
+			if top {
+				return utils.MetaArr(arr)
+			}
+			return arr
+		}
+		dict := make(map[string]any)
+		v.ForEach(func(k, v lua.LValue) {
+			dict[k.String()] = metaValueFromLua(v, false)
+		})
+		if top {
+			return utils.MetaMap(dict)
+		}
+		return dict
+	}
+	return nil
+}
+
+// metaValueToLua converts value of plist or regedit into lua value
+func metaValueToLua(lvm *lua.LState, v utils.MetaValue) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case []string:
+		return strSlice2Table(v)
+	case []any:
+		tbl := lvm.CreateTable(len(v), 0)
+		for _, item := range v {
+			tbl.Append(metaValueToLua(lvm, item))
+		}
+		return tbl
+	case utils.MetaArr:
+		return metaValueToLua(lvm, []any(v))
+	case map[string]any:
+		tbl := lvm.CreateTable(0, len(v))
+		for k, item := range v {
+			tbl.RawSetString(k, metaValueToLua(lvm, item))
+		}
+		return tbl
+	case utils.MetaMap:
+		return metaValueToLua(lvm, map[string]any(v))
+	case interface{ ToString() string }:
+		// value of regedit
+		return lua.LString(v.ToString())
+	}
+	return lua.LString(fmt.Sprint(v))
+}
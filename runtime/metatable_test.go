@@ -0,0 +1,39 @@
+package runtime
+
+import (
+	"runtime"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestMetaTable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("meta table is regedit")
+	}
+	vm := NewVirtualMachine().Default()
+	vm.SetGlobalVar("root", lua.LString(t.TempDir()))
+	err := vm.Eval(`
+Import({"cushion-meta-table"})
+local mt = require("cushion-meta-table")
+local app = mt.Create(root .. "/app")
+app:SetValue({ version = "1.0.0", paths = { "bin", "lib" }, port = 8080 })
+app:SafeSetValue({ version = "2.0.0", name = "cushion" })
+app:CreateSubTable("plugins"):SetValue({ enabled = true })
+app:Write()
+app:Close()
+
+app = mt.Open(root .. "/app.plist")
+assert(app:GetValue("version") == "1.0.0")
+assert(app:GetValue("name") == "cushion")
+assert(app:GetValue("port") == 8080)
+assert(app:GetValue("paths")[2] == "lib")
+assert(app:GetValue("plugins").enabled == true)
+assert(app:GetValue("unknown") == nil)
+assert(app:CreateSubTable("plugins"):GetValue("enabled") == true)
+app:Close()
+assert(not pcall(mt.Open, root .. "/not-found"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
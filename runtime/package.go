@@ -0,0 +1,233 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ansurfen/cushion/utils"
+	"github.com/spf13/viper"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// PackageManifest is the name of manifest which is located in the root of package
+const PackageManifest = "package.yaml"
+
+// LuaPackage is the lua package loaded from directory or zip, which is declared by PackageManifest.
+//
+//	name: pkg
+//	version: 1.0.0
+//	entry: init.lua
+//	deps:
+//	  other-pkg: 1.2+
+//	modules: [cushion-path, cushion-strings]
+type LuaPackage struct {
+	Name    string `mapstructure:"name"`
+	Version string `mapstructure:"version"`
+	// Entry is the script to be executed when package is required, it defaults to init.lua
+	Entry string `mapstructure:"entry"`
+	// Deps maps the name of package to version constraint, which is checked by utils.CheckedVersion
+	Deps map[string]string `mapstructure:"deps"`
+	// Modules is the cushion mids or clusters which package requires
+	Modules []string `mapstructure:"modules"`
+	// Source is the path of directory or zip
+	Source string `mapstructure:"-"`
+	files  map[string][]byte
+}
+
+// LoadPackage reads package from directory or zip, and registers it into MAT,
+// so that it's able to be imported by Import{"name"} and required by require("name").
+// Other scripts of package could be required by name.dir.file.
+func (vm *LuaVM) LoadPackage(src string) (*LuaPackage, error) {
+	pkg, err := ReadPackage(src)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := vm.mat.MCB(pkg.Name)[pkg.Name]; ok {
+		return nil, fmt.Errorf("package %s: %s is already registered", pkg.Name, pkg.Name)
+	}
+	deps, err := pkg.resolve(vm.mat)
+	if err != nil {
+		return nil, err
+	}
+	vm.mat.MountDesc(map[string]ModuleDesc{
+		pkg.Name: {
+			Version: pkg.Version,
+			Deps:    deps,
+			Loader:  pkg.loader(),
+		},
+	})
+	vm.reload.trackPackage(pkg)
+	return pkg, nil
+}
+
+// ReadPackage reads manifest and scripts of package from directory or zip.
+// Zip is read in memory without extracting, and package could be located
+// in the root or the only top directory of zip.
+func ReadPackage(src string) (*LuaPackage, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	var fsys fs.FS
+	if info.IsDir() {
+		fsys = os.DirFS(src)
+	} else {
+		reader, err := utils.OpenZip(src)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		fsys = reader
+		if _, err := fs.Stat(fsys, PackageManifest); err != nil {
+			matches, _ := fs.Glob(fsys, "*/"+PackageManifest)
+			if len(matches) != 1 {
+				return nil, fmt.Errorf("package %s: %s not found", src, PackageManifest)
+			}
+			if fsys, err = fs.Sub(fsys, path.Dir(matches[0])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	raw, err := fs.ReadFile(fsys, PackageManifest)
+	if err != nil {
+		return nil, fmt.Errorf("package %s: %s", src, err)
+	}
+	conf := viper.New()
+	conf.SetConfigType("yaml")
+	if err := conf.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("package %s: %s", src, err)
+	}
+	pkg := &LuaPackage{Source: src, files: make(map[string][]byte)}
+	if err := conf.Unmarshal(pkg); err != nil {
+		return nil, fmt.Errorf("package %s: %s", src, err)
+	}
+	if len(pkg.Name) == 0 {
+		return nil, fmt.Errorf("package %s: name is required", src)
+	}
+	if len(pkg.Entry) == 0 {
+		pkg.Entry = "init.lua"
+	}
+	if len(pkg.Version) > 0 {
+		if _, err := checkedVersion(pkg.Version); err != nil {
+			return nil, fmt.Errorf("package %s: %s", pkg.Name, err)
+		}
+	}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) != ".lua" {
+			return err
+		}
+		pkg.files[name], err = fs.ReadFile(fsys, name)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("package %s: %s", pkg.Name, err)
+	}
+	if _, ok := pkg.files[path.Clean(pkg.Entry)]; !ok {
+		return nil, fmt.Errorf("package %s: entry %s not found", pkg.Name, pkg.Entry)
+	}
+	return pkg, nil
+}
+
+// Files returns sorted scripts of package
+func (pkg *LuaPackage) Files() []string {
+	files := []string{}
+	for name := range pkg.files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// resolve checks dependencies and required modules, and returns mids which package depends on
+func (pkg *LuaPackage) resolve(mat MAT) ([]string, error) {
+	deps := []string{}
+	for name, constraint := range pkg.Deps {
+		mcb, ok := mat.MCB(name)[name]
+		if !ok {
+			return nil, fmt.Errorf("package %s: dependency %s isn't loaded", pkg.Name, name)
+		}
+		want, err := checkedVersion(constraint)
+		if err != nil {
+			return nil, fmt.Errorf("package %s: dependency %s: %s", pkg.Name, name, err)
+		}
+		got, err := checkedVersion(mcb.Version())
+		if err != nil || !want.Compare(got) {
+			return nil, fmt.Errorf("package %s: dependency %s %s doesn't satisfy %s", pkg.Name, name, mcb.Version(), constraint)
+		}
+		deps = append(deps, name)
+	}
+	for _, mod := range pkg.Modules {
+		mcbs := mat.MCB(mod)
+		if len(mcbs) == 0 {
+			return nil, fmt.Errorf("package %s: module %s isn't registered", pkg.Name, mod)
+		}
+		for mid := range mcbs {
+			deps = append(deps, mid)
+		}
+	}
+	sort.Strings(deps)
+	return deps, nil
+}
+
+// loader executes entry of package, and other scripts are preloaded as submodules
+func (pkg *LuaPackage) loader() lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		entry := path.Clean(pkg.Entry)
+		for name := range pkg.files {
+			if mod := pkg.submodule(name); name != entry && mod != pkg.Name {
+				lvm.PreloadModule(mod, pkg.fileLoader(name))
+			}
+		}
+		return pkg.fileLoader(entry)(lvm)
+	}
+}
+
+func (pkg *LuaPackage) fileLoader(name string) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		proto, err := compileChunk(pkg.files[name], filepath.ToSlash(path.Join(pkg.Source, name)))
+		if err != nil {
+			raiseError(lvm, err)
+		}
+		lvm.Push(lvm.NewFunctionFromProto(proto))
+		lvm.Push(lua.LString(pkg.Name))
+		lvm.Call(1, 1)
+		if lvm.Get(-1) == lua.LNil {
+			lvm.Pop(1)
+			lvm.Push(lua.LTrue)
+		}
+		return 1
+	}
+}
+
+// submodule returns the name of script to be required, such as pkg.dir.file for dir/file.lua,
+// and pkg.dir for dir/init.lua.
+func (pkg *LuaPackage) submodule(name string) string {
+	name = strings.TrimSuffix(name, ".lua")
+	if name == "init" || strings.HasSuffix(name, "/init") {
+		name = strings.TrimSuffix(strings.TrimSuffix(name, "init"), "/")
+	}
+	if len(name) == 0 {
+		return pkg.Name
+	}
+	return pkg.Name + "." + strings.ReplaceAll(name, "/", ".")
+}
+
+// checkedVersion parses version or constraint, and it returns error rather than panic when it's invalid
+func checkedVersion(version string) (ver *utils.CheckedVersion, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid version %q", version)
+		}
+	}()
+	if len(version) == 0 {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+	return utils.NewCheckedVersion(version), nil
+}
@@ -0,0 +1,62 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ansurfen/cushion/utils"
+)
+
+func TestLoadPackage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base/package.yaml": "name: base\nversion: 1.2.0\n",
+		"base/init.lua":     `return { greet = function(name) return "hello " .. name end }`,
+		"app/package.yaml":  "name: app\nversion: 0.1.0\nentry: main.lua\ndeps:\n  base: 1.0+\nmodules: [cushion-strings]\n",
+		"app/main.lua": `local base = require("base")
+local util = require("app.lib.util")
+local strings = require("cushion-strings")
+return { run = function() return util.upper(base.greet("app")) end, has = strings.Contains }`,
+		"app/lib/util.lua": `return { upper = string.upper }`,
+		"bad/package.yaml": "name: bad\nversion: 1.0.0\ndeps:\n  base: 2.0+\n",
+		"bad/init.lua":     `return {}`,
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := utils.Zip(filepath.Join(dir, "app.zip"), filepath.Join(dir, "app")); err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVirtualMachine().Default()
+	if _, err := vm.LoadPackage(filepath.Join(dir, "app.zip")); err == nil || !strings.Contains(err.Error(), "base isn't loaded") {
+		t.Fatal(err)
+	}
+	if _, err := vm.LoadPackage(filepath.Join(dir, "base")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.LoadPackage(filepath.Join(dir, "bad")); err == nil || !strings.Contains(err.Error(), "doesn't satisfy 2.0+") {
+		t.Fatal(err)
+	}
+	pkg, err := vm.LoadPackage(filepath.Join(dir, "app.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(pkg.Files(), ",") != "lib/util.lua,main.lua" {
+		t.Fatal(pkg.Files())
+	}
+	err = vm.Eval(`Import({"app"})
+local app = require("app")
+assert(app.run() == "HELLO APP")
+assert(app.has("app", "p"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,321 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var ErrPoolClosed = errors.New("vm pool closed")
+
+// VirtualMachinePool is an interface to abstract a set of pre-warmed virtual machine,
+// which could be shared by different goroutines.
+type VirtualMachinePool interface {
+	// Acquire to take an idle vm from pool, it'll block until vm is available or ctx is done
+	Acquire(context.Context) (VirtualMachine, error)
+	// Release to reset vm and give it back to pool, and vm which isn't acquired is ignored
+	Release(VirtualMachine)
+	// Do to acquire vm, execute callback and release it
+	Do(context.Context, func(VirtualMachine) error) error
+	// Stats returns the current usage of pool
+	Stats() PoolStats
+	// Close to free all vm of pool
+	Close()
+}
+
+var _ VirtualMachinePool = &LuaVMPool{}
+
+type PoolOpt struct {
+	// Size is the number of vm to be pre-warmed, it defaults to 1
+	Size int
+	// Setup will be called once for every vm after Default(),
+	// which is used to SetGlobalFn, RegisterModule and so on.
+	Setup func(VirtualMachine)
+}
+
+type PoolStats struct {
+	Size     int
+	Idle     int
+	InUse    int
+	Acquires uint64
+	Releases uint64
+	// Waits is the count of Acquire which has to wait for idle vm
+	Waits    uint64
+	WaitTime time.Duration
+}
+
+// LuaVMPool pre-warms LuaVM with the same setup, and resets the state changed by request
+// when vm is released, such as globals, loaded modules, exports, event handlers and async tasks.
+type LuaVMPool struct {
+	idle      chan *LuaVM
+	snapshots map[*LuaVM]*vmSnapshot
+	// inUse records vm checked out by Acquire, so that vm couldn't be released twice
+	inUse  map[*LuaVM]bool
+	stats  PoolStats
+	mutex  sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func NewLuaVMPool(opt PoolOpt) *LuaVMPool {
+	if opt.Size <= 0 {
+		opt.Size = 1
+	}
+	pool := &LuaVMPool{
+		idle:      make(chan *LuaVM, opt.Size),
+		snapshots: make(map[*LuaVM]*vmSnapshot),
+		inUse:     make(map[*LuaVM]bool),
+		stats:     PoolStats{Size: opt.Size},
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < opt.Size; i++ {
+		vm := NewVirtualMachine().Default()
+		if opt.Setup != nil {
+			opt.Setup(vm)
+		}
+		lvm := vm.(*LuaVM)
+		pool.snapshots[lvm] = lvm.snapshot()
+		pool.idle <- lvm
+	}
+	return pool
+}
+
+// Acquire to take an idle vm from pool, it'll block until vm is available or ctx is done
+func (pool *LuaVMPool) Acquire(ctx context.Context) (VirtualMachine, error) {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return nil, ErrPoolClosed
+	}
+	pool.mutex.Unlock()
+	var vm *LuaVM
+	select {
+	case vm = <-pool.idle:
+	default:
+		start := time.Now()
+		select {
+		case vm = <-pool.idle:
+		case <-pool.done:
+			return nil, ErrPoolClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		pool.mutex.Lock()
+		pool.stats.Waits++
+		pool.stats.WaitTime += time.Since(start)
+		pool.mutex.Unlock()
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed {
+		vm.state.Close()
+		return nil, ErrPoolClosed
+	}
+	pool.inUse[vm] = true
+	pool.stats.Acquires++
+	return vm, nil
+}
+
+// Release to reset vm and give it back to pool,
+// and vm which isn't acquired from pool or has been released is ignored.
+func (pool *LuaVMPool) Release(vm VirtualMachine) {
+	lvm, ok := vm.(*LuaVM)
+	if !ok {
+		return
+	}
+	pool.mutex.Lock()
+	if !pool.inUse[lvm] {
+		pool.mutex.Unlock()
+		return
+	}
+	delete(pool.inUse, lvm)
+	pool.stats.Releases++
+	closed := pool.closed
+	pool.mutex.Unlock()
+	if closed {
+		lvm.state.Close()
+		return
+	}
+	lvm.restore(pool.snapshots[lvm])
+	// it never blocks because vm in idle is less than size
+	pool.idle <- lvm
+	// vm is freed by Close or here if pool is closed during release
+	select {
+	case <-pool.done:
+		pool.drain()
+	default:
+	}
+}
+
+// Do to acquire vm, execute callback and release it
+func (pool *LuaVMPool) Do(ctx context.Context, fn func(VirtualMachine) error) error {
+	vm, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Release(vm)
+	return fn(vm)
+}
+
+// Stats returns the current usage of pool
+func (pool *LuaVMPool) Stats() PoolStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	stats := pool.stats
+	stats.Idle = len(pool.idle)
+	stats.InUse = len(pool.inUse)
+	return stats
+}
+
+// Close to free all vm of pool. The vm in use will be freed when it's released.
+func (pool *LuaVMPool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	close(pool.done)
+	pool.drain()
+}
+
+// drain to free idle vm
+func (pool *LuaVMPool) drain() {
+	for {
+		select {
+		case vm := <-pool.idle:
+			vm.state.Close()
+		default:
+			return
+		}
+	}
+}
+
+// vmSnapshot records the state of vm after setup, which is restored when vm is released
+type vmSnapshot struct {
+	globals map[string]lua.LValue
+	loaded  map[lua.LValue]lua.LValue
+	preload map[lua.LValue]lua.LValue
+	// used records mids imported and loaded by setup
+	used         map[string]bool
+	loadedMCB    map[string]bool
+	exportNames  []string
+	exportValues map[string]any
+	events       *eventBus
+}
+
+// snapshot returns the state of vm to be restored
+func (vm *LuaVM) snapshot() *vmSnapshot {
+	s := &vmSnapshot{
+		globals:   snapshotGlobals(vm.state),
+		loaded:    snapshotTable(vm.packageTable("loaded")),
+		preload:   snapshotTable(vm.packageTable("preload")),
+		used:      make(map[string]bool),
+		loadedMCB: make(map[string]bool),
+		events:    vm.events.clone(),
+	}
+	for _, mid := range vm.mat.Mids() {
+		mcb := vm.mat.MCB(mid)[mid]
+		s.used[mid], s.loadedMCB[mid] = mcb.used, mcb.loaded
+	}
+	s.exportNames, s.exportValues = vm.exports.snapshot()
+	return s
+}
+
+// restore to reset vm into snapshot, and tasks and timers of async loop are cancelled
+func (vm *LuaVM) restore(s *vmSnapshot) {
+	vm.state.SetTop(0)
+	vm.loop.stop()
+	vm.loop = newEventLoop(vm)
+	vm.events = s.events.clone()
+	vm.exports.restore(s.exportNames, s.exportValues)
+	for _, mid := range vm.mat.Mids() {
+		mcb := vm.mat.MCB(mid)[mid]
+		mcb.used, mcb.loaded = s.used[mid], s.loadedMCB[mid]
+	}
+	restoreTable(vm.packageTable("loaded"), s.loaded)
+	restoreTable(vm.packageTable("preload"), s.preload)
+	restoreGlobals(vm.state, s.globals)
+}
+
+// packageTable returns the field of package, such as loaded and preload.
+// The loaded table is taken from registry because require uses it.
+func (vm *LuaVM) packageTable(name string) *lua.LTable {
+	if name == "loaded" {
+		if tbl, ok := vm.state.GetField(vm.state.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+			return tbl
+		}
+	}
+	if pkg, ok := vm.state.GetGlobal(lua.LoadLibName).(*lua.LTable); ok {
+		if tbl, ok := pkg.RawGetString(name).(*lua.LTable); ok {
+			return tbl
+		}
+	}
+	return nil
+}
+
+func snapshotTable(tbl *lua.LTable) map[lua.LValue]lua.LValue {
+	snapshot := make(map[lua.LValue]lua.LValue)
+	if tbl != nil {
+		tbl.ForEach(func(k, v lua.LValue) {
+			snapshot[k] = v
+		})
+	}
+	return snapshot
+}
+
+// restoreTable to remove fields which aren't in snapshot and recover the overwritten
+func restoreTable(tbl *lua.LTable, snapshot map[lua.LValue]lua.LValue) {
+	if tbl == nil {
+		return
+	}
+	dirty := []lua.LValue{}
+	tbl.ForEach(func(k, v lua.LValue) {
+		if old, ok := snapshot[k]; !ok || old != v {
+			dirty = append(dirty, k)
+		}
+	})
+	for _, k := range dirty {
+		tbl.RawSet(k, lua.LNil)
+	}
+	for k, v := range snapshot {
+		if tbl.RawGet(k) != v {
+			tbl.RawSet(k, v)
+		}
+	}
+}
+
+func snapshotGlobals(state *LuaInterp) map[string]lua.LValue {
+	globals := make(map[string]lua.LValue)
+	state.G.Global.ForEach(func(k, v lua.LValue) {
+		if name, ok := k.(lua.LString); ok {
+			globals[string(name)] = v
+		}
+	})
+	return globals
+}
+
+// restoreGlobals to remove globals which are created by request and recover the overwritten.
+func restoreGlobals(state *LuaInterp, globals map[string]lua.LValue) {
+	dirty := []string{}
+	state.G.Global.ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok {
+			return
+		}
+		if old, ok := globals[string(name)]; !ok || old != v {
+			dirty = append(dirty, string(name))
+		}
+	})
+	for _, name := range dirty {
+		state.SetGlobal(name, lua.LNil)
+	}
+	for name, v := range globals {
+		if state.GetGlobal(name) != v {
+			state.SetGlobal(name, v)
+		}
+	}
+}
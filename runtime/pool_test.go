@@ -0,0 +1,120 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLuaVMPool(t *testing.T) {
+	pool := NewLuaVMPool(PoolOpt{
+		Size: 4,
+		Setup: func(vm VirtualMachine) {
+			vm.SetGlobalFn(LuaFuncs{
+				"Hello": func(l *lua.LState) int {
+					l.Push(lua.LString("Hello " + l.CheckString(1)))
+					return 1
+				},
+			})
+		},
+	})
+	defer pool.Close()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := pool.Do(context.Background(), func(vm VirtualMachine) error {
+				if vm.GetGlobalVar("request") != lua.LNil {
+					return fmt.Errorf("global of last request isn't reset")
+				}
+				return vm.Eval(fmt.Sprintf(`request = Hello("%d")`, i))
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats := pool.Stats()
+	if stats.Acquires != 16 || stats.Idle != 4 || stats.InUse != 0 {
+		t.Fatal(stats)
+	}
+	fmt.Printf("%+v\n", stats)
+}
+
+func TestLuaVMPoolRelease(t *testing.T) {
+	pool := NewLuaVMPool(PoolOpt{Size: 1})
+	vm, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(vm)
+	pool.Release(vm)
+	pool.Release(NewVirtualMachine().Default())
+	if stats := pool.Stats(); stats.Releases != 1 || stats.Idle != 1 || stats.InUse != 0 {
+		t.Fatal(stats)
+	}
+	vm, _ = pool.Acquire(context.Background())
+	acquired := make(chan error)
+	go func() {
+		_, err := pool.Acquire(context.Background())
+		acquired <- err
+	}()
+	pool.Close()
+	if err := <-acquired; !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("want ErrPoolClosed, got %v", err)
+	}
+	pool.Release(vm)
+	if stats := pool.Stats(); stats.Idle != 0 || stats.InUse != 0 {
+		t.Fatal(stats)
+	}
+}
+
+func TestLuaVMPoolReset(t *testing.T) {
+	pool := NewLuaVMPool(PoolOpt{
+		Size: 1,
+		Setup: func(vm VirtualMachine) {
+			vm.Eval(`Import({"cushion-vm"}) require("cushion-vm").Export("setup", true)`)
+		},
+	})
+	defer pool.Close()
+	vm, _ := pool.Acquire(context.Background())
+	err := vm.Eval(`
+Import({"cushion-event", "cushion-async", "cushion-strings"})
+local event, async, vm = require("cushion-event"), require("cushion-async"), require("cushion-vm")
+require("cushion-strings")
+event.on("deploy", function() end)
+vm.Export("request", 1)
+async.set_timeout(function() leaked = true end, 10)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Release(vm)
+	vm, _ = pool.Acquire(context.Background())
+	defer pool.Release(vm)
+	if names := vm.Exports().Names(); len(names) != 1 || names[0] != "setup" {
+		t.Fatalf("exports aren't reset: %v", names)
+	}
+	if ev, err := vm.Emit(context.Background(), "deploy", nil); err != nil || ev.Handled != 0 {
+		t.Fatalf("handlers aren't reset: %v %v", ev, err)
+	}
+	if err := vm.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	err = vm.Eval(`
+assert(leaked == nil)
+assert(package.loaded["cushion-strings"] == nil and package.preload["cushion-strings"] == nil)
+assert(package.loaded["cushion-vm"] ~= nil)
+assert(not pcall(require, "cushion-strings"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.(*LuaVM).mat.MCB("cushion-strings")["cushion-strings"].Used() {
+		t.Fatal("used flag isn't reset")
+	}
+}
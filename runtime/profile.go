@@ -0,0 +1,261 @@
+package runtime
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ProfileOpt is the option of Profiler
+type ProfileOpt struct {
+	// Interval is the period of sampling, it defaults to 10ms
+	Interval time.Duration
+}
+
+// Profiler samples the lua call stack of vm at interval, and it's passed to vm by LuaVMOpt.Profiler.
+// Time spent in go builtins (such as cushion-io.Exec) is attributed to the frame named [G] name,
+// which is called by the lua line. The profile is written in pprof format, so that
+// `go tool pprof` is able to show flame graph labeled with lua function names and source lines.
+//
+// Note that the samples are taken when vm executes next instruction, so that
+// the sampling is only active when vm is running.
+type Profiler struct {
+	opt     ProfileOpt
+	ticks   atomic.Int64
+	stop    chan struct{}
+	start   time.Time
+	elapsed time.Duration
+
+	mutex   sync.Mutex
+	samples map[string]*profileSample
+
+	// last is only accessed by the goroutine of vm
+	last int64
+}
+
+type profileSample struct {
+	frames []profileFrame
+	count  int64
+}
+
+// profileFrame is the frame of call stack, and go builtin's file is [G]
+type profileFrame struct {
+	name      string
+	file      string
+	startLine int
+	line      int
+}
+
+var _ vmHook = &Profiler{}
+
+func NewProfiler(opt ProfileOpt) *Profiler {
+	if opt.Interval <= 0 {
+		opt.Interval = 10 * time.Millisecond
+	}
+	return &Profiler{
+		opt:     opt,
+		samples: make(map[string]*profileSample),
+	}
+}
+
+// Start to sample until Stop is called
+func (p *Profiler) Start() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.start = time.Now()
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(p.opt.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.ticks.Add(1)
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop)
+}
+
+// Stop to pause sampling, and samples are kept until Reset is called
+func (p *Profiler) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.stop = nil
+	p.elapsed += time.Since(p.start)
+}
+
+// Reset to clear samples
+func (p *Profiler) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.samples = make(map[string]*profileSample)
+	p.elapsed = 0
+	p.start = time.Now()
+}
+
+func (p *Profiler) begin() {
+	p.last = p.ticks.Load()
+}
+
+func (p *Profiler) step(state *lua.LState) error {
+	ticks := p.ticks.Load()
+	if ticks == p.last {
+		return nil
+	}
+	n := ticks - p.last
+	p.last = ticks
+	frames := profileStack(state)
+	if len(frames) == 0 {
+		return nil
+	}
+	// vm doesn't execute instruction when go builtin is running,
+	// so that the missed ticks belong to the builtin called by previous instruction.
+	if builtin := profileBuiltin(state); n > 1 && len(builtin) > 0 {
+		p.add(append([]profileFrame{{name: builtin, file: "[G]"}}, frames...), n-1)
+		n = 1
+	}
+	p.add(frames, n)
+	return nil
+}
+
+func (p *Profiler) add(frames []profileFrame, n int64) {
+	keys := make([]string, len(frames))
+	for i, f := range frames {
+		keys[i] = f.name + "\x00" + f.file + "\x00" + strconv.Itoa(f.startLine) + "\x00" + strconv.Itoa(f.line)
+	}
+	key := strings.Join(keys, "\x01")
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if sample, ok := p.samples[key]; ok {
+		sample.count += n
+		return
+	}
+	p.samples[key] = &profileSample{frames: frames, count: n}
+}
+
+// Profile returns the profile of samples in pprof format
+func (p *Profiler) Profile() *profile.Profile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	interval := p.opt.Interval.Nanoseconds()
+	elapsed := p.elapsed
+	if p.stop != nil {
+		elapsed += time.Since(p.start)
+	}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "wall", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "wall", Unit: "nanoseconds"},
+		Period:        interval,
+		TimeNanos:     p.start.UnixNano(),
+		DurationNanos: elapsed.Nanoseconds(),
+	}
+	funcs := make(map[profileFrame]*profile.Function)
+	locs := make(map[profileFrame]*profile.Location)
+	for _, sample := range p.samples {
+		s := &profile.Sample{Value: []int64{sample.count, sample.count * interval}}
+		for _, f := range sample.frames {
+			loc, ok := locs[f]
+			if !ok {
+				key := profileFrame{name: f.name, file: f.file, startLine: f.startLine}
+				fn, ok := funcs[key]
+				if !ok {
+					fn = &profile.Function{
+						ID:         uint64(len(prof.Function) + 1),
+						Name:       f.name,
+						SystemName: f.name,
+						Filename:   f.file,
+						StartLine:  int64(f.startLine),
+					}
+					funcs[key] = fn
+					prof.Function = append(prof.Function, fn)
+				}
+				loc = &profile.Location{
+					ID:   uint64(len(prof.Location) + 1),
+					Line: []profile.Line{{Function: fn, Line: int64(f.line)}},
+				}
+				locs[f] = loc
+				prof.Location = append(prof.Location, loc)
+			}
+			s.Location = append(s.Location, loc)
+		}
+		prof.Sample = append(prof.Sample, s)
+	}
+	return prof
+}
+
+// Write to write gzipped pprof profile
+func (p *Profiler) Write(w io.Writer) error {
+	return p.Profile().Write(w)
+}
+
+// profileStack returns the call stack from current frame to the bottom
+func profileStack(state *lua.LState) []profileFrame {
+	frames := []profileFrame{}
+	for level := 0; ; level++ {
+		dbg, ok := state.GetStack(level)
+		if !ok {
+			break
+		}
+		if _, err := state.GetInfo("nSl", dbg, lua.LNil); err != nil {
+			break
+		}
+		f := profileFrame{name: dbg.Name, file: dbg.Source, startLine: dbg.LineDefined, line: dbg.CurrentLine}
+		switch {
+		case dbg.What == "G":
+			f.file, f.line = "[G]", 0
+		case dbg.What == "main":
+			f.name = "main chunk"
+		}
+		if len(f.name) == 0 {
+			f.name = "?"
+		}
+		if f.file == "[G]" {
+			f.name = "[G] " + f.name
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// profileBuiltin returns the name of function called by previous instruction of current frame
+func profileBuiltin(state *lua.LState) string {
+	dbg, ok := state.GetStack(0)
+	if !ok {
+		return ""
+	}
+	fn, _ := state.GetInfo("f", dbg, lua.LNil)
+	lfn, ok := fn.(*lua.LFunction)
+	if !ok || lfn.IsG {
+		return ""
+	}
+	// Pc points to the next instruction of running one
+	pc := debugFrameField(dbg, "Pc") - 2
+	if pc < 0 || int(lfn.Proto.Code[pc]>>26) != lua.OP_CALL {
+		return ""
+	}
+	for _, call := range lfn.Proto.DbgCalls {
+		if call.Pc == pc {
+			return "[G] " + call.Name
+		}
+	}
+	return "[G] ?"
+}
@@ -0,0 +1,61 @@
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestProfiler(t *testing.T) {
+	profiler := NewProfiler(ProfileOpt{Interval: time.Millisecond})
+	vm := NewVirtualMachineWithOpt(LuaVMOpt{Profiler: profiler}).Default()
+	vm.SetGlobalFn(LuaFuncs{
+		"sleep": func(l *lua.LState) int {
+			time.Sleep(time.Duration(l.CheckInt(1)) * time.Millisecond)
+			return 0
+		},
+	})
+	profiler.Start()
+	err := vm.Eval(`
+local function busy()
+	local n = 0
+	local deadline = os.clock() + 0.05
+	while os.clock() < deadline do
+		n = n + 1
+	end
+	return n
+end
+busy()
+sleep(50)`)
+	profiler.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := profiler.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := profile.Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{}
+	for _, sample := range prof.Sample {
+		leaf := sample.Location[0].Line[0]
+		counts[leaf.Function.Name] += sample.Value[0]
+		if leaf.Function.Name == "busy" && (leaf.Line < 3 || leaf.Line > 8) {
+			t.Errorf("unexpected line of busy: %d", leaf.Line)
+		}
+	}
+	if counts["busy"] == 0 || counts["[G] sleep"] == 0 {
+		t.Fatal(counts)
+	}
+	if !strings.Contains(prof.String(), "main chunk") {
+		t.Fatal(prof.String())
+	}
+}
@@ -0,0 +1,439 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+
+	"github.com/ansurfen/cushion/utils"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SandboxManifest is the name of capabilities manifest which is located next to script
+const SandboxManifest = "sandbox.yaml"
+
+// Capabilities declares what a sandboxed virtual machine is able to do.
+// Anything not be declared is denied.
+type Capabilities struct {
+	// Libs is the lua base libraries to be opened: base, package, table, string, math, os, io, debug, channel, coroutine.
+	// Note that the package library is always opened to support Import, but it only could require file when package is declared.
+	Libs []string `mapstructure:"libs"`
+	// Modules is the mids or clusters which Import is allowed to load
+	Modules []string `mapstructure:"modules"`
+	// Roots is the filesystem roots which cushion-io, cushion-path and file loaders (dofile, loadfile, EvalFile) could touch
+	Roots []string `mapstructure:"roots"`
+	// Exec allows scripts to spawn process through cushion-io.Exec and cushion-check.CheckEnv
+	Exec bool `mapstructure:"exec"`
+	// Network allows scripts to download file through cushion-io.Fetch
+	Network bool `mapstructure:"network"`
+	// Env allows scripts to modify enviroment variables through cushion-env,
+	// and meta tables (regedit on windows and plist on others) through cushion-meta-table
+	Env bool `mapstructure:"env"`
+}
+
+// LoadCapabilities reads the manifest named SandboxManifest in the directory of script,
+// and relative roots will be resolved according to the directory.
+func LoadCapabilities(script string) (*Capabilities, error) {
+	dir := filepath.Dir(script)
+	conf := utils.OpenConfFromPath(filepath.Join(dir, SandboxManifest))
+	if err := conf.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	caps := &Capabilities{}
+	if err := conf.Unmarshal(caps); err != nil {
+		return nil, err
+	}
+	for i, root := range caps.Roots {
+		if !filepath.IsAbs(root) {
+			caps.Roots[i] = filepath.Join(dir, root)
+		}
+	}
+	return caps, nil
+}
+
+// PermissionError is raised when sandboxed script calls function which is out of capabilities
+type PermissionError struct {
+	// Capability is the name of capability to be required, such as lib:os, module:cushion-io, fs:/tmp, exec and network
+	Capability string
+	// Op is the operation to be blocked
+	Op string
+}
+
+func (err *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: %s requires capability %q", err.Op, err.Capability)
+}
+
+// HasLib returns whether lua base library is declared
+func (caps *Capabilities) HasLib(lib string) bool {
+	return containStr(caps.Libs, lib)
+}
+
+// HasModule returns whether mid or cluster is declared
+func (caps *Capabilities) HasModule(mid string) bool {
+	return containStr(caps.Modules, mid)
+}
+
+// CheckPath returns PermissionError when path isn't located in any roots.
+// Symbolic links of path and roots are resolved before comparing, so that link can't escape roots.
+func (caps *Capabilities) CheckPath(op, p string) error {
+	abs, err := resolvePath(p)
+	if err != nil {
+		return err
+	}
+	for _, root := range caps.Roots {
+		root, err := resolvePath(root)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, abs); err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return nil
+		}
+	}
+	return &PermissionError{Capability: "fs:" + abs, Op: op}
+}
+
+// resolvePath returns absolute path whose symbolic links are resolved.
+// The deepest existing ancestor is resolved when path isn't created yet,
+// and path isn't cleaned before resolving because ".." after link is relative to target of link.
+func resolvePath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		p = wd + string(os.PathSeparator) + p
+	}
+	parts := strings.Split(filepath.ToSlash(p), "/")
+	for i := len(parts); i > 0; i-- {
+		prefix := strings.Join(parts[:i], string(os.PathSeparator))
+		if len(prefix) == 0 {
+			prefix = string(os.PathSeparator)
+		}
+		if real, err := filepath.EvalSymlinks(prefix); err == nil {
+			return filepath.Abs(filepath.Join(append([]string{real}, parts[i:]...)...))
+		}
+	}
+	return filepath.Abs(p)
+}
+
+var sandboxLibs = map[string]struct {
+	name string
+	fn   lua.LGFunction
+}{
+	"base":      {lua.BaseLibName, lua.OpenBase},
+	"table":     {lua.TabLibName, lua.OpenTable},
+	"io":        {lua.IoLibName, lua.OpenIo},
+	"os":        {lua.OsLibName, lua.OpenOs},
+	"string":    {lua.StringLibName, lua.OpenString},
+	"math":      {lua.MathLibName, lua.OpenMath},
+	"debug":     {lua.DebugLibName, lua.OpenDebug},
+	"channel":   {lua.ChannelLibName, lua.OpenChannel},
+	"coroutine": {lua.CoroutineLibName, lua.OpenCoroutine},
+}
+
+// openSandboxLibs only opens the libraries declared in capabilities
+func openSandboxLibs(state *LuaInterp, caps *Capabilities) {
+	openLib := func(name string, fn lua.LGFunction) {
+		state.Push(state.NewFunction(fn))
+		state.Push(lua.LString(name))
+		state.Call(1, 0)
+	}
+	openLib(lua.LoadLibName, lua.OpenPackage)
+	if !caps.HasLib("package") {
+		// only preload searcher is kept, so that require can't load file by reassigning package.path.
+		// require uses the loaders of registry, and package.loaders is a copy which could be modified by script.
+		pkg := state.GetGlobal(lua.LoadLibName)
+		preload := state.GetField(state.Get(lua.RegistryIndex), "_LOADERS").(*lua.LTable).RawGetInt(1)
+		loaders := state.NewTable()
+		loaders.Append(preload)
+		state.SetField(state.Get(lua.RegistryIndex), "_LOADERS", loaders)
+		copied := state.NewTable()
+		copied.Append(preload)
+		state.SetField(pkg, "loaders", copied)
+		state.SetField(pkg, "path", lua.LString(""))
+		state.SetField(pkg, "cpath", lua.LString(""))
+	}
+	for _, lib := range caps.Libs {
+		if l, ok := sandboxLibs[lib]; ok {
+			openLib(l.name, l.fn)
+		}
+	}
+	if caps.HasLib("base") {
+		for _, name := range []string{"dofile", "loadfile"} {
+			if fn, ok := state.GetGlobal(name).(*lua.LFunction); ok {
+				state.SetGlobal(name, state.NewFunction(guardFunc(caps, fn, fsGuard(name, 1))))
+			}
+		}
+	}
+	denySandboxLibs(state, caps)
+}
+
+// denySandboxLibs to replace undeclared libraries with stubs,
+// which raise PermissionError naming the capability when they're accessed.
+func denySandboxLibs(state *LuaInterp, caps *Capabilities) {
+	deny := func(lib string) lua.LGFunction {
+		return func(lvm *lua.LState) int {
+			op := lvm.CheckAny(2).String()
+			if lib != "base" {
+				op = lib + "." + op
+			}
+			raiseError(lvm, &PermissionError{Capability: "lib:" + lib, Op: op})
+			return 0
+		}
+	}
+	for lib, l := range sandboxLibs {
+		if caps.HasLib(lib) || lib == "base" {
+			continue
+		}
+		stub, mt := state.NewTable(), state.NewTable()
+		mt.RawSetString("__index", state.NewFunction(deny(lib)))
+		state.SetMetatable(stub, mt)
+		state.SetGlobal(l.name, stub)
+	}
+	if !caps.HasLib("base") {
+		base := lua.NewState(lua.Options{SkipOpenLibs: true})
+		defer base.Close()
+		base.Push(base.NewFunction(lua.OpenBase))
+		base.Push(lua.LString(lua.BaseLibName))
+		base.Call(1, 0)
+		names := map[string]bool{}
+		base.G.Global.ForEach(func(k, v lua.LValue) {
+			if _, ok := v.(*lua.LFunction); ok {
+				names[k.String()] = true
+			}
+		})
+		denyBase := deny("base")
+		mt := state.NewTable()
+		mt.RawSetString("__index", state.NewFunction(func(lvm *lua.LState) int {
+			if names[lvm.CheckAny(2).String()] {
+				return denyBase(lvm)
+			}
+			lvm.Push(lua.LNil)
+			return 1
+		}))
+		state.SetMetatable(state.G.Global, mt)
+	}
+}
+
+// sandboxGuard checks arguments of function before it's called
+type sandboxGuard func(*Capabilities, *lua.LState) error
+
+// fsGuard checks path at specified positions, and every string of table is checked when it's array of paths
+func fsGuard(op string, idx ...int) sandboxGuard {
+	return func(caps *Capabilities, lvm *lua.LState) error {
+		for _, i := range idx {
+			switch v := lvm.Get(i).(type) {
+			case lua.LString:
+				if err := caps.CheckPath(op, string(v)); err != nil {
+					return err
+				}
+			case *lua.LTable:
+				for j := 1; j <= v.Len(); j++ {
+					if p, ok := v.RawGetInt(j).(lua.LString); ok {
+						if err := caps.CheckPath(op, string(p)); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// fsGuards returns guards of module whose functions take paths at specified positions,
+// and temporary functions check the directory of the second argument or os.TempDir.
+func fsGuards(mid string, funcs map[string][]int, temps ...string) map[string]sandboxGuard {
+	gs := make(map[string]sandboxGuard)
+	for name, idx := range funcs {
+		gs[name] = fsGuard(mid+"."+name, idx...)
+	}
+	for _, name := range temps {
+		op := mid + "." + name
+		gs[name] = func(caps *Capabilities, lvm *lua.LState) error {
+			dir := lvm.OptString(2, "")
+			if len(dir) == 0 {
+				dir = os.TempDir()
+			}
+			return caps.CheckPath(op, dir)
+		}
+	}
+	return gs
+}
+
+// absFsGuard only checks absolute path, which is used by functions that just manipulate string
+func absFsGuard(op string, idx ...int) sandboxGuard {
+	return func(caps *Capabilities, lvm *lua.LState) error {
+		for i := 1; i <= lvm.GetTop(); i++ {
+			if len(idx) > 0 && !containInt(idx, i) {
+				continue
+			}
+			if p, ok := lvm.Get(i).(lua.LString); ok && filepath.IsAbs(string(p)) {
+				if err := caps.CheckPath(op, string(p)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func capGuard(op, capability string, granted func(*Capabilities) bool) sandboxGuard {
+	return func(caps *Capabilities, lvm *lua.LState) error {
+		if !granted(caps) {
+			return &PermissionError{Capability: capability, Op: op}
+		}
+		return nil
+	}
+}
+
+func guards(gs ...sandboxGuard) sandboxGuard {
+	return func(caps *Capabilities, lvm *lua.LState) error {
+		for _, g := range gs {
+			if err := g(caps, lvm); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var (
+	execGuard    = capGuard("exec", "exec", func(caps *Capabilities) bool { return caps.Exec })
+	networkGuard = capGuard("network", "network", func(caps *Capabilities) bool { return caps.Network })
+	envGuard     = capGuard("env", "env", func(caps *Capabilities) bool { return caps.Env })
+)
+
+// metaTableGuard requires env capability, and path of plist also is checked on others than windows,
+// whose meta table is keyed by path of regedit.
+func metaTableGuard(op string) sandboxGuard {
+	if goruntime.GOOS == "windows" {
+		return envGuard
+	}
+	return guards(envGuard, fsGuard(op, 1))
+}
+
+// sandboxGuards records which functions of cushion modules should be checked
+var sandboxGuards = map[string]map[string]sandboxGuard{
+	"cushion-io": {
+		"Fetch":  guards(networkGuard, fsGuard("cushion-io.Fetch", 2)),
+		"Unzip":  fsGuard("cushion-io.Unzip", 1, 2),
+		"Exec":   execGuard,
+		"Mkdirs": fsGuard("cushion-io.Mkdirs", 1),
+	},
+	"cushion-check": {
+		"CheckEnv": execGuard,
+	},
+	"cushion-async": {
+		"fetch": guards(networkGuard, fsGuard("cushion-async.fetch", 2)),
+		"unzip": fsGuard("cushion-async.unzip", 1, 2),
+		"exec":  execGuard,
+	},
+	"cushion-exec": {
+		"run":   execGuard,
+		"shell": execGuard,
+	},
+	"cushion-vm": {
+		"EvalFile": fsGuard("cushion-vm.EvalFile", 1),
+	},
+	"cushion-fs": fsGuards("cushion-fs", map[string][]int{
+		"read": {1}, "read_bytes": {1}, "read_lines": {1}, "write": {1}, "write_bytes": {1},
+		"safe_write": {1}, "atomic_write": {1}, "append": {1}, "exists": {1}, "stat": {1},
+		"chmod": {1}, "mkdirs": {1}, "remove": {1}, "list": {1}, "walk": {1}, "glob": {1},
+		"copy": {1, 2}, "move": {1, 2},
+	}, "temp_dir", "temp_file"),
+	"cushion-archive": fsGuards("cushion-archive", map[string][]int{
+		"extract": {1, 2}, "create": {1, 2}, "list": {1}, "detect": {1},
+	}),
+	"cushion-env": {
+		"SetPath":  envGuard,
+		"Set":      envGuard,
+		"SafeSet":  envGuard,
+		"Unset":    envGuard,
+		"SetL":     envGuard,
+		"SafeSetL": envGuard,
+		"Export":   fsGuard("cushion-env.Export", 1),
+		"Load":     guards(envGuard, fsGuard("cushion-env.Load", 1)),
+	},
+	"cushion-meta-table": {
+		"Create": metaTableGuard("cushion-meta-table.Create"),
+		"Open":   metaTableGuard("cushion-meta-table.Open"),
+	},
+	"cushion-path": {
+		"IsAbs":    absFsGuard("cushion-path.IsAbs"),
+		"Base":     absFsGuard("cushion-path.Base"),
+		"Ext":      absFsGuard("cushion-path.Ext"),
+		"Clean":    absFsGuard("cushion-path.Clean"),
+		"Dir":      absFsGuard("cushion-path.Dir"),
+		"Join":     absFsGuard("cushion-path.Join"),
+		"Split":    absFsGuard("cushion-path.Split"),
+		"Match":    absFsGuard("cushion-path.Match", 2),
+		"Filename": absFsGuard("cushion-path.Filename"),
+	},
+}
+
+func guardFunc(caps *Capabilities, fn *lua.LFunction, guard sandboxGuard) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		if err := guard(caps, lvm); err != nil {
+			raiseError(lvm, err)
+		}
+		if fn.IsG {
+			return fn.GFunction(lvm)
+		}
+		lvm.Insert(fn, 1)
+		lvm.Call(lvm.GetTop()-1, lua.MultRet)
+		return lvm.GetTop()
+	}
+}
+
+// guardModule wraps loader of module, which makes functions of module be checked before called.
+func guardModule(caps *Capabilities, mid string, loader lua.LGFunction) lua.LGFunction {
+	gs, ok := sandboxGuards[mid]
+	if !ok {
+		return loader
+	}
+	return func(lvm *lua.LState) int {
+		n := loader(lvm)
+		mod, ok := lvm.Get(-1).(*lua.LTable)
+		if !ok {
+			return n
+		}
+		for name, guard := range gs {
+			if fn, ok := mod.RawGetString(name).(*lua.LFunction); ok {
+				mod.RawSetString(name, lvm.NewFunction(guardFunc(caps, fn, guard)))
+			}
+		}
+		return n
+	}
+}
+
+// checkImport returns PermissionError when mid isn't declared in capabilities,
+// and mid is allowed as long as itself or the cluster to be imported is declared.
+func (caps *Capabilities) checkImport(cluster, mid string) error {
+	if caps.HasModule(cluster) || caps.HasModule(mid) {
+		return nil
+	}
+	return &PermissionError{Capability: "module:" + mid, Op: "Import"}
+}
+
+func containStr(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func containInt(nums []int, num int) bool {
+	for _, n := range nums {
+		if n == num {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "plugin.lua")
+	manifest := `libs: [base, string, table]
+modules: [cushion-io, cushion-strings, cushion-env, cushion-meta-table]
+roots: [data]
+`
+	if err := os.WriteFile(filepath.Join(dir, SandboxManifest), []byte(manifest), 0666); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := NewSandboxVirtualMachine(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Default()
+	testDataset := map[string]string{
+		`Import({"cushion-io"}) local io = require("cushion-io") io.Mkdirs("` + filepath.ToSlash(filepath.Join(dir, "data", "a")) + `")`: "",
+		`Import({"cushion-io"}) local io = require("cushion-io") io.Mkdirs("/etc/cushion")`:                                              "fs:/etc/cushion",
+		`Import({"cushion-io"}) local io = require("cushion-io") io.Exec("ls")`:                                                          "exec",
+		`Import({"cushion-env"}) local env = require("cushion-env") env.Set("CUSHION_SANDBOX", "1")`:                                     "env",
+		`Import({"cushion-env"}) local env = require("cushion-env") env.Export("/etc/cushion.env")`:                                      "fs:/etc/cushion.env",
+		`Import({"cushion-meta-table"}) local mt = require("cushion-meta-table") mt.Open("LOCAL_MACHINE/SOFTWARE/cushion")`:              "env",
+		`Import({"cushion-tui"})`:   "module:cushion-tui",
+		`os.exit(1)`:                "lib:os",
+		`print(string.upper("ok"))`: "",
+	}
+	for script, want := range testDataset {
+		err := vm.Eval(script)
+		if len(want) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", script, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want %s, got %v", script, want, err)
+		}
+	}
+}
+
+func TestSandboxSymlink(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	root := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(root, "sub"), os.ModePerm)
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	caps := &Capabilities{Roots: []string{root}}
+	for p, allowed := range map[string]bool{
+		filepath.Join(root, "sub", "a.txt"):            true,
+		filepath.Join(root, "new", "dir", "a.txt"):     true,
+		filepath.Join(root, "out"):                     false,
+		filepath.Join(root, "out", "a.txt"):            false,
+		filepath.Join(root, "out", "new", "a.txt"):     false,
+		root + string(os.PathSeparator) + "out/../x":   false,
+		root + string(os.PathSeparator) + "sub/../x":   true,
+		root + string(os.PathSeparator) + "none/../..": false,
+	} {
+		if err := caps.CheckPath("test", p); (err == nil) != allowed {
+			t.Errorf("%s: allowed %v, got %v", p, allowed, err)
+		}
+	}
+}
+
+func TestSandboxPackagePath(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "escape.lua"), []byte(`escaped = true`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, SandboxManifest), []byte("libs: [base, table]\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := NewSandboxVirtualMachine(filepath.Join(dir, "plugin.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Default()
+	err = vm.Eval(`package.path = "` + filepath.ToSlash(outside) + `/?.lua"
+assert(not pcall(require, "escape"))
+assert(escaped == nil)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
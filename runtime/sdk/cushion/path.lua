@@ -39,9 +39,9 @@ end
 
 ---@param pattern string
 ---@param name string
----@return boolean, error
+---@return boolean
 function cusionPath.Match(pattern, name)
-    return false, nil
+    return false
 end
 
 ---@param path string
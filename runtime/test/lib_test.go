@@ -10,3 +10,7 @@ func TestTui(t *testing.T) {
 	vm := runtime.NewVirtualMachine().Default()
 	vm.EvalFile("tui.lua")
 }
+
+func TestLuaTests(t *testing.T) {
+	runtime.RunLuaTests(t, "strings_test.lua")
+}
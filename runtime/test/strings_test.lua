@@ -0,0 +1,27 @@
+---@diagnostic disable: undefined-global
+Import({ "cushion" })
+
+local test = require("cushion-test")
+local strings = require("cushion-strings")
+local describe, it, assert = test.describe, test.it, test.assert
+
+describe("cushion-strings", function()
+    local text
+
+    test.before_each(function()
+        text = "cushion,hulo"
+    end)
+
+    it("splits text", function()
+        assert.equal({ "cushion", "hulo" }, strings.Split(text, ","))
+    end)
+
+    it("checks prefix and suffix", function()
+        assert.truthy(strings.HasPrefix(text, "cushion"))
+        assert.falsy(strings.HasSuffix(text, "cushion"))
+    end)
+
+    it("finds substring", function()
+        assert.truthy(strings.Contains(text, ","), "separator should exist")
+    end)
+end)
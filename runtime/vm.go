@@ -1,7 +1,10 @@
 package runtime
 
 import (
+	"context"
+	"errors"
 	"path"
+	"reflect"
 
 	"github.com/ansurfen/cushion/utils"
 
@@ -24,10 +27,22 @@ type VirtualMachine interface {
 	Eval(string) error
 	// EvalFile to execute file of script
 	EvalFile(string) error
+	// CompileFile to compile file of script, and the proto will be cached
+	CompileFile(string) (*lua.FunctionProto, error)
+	// EvalProto to execute compiled proto
+	EvalProto(*lua.FunctionProto) error
 	// EvalFunc to execute function
 	EvalFunc(lua.LValue, []lua.LValue) ([]any, error)
 	// FastEvalFunc to execute function and not return value
 	FastEvalFunc(lua.LValue, []lua.LValue) error
+	// EvalContext to execute string of script, which could be cancelled by context
+	EvalContext(context.Context, string) error
+	// EvalFileContext to execute file of script, which could be cancelled by context
+	EvalFileContext(context.Context, string) error
+	// CallContext to call specify function with arguments, which could be cancelled by context
+	CallContext(context.Context, string, []lua.LValue) ([]any, error)
+	// EvalFuncContext to execute function, which could be cancelled by context
+	EvalFuncContext(context.Context, lua.LValue, []lua.LValue) ([]any, error)
 	// SetGlobalFn to set global function
 	SetGlobalFn(Handles)
 	// SafeSetGlobalFn to set global function when it isn't exist
@@ -40,19 +55,73 @@ type VirtualMachine interface {
 	SafeSetGlobalVar(string, lua.LValue)
 	// RegisterModule to register modules
 	RegisterModule(Handles)
+	// RegisterModuleDesc to register modules with version, dependencies and hooks
+	RegisterModuleDesc(map[string]ModuleDesc)
 	// UnregisterModule to unregister specify module
 	UnregisterModule(string)
+	// LoadPackage to register package of directory or zip into MAT
+	LoadPackage(string) (*LuaPackage, error)
 	// LoadModule to immediately load module to be specified
 	LoadModule(string, lua.LGFunction)
+	// RegisterClass to expose go struct as class
+	RegisterClass(string, any) error
+	// NewClassObject wraps pointer of registered struct as object
+	NewClassObject(any) (lua.LValue, error)
+	// Exports returns the registry of values exported by script
+	Exports() *ExportRegistry
+	// RunLoop to run event loop of cushion-async until all tasks are finished
+	RunLoop(context.Context) error
+	// Go runs work on goroutine, and returns promise of cushion-async
+	Go(func() (any, error)) lua.LValue
+	// Emit to call handlers subscribed by cushion-event, and returns the payload modified by handlers
+	Emit(context.Context, string, any) (*Event, error)
+	// Watch to reload files loaded by EvalFile and package loader when they're changed
+	Watch(WatchOpt) *Watcher
 	// Interp returns interpreter
 	Interp() *LuaInterp
 }
 
 var _ VirtualMachine = &LuaVM{}
 
+var (
+	// ErrCancelled will be returned when the context of execution is cancelled
+	ErrCancelled = errors.New("vm: execution cancelled")
+	// ErrDeadline will be returned when the context of execution exceeds deadline
+	ErrDeadline = errors.New("vm: execution deadline exceeded")
+)
+
 type LuaVM struct {
-	mat   MAT
-	state *LuaInterp
+	mat     MAT
+	state   *LuaInterp
+	sandbox *Capabilities
+	budget  *Budget
+	cache   *CompileCache
+	hooks   []vmHook
+	classes map[reflect.Type]*luaClass
+	exports *ExportRegistry
+	reload  *reloadState
+	loop    *eventLoop
+	events  *eventBus
+	// depth is the depth of nested execution
+	depth int
+	// testCases collects cases declared by cushion-test
+	testCases *luaTests
+}
+
+// LuaVMOpt is used to customize LuaVM when it's created
+type LuaVMOpt struct {
+	// Sandbox restricts vm according to capabilities, and vm isn't restricted when it's nil.
+	Sandbox *Capabilities
+	// Budget limits the resource of every Eval and Call, and vm is unlimited when it's nil.
+	Budget *Budget
+	// Cache stores the compiled script of EvalFile, it defaults to DefaultCompileCache.
+	Cache *CompileCache
+	// Debugger pauses vm at breakpoints and steps, and it's attached by DAP client
+	Debugger *Debugger
+	// Profiler samples call stack of vm when it's started
+	Profiler *Profiler
+	// Coverage records executed lines of script files, which could be shared by vms
+	Coverage *Coverage
 }
 
 type (
@@ -63,10 +132,66 @@ type (
 )
 
 func NewVirtualMachine() VirtualMachine {
-	return &LuaVM{
-		state: lua.NewState(),
-		mat:   NewLuaMAT(),
+	return NewVirtualMachineWithOpt(LuaVMOpt{})
+}
+
+// NewVirtualMachineWithOpt to create virtual machine according to opt
+func NewVirtualMachineWithOpt(opt LuaVMOpt) VirtualMachine {
+	vm := &LuaVM{
+		mat:     NewLuaMAT(),
+		sandbox: opt.Sandbox,
+		budget:  opt.Budget,
+		cache:   opt.Cache,
+		exports: NewExportRegistry(),
+		reload:  newReloadState(),
+		events:  newEventBus(),
+	}
+	vm.loop = newEventLoop(vm)
+	vm.exports.vm = vm
+	if vm.cache == nil {
+		vm.cache = DefaultCompileCache()
+	}
+	luaOpt := lua.Options{
+		CallStackSize: lua.CallStackSize,
+		RegistrySize:  lua.RegistrySize,
+		SkipOpenLibs:  vm.sandbox != nil,
+	}
+	if vm.budget != nil {
+		vm.budget.apply(&luaOpt)
+		vm.hooks = append(vm.hooks, newBudgetHook(vm.budget))
+	}
+	if opt.Debugger != nil {
+		vm.hooks = append(vm.hooks, opt.Debugger)
+	}
+	if opt.Profiler != nil {
+		vm.hooks = append(vm.hooks, opt.Profiler)
+	}
+	if opt.Coverage != nil {
+		vm.hooks = append(vm.hooks, newCoverageHook(opt.Coverage))
+	}
+	vm.state = lua.NewState(luaOpt)
+	if vm.sandbox != nil {
+		openSandboxLibs(vm.state, vm.sandbox)
 	}
+	if len(vm.hooks) > 0 {
+		hookCoroutines(vm.state)
+	}
+	return vm
+}
+
+// NewSandboxVirtualMachine to create sandboxed virtual machine,
+// whose capabilities are loaded from the manifest next to script.
+func NewSandboxVirtualMachine(script string) (VirtualMachine, error) {
+	caps, err := LoadCapabilities(script)
+	if err != nil {
+		return nil, err
+	}
+	return NewVirtualMachineWithOpt(LuaVMOpt{Sandbox: caps}), nil
+}
+
+// Exports returns the registry of values exported by script
+func (vm *LuaVM) Exports() *ExportRegistry {
+	return vm.exports
 }
 
 // Interp returns interpreter
@@ -76,50 +201,33 @@ func (vm *LuaVM) Interp() *LuaInterp {
 
 // Call to call specify function without arguments
 func (vm *LuaVM) Call(fun string) ([]any, error) {
-	ret := []any{}
-	if err := vm.state.CallByParam(lua.P{
-		Fn:      vm.state.GetGlobal(fun),
-		NRet:    0,
-		Protect: true,
-	}); err != nil {
-		return ret, err
-	}
-	for i := 1; i <= vm.state.GetTop(); i++ {
-		ret = append(ret, vm.state.CheckAny(i))
-	}
-	return ret, nil
+	return vm.call(nil, vm.state.GetGlobal(fun), nil)
 }
 
 // FastCall to call specify function without arguments and not return value
 func (vm *LuaVM) FastCall(fun string) error {
-	return vm.state.CallByParam(lua.P{
-		Fn:      vm.state.GetGlobal(fun),
-		NRet:    0,
-		Protect: true,
+	return vm.exec(nil, func() error {
+		return vm.state.CallByParam(lua.P{
+			Fn:      vm.state.GetGlobal(fun),
+			NRet:    0,
+			Protect: true,
+		})
 	})
 }
 
 // Call to call specify function with arguments
 func (vm *LuaVM) CallByParam(fn string, args []lua.LValue) ([]any, error) {
-	ret := []any{}
-	if err := vm.state.CallByParam(lua.P{
-		Fn:      vm.state.GetGlobal(fn),
-		Protect: true,
-	}, args...); err != nil {
-		return ret, err
-	}
-	for i := 1; i <= vm.state.GetTop(); i++ {
-		ret = append(ret, vm.state.CheckAny(i))
-	}
-	return ret, nil
+	return vm.call(nil, vm.state.GetGlobal(fn), args)
 }
 
 // FastCallByParam to call specify function with arguments and not return value
 func (vm *LuaVM) FastCallByParam(fn string, args []lua.LValue) error {
-	return vm.state.CallByParam(lua.P{
-		Fn:      vm.state.GetGlobal(fn),
-		Protect: true,
-	}, args...)
+	return vm.exec(nil, func() error {
+		return vm.state.CallByParam(lua.P{
+			Fn:      vm.state.GetGlobal(fn),
+			Protect: true,
+		}, args...)
+	})
 }
 
 // RegisterModule to register modules
@@ -127,8 +235,29 @@ func (vm *LuaVM) RegisterModule(fns LuaFuncs) {
 	vm.mat.Mount(fns)
 }
 
-// UnregisterModule to unregister specify module
+// RegisterModuleDesc to register modules with version, dependencies and hooks
+func (vm *LuaVM) RegisterModuleDesc(descs map[string]ModuleDesc) {
+	vm.mat.MountDesc(descs)
+}
+
+// UnregisterModule to unregister specify module,
+// and it'll be evicted from package.loaded and package.preload.
 func (vm *LuaVM) UnregisterModule(mid string) {
+	if mcb, ok := vm.mat.MCB(mid)[mid]; ok {
+		if mcb.loaded && mcb.onUnload != nil {
+			mcb.onUnload(vm.state)
+		}
+		if mcb.used {
+			if loaded, ok := vm.state.GetField(vm.state.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+				loaded.RawSetString(mid, lua.LNil)
+			}
+			if pkg, ok := vm.state.GetGlobal("package").(*lua.LTable); ok {
+				if preload, ok := pkg.RawGetString("preload").(*lua.LTable); ok {
+					preload.RawSetString(mid, lua.LNil)
+				}
+			}
+		}
+	}
 	vm.mat.Unmount(mid)
 }
 
@@ -148,20 +277,46 @@ func (vm *LuaVM) Default() VirtualMachine {
 }
 
 func (vm *LuaVM) mountCushion() {
-	vm.mat.Mount(LuaFuncs{
-		"cushion-check":   LoadCheck,
-		"cushion-io":      loadIO,
-		"cushion-tmpl":    loadTmpl,
-		"cushion-tui":     loadTui,
-		"cushion-vm":      loadVM,
-		"cushion-crypto":  loadCrypto,
-		"cushion-time":    loadTime,
-		"cushion-path":    loadPath,
-		"cushion-strings": loadStrings,
-	}).Collect("cushion", []string{
+	vm.mat.Mount(vm.guard(LuaFuncs{
+		"cushion-check":      LoadCheck,
+		"cushion-io":         loadIO,
+		"cushion-tmpl":       loadTmpl,
+		"cushion-tui":        loadTui,
+		"cushion-vm":         loadVM(vm),
+		"cushion-crypto":     loadCrypto,
+		"cushion-time":       loadTime,
+		"cushion-path":       loadPath,
+		"cushion-strings":    loadStrings,
+		"cushion-meta":       loadMeta(vm),
+		"cushion-test":       loadTest(vm),
+		"cushion-async":      loadAsync(vm),
+		"cushion-event":      loadEvent(vm),
+		"cushion-encoding":   loadEncoding,
+		"cushion-fs":         loadFS,
+		"cushion-exec":       loadExec,
+		"cushion-archive":    loadArchive,
+		"cushion-env":        loadEnv,
+		"cushion-meta-table": loadMetaTable,
+	})).Collect("cushion", []string{
 		"cushion-check", "cushion-io", "cushion-tmpl",
 		"cushion-tui", "cushion-vm", "cushion-crypto",
-		"cushion-time", "cushion-path", "cushion-strings"})
+		"cushion-time", "cushion-path", "cushion-strings",
+		"cushion-meta", "cushion-test", "cushion-async",
+		"cushion-event", "cushion-encoding", "cushion-fs",
+		"cushion-exec", "cushion-archive", "cushion-env",
+		"cushion-meta-table"})
+}
+
+// guard wraps loaders to check capabilities when vm is sandboxed
+func (vm *LuaVM) guard(loaders LuaFuncs) LuaFuncs {
+	if vm.sandbox == nil {
+		return loaders
+	}
+	guarded := make(LuaFuncs)
+	for mid, loader := range loaders {
+		guarded[mid] = guardModule(vm.sandbox, mid, loader)
+	}
+	return guarded
 }
 
 // SetGlobalFn to set global function
@@ -182,38 +337,163 @@ func (vm *LuaVM) SafeSetGlobalFn(loaders LuaFuncs) {
 
 // Eval to execute string of script
 func (vm *LuaVM) Eval(script string) error {
-	return vm.state.DoString(script)
+	return withSource(vm.exec(nil, func() error {
+		return vm.state.DoString(script)
+	}), "<string>", script)
 }
 
-// EvalFile to execute file of script
+// EvalFile to execute file of script, and only .lua file is supported
 func (vm *LuaVM) EvalFile(fullpath string) error {
-	if path.Ext(fullpath) == ".lua" {
-		return vm.state.DoFile(fullpath)
-	}
-	return nil
+	return vm.evalFile(nil, fullpath)
+}
+
+// CompileFile to compile file of script, and the proto will be cached
+func (vm *LuaVM) CompileFile(fullpath string) (*lua.FunctionProto, error) {
+	return vm.cache.Compile(fullpath)
+}
+
+// EvalProto to execute compiled proto
+func (vm *LuaVM) EvalProto(proto *lua.FunctionProto) error {
+	return vm.evalProto(nil, proto)
+}
+
+func (vm *LuaVM) evalProto(ctx context.Context, proto *lua.FunctionProto) error {
+	return vm.exec(ctx, func() error {
+		vm.state.Push(vm.state.NewFunctionFromProto(proto))
+		return vm.state.PCall(0, lua.MultRet, nil)
+	})
 }
 
 // EvalFunc to execute function
 func (vm *LuaVM) EvalFunc(fn lua.LValue, args []lua.LValue) ([]any, error) {
+	return vm.call(nil, fn, args)
+}
+
+// FastEvalFunc to execute function and not return value
+func (vm *LuaVM) FastEvalFunc(fn lua.LValue, args []lua.LValue) error {
+	return vm.exec(nil, func() error {
+		return vm.state.CallByParam(lua.P{
+			Fn:      fn,
+			Protect: true,
+		}, args...)
+	})
+}
+
+// EvalContext to execute string of script, which could be cancelled by context
+func (vm *LuaVM) EvalContext(ctx context.Context, script string) error {
+	return withSource(vm.exec(ctx, func() error {
+		return vm.state.DoString(script)
+	}), "<string>", script)
+}
+
+// EvalFileContext to execute file of script, which could be cancelled by context
+func (vm *LuaVM) EvalFileContext(ctx context.Context, fullpath string) error {
+	return vm.evalFile(ctx, fullpath)
+}
+
+func (vm *LuaVM) evalFile(ctx context.Context, fullpath string) error {
+	proto, err := vm.CompileFile(fullpath)
+	if err != nil {
+		return newScriptError(err)
+	}
+	vm.reload.track(fullpath, nil, "")
+	return vm.evalProto(ctx, proto)
+}
+
+// CallContext to call specify function with arguments, which could be cancelled by context
+func (vm *LuaVM) CallContext(ctx context.Context, fn string, args []lua.LValue) ([]any, error) {
+	return vm.EvalFuncContext(ctx, vm.state.GetGlobal(fn), args)
+}
+
+// EvalFuncContext to execute function, which could be cancelled by context
+func (vm *LuaVM) EvalFuncContext(ctx context.Context, fn lua.LValue, args []lua.LValue) ([]any, error) {
+	return vm.call(ctx, fn, args)
+}
+
+// call to execute function and collect its return values, which are popped from stack
+func (vm *LuaVM) call(ctx context.Context, fn lua.LValue, args []lua.LValue) ([]any, error) {
 	ret := []any{}
-	if err := vm.state.CallByParam(lua.P{
-		Fn:      fn,
-		Protect: true,
-	}, args...); err != nil {
+	base := vm.state.GetTop()
+	if err := vm.exec(ctx, func() error {
+		return vm.state.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    lua.MultRet,
+			Protect: true,
+		}, args...)
+	}); err != nil {
 		return ret, err
 	}
-	for i := 1; i <= vm.state.GetTop(); i++ {
-		ret = append(ret, vm.state.CheckAny(i))
+	for i := base + 1; i <= vm.state.GetTop(); i++ {
+		ret = append(ret, vm.state.Get(i))
 	}
+	vm.state.SetTop(base)
 	return ret, nil
 }
 
-// FastEvalFunc to execute function and not return value
-func (vm *LuaVM) FastEvalFunc(fn lua.LValue, args []lua.LValue) error {
-	return vm.state.CallByParam(lua.P{
-		Fn:      fn,
-		Protect: true,
-	}, args...)
+// exec is the entry of all execution, which attaches ctx and hooks to interpreter during the execution of callback.
+// The previous context will be restored after callback returns, and ctx could be nil when it isn't required.
+// The error raised by script is converted into ScriptError.
+func (vm *LuaVM) exec(ctx context.Context, callback func() error) error {
+	if vm.depth == 0 {
+		// files changed are reloaded before top-level execution
+		vm.applyWatcher()
+	}
+	vm.depth++
+	defer func() { vm.depth-- }()
+	return takeScriptCause(vm.state, newScriptError(vm.execHooks(ctx, callback)))
+}
+
+func (vm *LuaVM) execHooks(ctx context.Context, callback func() error) error {
+	old := vm.state.Context()
+	outer, nested := old.(*stepContext)
+	if nested && ctx == nil {
+		// nested execution shares the hooks of outer
+		return outer.hctx.convert(callback())
+	}
+	if ctx == nil && len(vm.hooks) == 0 {
+		return callback()
+	}
+	if ctx == nil {
+		ctx = context.Background()
+		if old != nil {
+			ctx = old
+		}
+	}
+	if old != nil {
+		defer vm.state.SetContext(old)
+	} else {
+		defer vm.state.RemoveContext()
+	}
+	if len(vm.hooks) == 0 {
+		vm.state.SetContext(ctx)
+		return contextErr(ctx, callback())
+	}
+	if !nested {
+		for _, hook := range vm.hooks {
+			hook.begin()
+		}
+	}
+	hctx := newHookContext(ctx, vm.hooks)
+	vm.state.SetContext(&stepContext{Context: hctx, hctx: hctx, state: vm.state})
+	err := hctx.convert(callback())
+	if vm.budget != nil {
+		err = vm.budget.convert(err)
+	}
+	return err
+}
+
+// contextErr converts the error raised by cancelled context into ErrCancelled or ErrDeadline
+func contextErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		return ErrCancelled
+	case context.DeadlineExceeded:
+		return ErrDeadline
+	}
+	return err
 }
 
 // GetGlobalVar returns global variable
@@ -250,9 +530,26 @@ func globalImport(vm *LuaVM) lua.LGFunction {
 	return func(lvm *lua.LState) int {
 		lvm.CheckTable(1).ForEach(func(idx, moudules lua.LValue) {
 			mcbs := vm.mat.MCB(moudules.String())
-			for mid, mcb := range mcbs {
+			// dependencies are imported implicitly
+			mids, err := vm.mat.Resolve(moudules.String())
+			if err != nil {
+				raiseError(lvm, err)
+			}
+			if vm.sandbox != nil {
+				for _, mid := range mids {
+					cluster := mid
+					if _, ok := mcbs[mid]; ok {
+						cluster = moudules.String()
+					}
+					if err := vm.sandbox.checkImport(cluster, mid); err != nil {
+						raiseError(lvm, err)
+					}
+				}
+			}
+			for _, mid := range mids {
+				mcb := vm.mat.MCB(mid)[mid]
 				if !mcb.Used() {
-					lvm.PreloadModule(mid, mcb.Fun())
+					lvm.PreloadModule(mid, mcb.loader())
 					mcb.Mark()
 				}
 			}
@@ -276,6 +573,26 @@ func LuaDoFunc(lvm *lua.LState, fun *lua.LFunction) error {
 	return lvm.PCall(0, lua.MultRet, nil)
 }
 
+// LuaDoFuncContext is the same as LuaDoFunc, but it could be cancelled by ctx.
+// It's useful to run lua callback in other goroutine, such as components.
+func LuaDoFuncContext(ctx context.Context, lvm *lua.LState, fun *lua.LFunction) error {
+	if ctx == nil {
+		return LuaDoFunc(lvm, fun)
+	}
+	if err := ctx.Err(); err != nil {
+		return contextErr(ctx, err)
+	}
+	if lvm.Context() != ctx {
+		if old := lvm.Context(); old != nil {
+			defer lvm.SetContext(old)
+		} else {
+			defer lvm.RemoveContext()
+		}
+		lvm.SetContext(ctx)
+	}
+	return contextErr(ctx, LuaDoFunc(lvm, fun))
+}
+
 func boolHandle(lvm *lua.LState, b bool) {
 	if b {
 		lvm.Push(lua.LTrue)
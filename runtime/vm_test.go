@@ -0,0 +1,34 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEvalContext(t *testing.T) {
+	vm := NewVirtualMachine().Default()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := vm.EvalContext(ctx, `while true do end`); !errors.Is(err, ErrDeadline) {
+		t.Fatalf("want ErrDeadline, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := vm.CallContext(ctx, "print", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.EvalContext(ctx, `function loop() while true do end end loop()`); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("want ErrCancelled, got %v", err)
+	}
+	if err := vm.Eval(`ok = 1 + 1`); err != nil {
+		t.Fatal(err)
+	}
+	if vm.GetGlobalVar("ok").String() != "2" {
+		t.Fatal("vm isn't reusable after cancelled")
+	}
+}
@@ -0,0 +1,329 @@
+package runtime
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// WatchOpt is the option of Watch
+type WatchOpt struct {
+	// Interval is the period of polling files, it defaults to 500ms
+	Interval time.Duration
+	// OnReload is called after changed file is reloaded, and err is the error of reload.
+	// The vm keeps running when reload fails, so that the file could be fixed and reloaded again.
+	OnReload func(file string, err error)
+}
+
+// reloadState records files loaded by EvalFile and package loader, and globals to be kept when reloading
+type reloadState struct {
+	mutex      sync.Mutex
+	files      map[string]*watchedFile
+	persistent []string
+	watcher    *Watcher
+	// applying avoids reloading again when reloaded script is executed
+	applying bool
+}
+
+// watchedFile is the file to be polled, and pkg is nil when it's loaded by EvalFile
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	pkg     *LuaPackage
+	// name is the file of package, and it's empty when package is zip
+	name string
+}
+
+func newReloadState() *reloadState {
+	return &reloadState{files: make(map[string]*watchedFile)}
+}
+
+// track to record the file and its stat, and it's ignored when file doesn't exist
+func (rs *reloadState) track(file string, pkg *LuaPackage, name string) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.files[file] = &watchedFile{modTime: info.ModTime(), size: info.Size(), pkg: pkg, name: name}
+}
+
+// trackPackage to record scripts of directory package or the zip of package
+func (rs *reloadState) trackPackage(pkg *LuaPackage) {
+	info, err := os.Stat(pkg.Source)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		rs.track(pkg.Source, pkg, "")
+		return
+	}
+	for name := range pkg.files {
+		rs.track(filepath.Join(pkg.Source, filepath.FromSlash(name)), pkg, name)
+	}
+}
+
+// Watcher polls files loaded by EvalFile and package loader, and reloads changed files in place.
+// Changed files are reloaded when Reload is called or before next Eval or Call of vm,
+// because interpreter only could be accessed by the goroutine of vm.
+type Watcher struct {
+	vm      *LuaVM
+	opt     WatchOpt
+	mutex   sync.Mutex
+	pending map[string]struct{}
+	changed chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// Watch to poll files loaded by vm, and the previous watcher of vm is closed.
+//
+// When file loaded by EvalFile is changed, it's evaluated again, and the globals marked by
+// cushion-vm.Persist keep values before reloading. When script of package is changed,
+// loaded module is executed again and its table is updated in place, so that references
+// held by other scripts observe new functions. After that, global function on_reload is
+// called with the path of file if it's defined.
+func (vm *LuaVM) Watch(opt WatchOpt) *Watcher {
+	if opt.Interval <= 0 {
+		opt.Interval = 500 * time.Millisecond
+	}
+	w := &Watcher{
+		vm:      vm,
+		opt:     opt,
+		pending: make(map[string]struct{}),
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	vm.reload.mutex.Lock()
+	old := vm.reload.watcher
+	vm.reload.watcher = w
+	vm.reload.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go w.run()
+	return w
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.opt.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.poll()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// poll to compare stat of files with records, and changed files are pending to be reloaded
+func (w *Watcher) poll() {
+	rs := w.vm.reload
+	changed := []string{}
+	rs.mutex.Lock()
+	for file, wf := range rs.files {
+		info, err := os.Stat(file)
+		if err != nil || (info.ModTime().Equal(wf.modTime) && info.Size() == wf.size) {
+			continue
+		}
+		wf.modTime, wf.size = info.ModTime(), info.Size()
+		changed = append(changed, file)
+	}
+	rs.mutex.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+	w.mutex.Lock()
+	for _, file := range changed {
+		w.pending[file] = struct{}{}
+	}
+	w.mutex.Unlock()
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed returns the channel which receives when some files are changed
+func (w *Watcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// Close to stop polling, and pending files aren't reloaded
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		close(w.stop)
+		rs := w.vm.reload
+		rs.mutex.Lock()
+		if rs.watcher == w {
+			rs.watcher = nil
+		}
+		rs.mutex.Unlock()
+	})
+}
+
+// Reload to reload pending files immediately, which must be called by the goroutine of vm.
+// It returns the errors of files which fail to reload.
+func (w *Watcher) Reload() error {
+	w.poll()
+	return w.apply()
+}
+
+// apply to reload pending files in sorted order
+func (w *Watcher) apply() error {
+	rs := w.vm.reload
+	if rs.applying {
+		return nil
+	}
+	w.mutex.Lock()
+	files := []string{}
+	for file := range w.pending {
+		files = append(files, file)
+	}
+	w.pending = make(map[string]struct{})
+	w.mutex.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Strings(files)
+	rs.applying = true
+	defer func() { rs.applying = false }()
+	errs := []error{}
+	for _, file := range files {
+		rs.mutex.Lock()
+		wf := rs.files[file]
+		rs.mutex.Unlock()
+		if wf == nil {
+			continue
+		}
+		err := w.vm.reloadFile(file, wf)
+		if w.opt.OnReload != nil {
+			w.opt.OnReload(file, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyWatcher reloads pending files before top-level execution
+func (vm *LuaVM) applyWatcher() {
+	vm.reload.mutex.Lock()
+	w := vm.reload.watcher
+	vm.reload.mutex.Unlock()
+	if w != nil {
+		w.apply()
+	}
+}
+
+// reloadFile to evaluate file again, and persistent globals are restored after it
+func (vm *LuaVM) reloadFile(file string, wf *watchedFile) error {
+	persistent := make(map[string]lua.LValue)
+	for _, name := range vm.reload.persistent {
+		if v := vm.state.GetGlobal(name); v != lua.LNil {
+			persistent[name] = v
+		}
+	}
+	var err error
+	if wf.pkg == nil {
+		err = vm.evalFile(nil, file)
+	} else {
+		err = vm.reloadPackage(wf.pkg, wf.name)
+	}
+	for name, v := range persistent {
+		vm.state.SetGlobal(name, v)
+	}
+	if err != nil {
+		return err
+	}
+	if hook, ok := vm.state.GetGlobal("on_reload").(*lua.LFunction); ok {
+		return vm.FastEvalFunc(hook, []lua.LValue{lua.LString(file)})
+	}
+	return nil
+}
+
+// reloadPackage to read changed script of package, and the module is executed again when it's loaded.
+// All scripts are read again when package is zip.
+func (vm *LuaVM) reloadPackage(pkg *LuaPackage, name string) error {
+	names := []string{name}
+	if len(name) == 0 {
+		newPkg, err := ReadPackage(pkg.Source)
+		if err != nil {
+			return err
+		}
+		pkg.files = newPkg.files
+		names = names[:0]
+		for name := range pkg.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		raw, err := os.ReadFile(filepath.Join(pkg.Source, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		pkg.files[name] = raw
+	}
+	loaded := vm.state.GetField(vm.state.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable)
+	entry := path.Clean(pkg.Entry)
+	for _, name := range names {
+		mod := pkg.submodule(name)
+		if name == entry {
+			mod = pkg.Name
+		}
+		old := loaded.RawGetString(mod)
+		if old == lua.LNil {
+			// module will read new script when it's required
+			continue
+		}
+		ret, err := vm.call(nil, vm.state.NewFunction(pkg.fileLoader(name)), nil)
+		if err != nil {
+			return err
+		}
+		var value lua.LValue = lua.LTrue
+		if len(ret) > 0 {
+			value = ret[0].(lua.LValue)
+		}
+		oldTbl, ok1 := old.(*lua.LTable)
+		newTbl, ok2 := value.(*lua.LTable)
+		if !ok1 || !ok2 {
+			loaded.RawSetString(mod, value)
+			continue
+		}
+		// update table in place, so that references held by other scripts observe new functions
+		keys := []lua.LValue{}
+		oldTbl.ForEach(func(k, _ lua.LValue) {
+			keys = append(keys, k)
+		})
+		for _, k := range keys {
+			oldTbl.RawSet(k, lua.LNil)
+		}
+		newTbl.ForEach(func(k, v lua.LValue) {
+			oldTbl.RawSet(k, v)
+		})
+	}
+	return nil
+}
+
+// vmPersist marks globals to keep their values when script is reloaded by watcher
+func vmPersist(vm *LuaVM) lua.LGFunction {
+	return func(lvm *lua.LState) int {
+		for i := 1; i <= lvm.GetTop(); i++ {
+			name := lvm.CheckString(i)
+			if !containStr(vm.reload.persistent, name) {
+				vm.reload.persistent = append(vm.reload.persistent, name)
+			}
+		}
+		return 0
+	}
+}
@@ -0,0 +1,71 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.lua")
+	pkg := filepath.Join(dir, "pkg")
+	os.MkdirAll(pkg, 0777)
+	write := func(file, content string) {
+		os.WriteFile(file, []byte(content), 0666)
+		// the modified time is moved forward, because writes within the same tick can't be observed
+		future := time.Now().Add(time.Duration(len(content)) * time.Second)
+		os.Chtimes(file, future, future)
+	}
+	write(filepath.Join(pkg, "package.yaml"), "name: pkg\nversion: 1.0.0\n")
+	write(filepath.Join(pkg, "init.lua"), `return { version = function() return "v1" end }`)
+	write(main, `
+Import({"cushion-vm", "pkg"})
+require("cushion-vm").Persist("Counter")
+Counter = 0
+Version = "v1"
+Pkg = require("pkg")`)
+	vm := NewVirtualMachine().Default()
+	if _, err := vm.LoadPackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.EvalFile(main); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := []string{}
+	w := vm.Watch(WatchOpt{Interval: 10 * time.Millisecond, OnReload: func(file string, err error) {
+		reloaded = append(reloaded, filepath.Base(file))
+	}})
+	defer w.Close()
+	vm.Eval(`Counter = Counter + 1`)
+
+	write(main, `
+Import({"cushion-vm", "pkg"})
+require("cushion-vm").Persist("Counter")
+Counter = 0
+Version = "v2"
+function on_reload(file) Reloads = (Reloads or 0) + 1 end`)
+	write(filepath.Join(pkg, "init.lua"), `return { version = function() return "v2 from package" end }`)
+	select {
+	case <-w.Changed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("change isn't observed")
+	}
+	// pending files are reloaded before Eval
+	if err := vm.Eval(`assert(Counter == 1 and Version == "v2" and Reloads == 2, tostring(Reloads))
+assert(Pkg.version() == "v2 from package")`); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded) != 2 {
+		t.Fatalf("unexpected reloaded files %v", reloaded)
+	}
+
+	write(main, `Version = `)
+	if err := w.Reload(); err == nil {
+		t.Fatal("syntax error should be reported")
+	}
+	if err := vm.Eval(`assert(Version == "v2")`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,609 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveFormat is the format of archive
+type ArchiveFormat string
+
+const (
+	ArchiveZip    ArchiveFormat = "zip"
+	ArchiveTar    ArchiveFormat = "tar"
+	ArchiveTarGz  ArchiveFormat = "tar.gz"
+	ArchiveTarBz2 ArchiveFormat = "tar.bz2"
+)
+
+// ErrUnsafeEntry is returned when entry of archive escapes the destination,
+// such as absolute path, ../ or symbolic link pointing outside.
+var ErrUnsafeEntry = errors.New("archive: entry escapes destination")
+
+// ArchiveOpt is the option of Extract and CreateArchive
+type ArchiveOpt struct {
+	// Format of archive to be created, which is inferred by extension of file when it's empty.
+	// The format of archive to be extracted is always detected by magic bytes.
+	Format ArchiveFormat
+	// StripComponents removes the number of leading directories from names when extracting,
+	// and entries without enough components are skipped.
+	StripComponents int
+	// Include only keeps entries matching any patterns, and all entries are kept when it's empty.
+	// Pattern matches the name in archive or its parent directory, and ** is supported.
+	// Pattern without / matches any element of name, such as *.log.
+	Include []string
+	// Exclude skips entries matching any patterns like Include
+	Exclude []string
+}
+
+// DetectArchive detects the format of archive by magic bytes
+func DetectArchive(file string) (ArchiveFormat, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(fp, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ArchiveZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ArchiveTarGz, nil
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return ArchiveTarBz2, nil
+	case len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return ArchiveTar, nil
+	}
+	return "", fmt.Errorf("archive: unknown format of %s", file)
+}
+
+// ArchiveFormatOf infers format by extension of file, such as .zip, .tar, .tar.gz, .tgz, .tar.bz2 and .tbz2
+func ArchiveFormatOf(file string) (ArchiveFormat, error) {
+	name := strings.ToLower(file)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip, nil
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz, nil
+	case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+		return ArchiveTarBz2, nil
+	}
+	return "", fmt.Errorf("archive: unknown format of %s", file)
+}
+
+// archiveEntry is the entry of zip or tar, whose name is separated by /
+type archiveEntry struct {
+	name string
+	mode fs.FileMode
+	// link is the target of symbolic link, or the name of hard link
+	link     string
+	hardlink bool
+	open     func() (io.ReadCloser, error)
+}
+
+// walkArchive calls fn with entries of archive in order
+func walkArchive(src string, fn func(archiveEntry) error) error {
+	format, err := DetectArchive(src)
+	if err != nil {
+		return err
+	}
+	if format == ArchiveZip {
+		reader, err := OpenZip(src)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		for _, f := range reader.File {
+			e := archiveEntry{name: f.Name, mode: f.Mode(), open: f.Open}
+			if e.mode&fs.ModeSymlink != 0 {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				link, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					return err
+				}
+				e.link = string(link)
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = bufio.NewReader(fp)
+	switch format {
+	case ArchiveTarGz:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case ArchiveTarBz2:
+		r = bzip2.NewReader(r)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := archiveEntry{
+			name: hdr.Name,
+			mode: hdr.FileInfo().Mode(),
+			open: func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+			e.link = hdr.Linkname
+		case tar.TypeLink:
+			e.link, e.hardlink = hdr.Linkname, true
+		default:
+			// devices and fifos aren't extracted
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// ListArchive returns names of entries matching include and exclude of opt
+func ListArchive(src string, opt ArchiveOpt) ([]string, error) {
+	names := []string{}
+	err := walkArchive(src, func(e archiveEntry) error {
+		if matchArchive(e.name, opt) {
+			names = append(names, e.name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Extract to extract zip, tar, tar.gz or tar.bz2 into dst, and the format is detected by magic bytes.
+// Permissions of entries are preserved, and ErrUnsafeEntry is returned when any entry escapes dst.
+// Symbolic links are created after other entries, so that nothing is written through them,
+// and they're verified again when all are created because a link could be redirected by later ones.
+func Extract(src, dst string, opt ArchiveOpt) error {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	root, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	type symlink struct {
+		name, target, link string
+	}
+	dirs := []dirMode{}
+	links := []symlink{}
+	// regular files extracted in this run, which could be the source of hard link
+	files := make(map[string]bool)
+	err = walkArchive(src, func(e archiveEntry) error {
+		if !matchArchive(e.name, opt) {
+			return nil
+		}
+		// the raw name is checked, so that ../ isn't hidden by stripping
+		if _, err := safeJoin(root, e.name); err != nil {
+			return err
+		}
+		name, ok := stripComponents(e.name, opt.StripComponents)
+		if !ok {
+			return nil
+		}
+		target, err := safeJoin(root, name)
+		if err != nil {
+			return err
+		}
+		if err := safeMkdirs(root, filepath.Dir(target)); err != nil {
+			return err
+		}
+		switch {
+		case e.mode.IsDir():
+			if err := safeMkdirs(root, target); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, e.mode.Perm()})
+			return nil
+		case e.mode&fs.ModeSymlink != 0:
+			if filepath.IsAbs(e.link) || strings.HasPrefix(e.link, "/") || len(filepath.VolumeName(e.link)) > 0 {
+				return fmt.Errorf("%w: %s -> %s", ErrUnsafeEntry, e.name, e.link)
+			}
+			links = append(links, symlink{e.name, target, filepath.FromSlash(e.link)})
+			return nil
+		case e.hardlink:
+			if _, err := safeJoin(root, e.link); err != nil {
+				return err
+			}
+			linkName, ok := stripComponents(e.link, opt.StripComponents)
+			if !ok {
+				return fmt.Errorf("%w: %s => %s", ErrUnsafeEntry, e.name, e.link)
+			}
+			old, err := safeJoin(root, linkName)
+			if err != nil {
+				return err
+			}
+			real, err := filepath.EvalSymlinks(old)
+			if err != nil || !files[real] {
+				return fmt.Errorf("%w: %s => %s isn't extracted regular file", ErrUnsafeEntry, e.name, e.link)
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Link(real, target); err != nil {
+				return err
+			}
+			return markExtracted(files, target)
+		}
+		// remove existed file, so that it isn't written through symbolic link
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		rc, err := e.open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		w, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, e.mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, rc); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, e.mode.Perm()); err != nil {
+			return err
+		}
+		return markExtracted(files, target)
+	})
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if info, err := os.Lstat(l.target); err == nil && info.IsDir() {
+			return fmt.Errorf("%w: symbolic link %s replaces directory", ErrUnsafeEntry, l.name)
+		}
+		if err := os.RemoveAll(l.target); err != nil {
+			return err
+		}
+		if err := os.Symlink(l.link, l.target); err != nil {
+			return err
+		}
+	}
+	for _, l := range links {
+		if err := checkSymlink(root, l.target, l.link); err != nil {
+			// links created in this run are removed, so that escaping one isn't left
+			for _, l := range links {
+				os.Remove(l.target)
+			}
+			return fmt.Errorf("%w: %s -> %s", err, l.name, filepath.ToSlash(l.link))
+		}
+	}
+	// permission of directory is set at last, because it may be readonly
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markExtracted records the real path of regular file extracted in this run
+func markExtracted(files map[string]bool, target string) error {
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	files[real] = true
+	return nil
+}
+
+// checkSymlink returns ErrUnsafeEntry when symbolic link resolves outside root.
+// Dangling link is checked by joining its target with the resolved parent.
+func checkSymlink(root, target, link string) error {
+	if real, err := filepath.EvalSymlinks(target); err == nil {
+		if !pathInside(root, real) {
+			return ErrUnsafeEntry
+		}
+		return nil
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil || !pathInside(root, filepath.Join(parent, link)) {
+		return ErrUnsafeEntry
+	}
+	return nil
+}
+
+// safeJoin joins name of entry with root, and it returns ErrUnsafeEntry when result is outside root
+func safeJoin(root, name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || len(filepath.VolumeName(name)) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeEntry, name)
+	}
+	target := filepath.Join(root, filepath.FromSlash(name))
+	if !pathInside(root, target) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeEntry, name)
+	}
+	return target, nil
+}
+
+// safeMkdirs creates dir, and checks that it isn't redirected outside root by symbolic link.
+// The existing ancestor is checked before creating, so that nothing is created outside root.
+func safeMkdirs(root, dir string) error {
+	existing := dir
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	for _, p := range []string{existing, dir} {
+		if p == dir {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return err
+		}
+		if !pathInside(root, real) {
+			return fmt.Errorf("%w: %s", ErrUnsafeEntry, dir)
+		}
+	}
+	return nil
+}
+
+func pathInside(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// stripComponents removes n leading elements of name, and it returns false when nothing is left
+func stripComponents(name string, n int) (string, bool) {
+	name = strings.Trim(path.Clean(name), "/")
+	if name == "." || len(name) == 0 {
+		return "", false
+	}
+	if n <= 0 {
+		return name, true
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) <= n {
+		return "", false
+	}
+	return strings.Join(parts[n:], "/"), true
+}
+
+// matchArchive returns whether name is included and isn't excluded by opt
+func matchArchive(name string, opt ArchiveOpt) bool {
+	name = strings.Trim(name, "/")
+	if len(opt.Include) > 0 && !matchArchivePatterns(opt.Include, name) {
+		return false
+	}
+	return !matchArchivePatterns(opt.Exclude, name)
+}
+
+func matchArchivePatterns(patterns []string, name string) bool {
+	parts := strings.Split(name, "/")
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		for i := range parts {
+			if !strings.Contains(pattern, "/") && !strings.Contains(pattern, "**") {
+				if ok, _ := path.Match(pattern, parts[i]); ok {
+					return true
+				}
+				continue
+			}
+			if ok, _ := MatchPath(pattern, strings.Join(parts[:i+1], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// archiveWriter adds files into archive
+type archiveWriter interface {
+	add(name string, info fs.FileInfo, file, link string) error
+	Close() error
+}
+
+// CreateArchive to create archive of paths, and entries are named relative to the parent of every path.
+// The format is inferred by extension of dst when Format of opt is empty.
+// tar.bz2 only could be extracted, because go doesn't implement the compressor of bzip2.
+func CreateArchive(dst string, paths []string, opt ArchiveOpt) (err error) {
+	format := opt.Format
+	if len(format) == 0 {
+		if format, err = ArchiveFormatOf(dst); err != nil {
+			return err
+		}
+	}
+	if format == ArchiveTarBz2 {
+		return errors.New("archive: creating tar.bz2 isn't supported")
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	fp, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := fp.Close(); err == nil {
+			err = e
+		}
+	}()
+	var w archiveWriter
+	switch format {
+	case ArchiveZip:
+		w = &zipArchiveWriter{zip.NewWriter(fp)}
+	case ArchiveTar:
+		w = &tarArchiveWriter{tw: tar.NewWriter(fp)}
+	case ArchiveTarGz:
+		gw := gzip.NewWriter(fp)
+		w = &tarArchiveWriter{tw: tar.NewWriter(gw), closer: gw}
+	default:
+		return fmt.Errorf("archive: unknown format %s", format)
+	}
+	abs, _ := filepath.Abs(dst)
+	for _, src := range paths {
+		src = filepath.Clean(src)
+		base := filepath.Dir(src)
+		err := filepath.Walk(src, func(p string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if pabs, _ := filepath.Abs(p); pabs == abs {
+				return nil
+			}
+			rel, err := filepath.Rel(base, p)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if matchArchivePatterns(opt.Exclude, name) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				// parents of included files are created when extracting
+				if len(opt.Include) > 0 {
+					return nil
+				}
+				name += "/"
+			} else if len(opt.Include) > 0 && !matchArchivePatterns(opt.Include, name) {
+				return nil
+			}
+			link := ""
+			if info.Mode()&fs.ModeSymlink != 0 {
+				if link, err = os.Readlink(p); err != nil {
+					return err
+				}
+				link = filepath.ToSlash(link)
+			}
+			return w.add(name, info, p, link)
+		})
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipArchiveWriter) add(name string, info fs.FileInfo, file, link string) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.Mode().IsRegular() {
+		hdr.Method = zip.Deflate
+	}
+	fw, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(link) > 0:
+		_, err = io.WriteString(fw, link)
+		return err
+	case info.Mode().IsRegular():
+		return copyFileTo(fw, file)
+	}
+	return nil
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw     *tar.Writer
+	closer io.Closer
+}
+
+func (w *tarArchiveWriter) add(name string, info fs.FileInfo, file, link string) error {
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		return copyFileTo(w.tw, file)
+	}
+	return nil
+}
+
+func (w *tarArchiveWriter) Close() error {
+	err := w.tw.Close()
+	if w.closer != nil {
+		if e := w.closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func copyFileTo(w io.Writer, file string) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = io.Copy(w, fp)
+	return err
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func newArchiveTree(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "app")
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "bin", "run.sh"), []byte("echo hi"), 0755)
+	os.WriteFile(filepath.Join(dir, "readme.md"), []byte("# app"), 0644)
+	os.WriteFile(filepath.Join(dir, "debug.log"), []byte("log"), 0644)
+	if err := os.Symlink("readme.md", filepath.Join(dir, "README")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestArchive(t *testing.T) {
+	src := newArchiveTree(t)
+	out := t.TempDir()
+	for _, name := range []string{"app.zip", "app.tar", "app.tar.gz"} {
+		file := filepath.Join(out, name)
+		if err := CreateArchive(file, []string{src}, ArchiveOpt{Exclude: []string{"*.log"}}); err != nil {
+			t.Fatal(err)
+		}
+		format, err := DetectArchive(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := ListArchive(file, ArchiveOpt{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println(format, names)
+		dst := filepath.Join(out, name+".d")
+		if err := Extract(file, dst, ArchiveOpt{StripComponents: 1}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dst, "bin", "run.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0755 {
+			t.Fatalf("%s: mode %v isn't preserved", name, info.Mode())
+		}
+		if link, err := os.Readlink(filepath.Join(dst, "README")); err != nil || link != "readme.md" {
+			t.Fatalf("%s: invalid link %q %v", name, link, err)
+		}
+		if ok, _ := PathIsExist(filepath.Join(dst, "debug.log")); ok {
+			t.Fatalf("%s: debug.log should be excluded", name)
+		}
+	}
+	dst := filepath.Join(out, "include")
+	if err := Extract(filepath.Join(out, "app.tar.gz"), dst, ArchiveOpt{Include: []string{"app/bin"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := PathIsExist(filepath.Join(dst, "app", "readme.md")); ok {
+		t.Fatal("readme.md shouldn't be included")
+	}
+	if err := CreateArchive(filepath.Join(out, "app.tar.bz2"), []string{src}, ArchiveOpt{}); err == nil {
+		t.Fatal("creating tar.bz2 should fail")
+	}
+}
+
+func TestArchiveBzip2(t *testing.T) {
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		t.Skip("bzip2 not found")
+	}
+	out := t.TempDir()
+	file := filepath.Join(out, "app.tar")
+	if err := CreateArchive(file, []string{newArchiveTree(t)}, ArchiveOpt{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("bzip2", file).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if format, err := DetectArchive(file + ".bz2"); err != nil || format != ArchiveTarBz2 {
+		t.Fatal(format, err)
+	}
+	if err := Extract(file+".bz2", filepath.Join(out, "app"), ArchiveOpt{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveUnsafe(t *testing.T) {
+	out := t.TempDir()
+	for i, hdrs := range [][]*tar.Header{
+		{{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "/etc/evil", Typeflag: tar.TypeReg, Mode: 0644}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../"}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../../evil"}},
+	} {
+		file := filepath.Join(out, fmt.Sprintf("%d.tar", i))
+		fp, _ := os.Create(file)
+		tw := tar.NewWriter(fp)
+		for _, hdr := range hdrs {
+			tw.WriteHeader(hdr)
+		}
+		tw.Close()
+		fp.Close()
+		err := Extract(file, filepath.Join(out, "dst"), ArchiveOpt{})
+		if !errors.Is(err, ErrUnsafeEntry) {
+			t.Fatalf("%s: expected unsafe entry, got %v", hdrs[0].Name, err)
+		}
+		fmt.Println(err)
+	}
+	file := filepath.Join(out, "slip.zip")
+	fp, _ := os.Create(file)
+	zw := zip.NewWriter(fp)
+	w, _ := zw.Create("a/../../evil")
+	w.Write([]byte("evil"))
+	zw.Close()
+	fp.Close()
+	if err := Unzip(file, filepath.Join(out, "dst")); !errors.Is(err, ErrUnsafeEntry) {
+		t.Fatalf("expected unsafe entry, got %v", err)
+	}
+	if ok, _ := PathIsExist(filepath.Join(out, "evil")); ok {
+		t.Fatal("evil shouldn't be written")
+	}
+}
+
+func TestArchiveSymlinkChain(t *testing.T) {
+	out := t.TempDir()
+	secret := filepath.Join(out, "secret.txt")
+	os.WriteFile(secret, []byte("secret"), 0644)
+	for i, hdrs := range [][]*tar.Header{
+		{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "a/x", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "a/x/secret.txt"},
+		},
+		{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/.."},
+		},
+		{
+			{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "c/.."},
+			{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+		{
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "data"},
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "l"},
+		},
+	} {
+		file := filepath.Join(out, fmt.Sprintf("%d.tar", i))
+		fp, _ := os.Create(file)
+		tw := tar.NewWriter(fp)
+		for _, hdr := range hdrs {
+			tw.WriteHeader(hdr)
+		}
+		tw.Close()
+		fp.Close()
+		dst := filepath.Join(out, fmt.Sprintf("dst%d", i))
+		err := Extract(file, dst, ArchiveOpt{})
+		if !errors.Is(err, ErrUnsafeEntry) {
+			t.Fatalf("%d: expected unsafe entry, got %v", i, err)
+		}
+		fmt.Println(err)
+		for _, name := range []string{"a", "b", "c", "x", "l"} {
+			if real, err := filepath.EvalSymlinks(filepath.Join(dst, name)); err == nil && !pathInside(dst, real) {
+				t.Fatalf("%d: %s escapes to %s", i, name, real)
+			}
+		}
+	}
+	if raw, _ := os.ReadFile(secret); string(raw) != "secret" {
+		t.Fatal("secret is changed")
+	}
+	file := filepath.Join(out, "links.tar")
+	fp, _ := os.Create(file)
+	tw := tar.NewWriter(fp)
+	tw.WriteHeader(&tar.Header{Name: "dir/f", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	tw.Write([]byte("f"))
+	tw.WriteHeader(&tar.Header{Name: "g", Typeflag: tar.TypeLink, Linkname: "dir/f"})
+	tw.WriteHeader(&tar.Header{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "dir/../g"})
+	tw.Close()
+	fp.Close()
+	dst := filepath.Join(out, "links")
+	if err := Extract(file, dst, ArchiveOpt{}); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile(filepath.Join(dst, "s")); string(raw) != "f" {
+		t.Fatalf("invalid content %q", raw)
+	}
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is the builder of process, which passes argv to process as it is
+// rather than splitting string, so that arguments containing spaces or quotes aren't broken.
+//
+//	res, err := NewCommand("git", "commit", "-m", "fix: a b").Dir(repo).Timeout(time.Minute).Run(ctx)
+type Command struct {
+	argv     []string
+	dir      string
+	env      map[string]string
+	stdin    io.Reader
+	timeout  time.Duration
+	onStdout func(string)
+	onStderr func(string)
+}
+
+// CommandResult is the result of process
+type CommandResult struct {
+	// Code is the exit code of process, and it's -1 when process isn't started or is killed
+	Code   int
+	Stdout []byte
+	Stderr []byte
+}
+
+// NewCommand to create command with name and arguments
+func NewCommand(name string, args ...string) *Command {
+	return &Command{argv: append([]string{name}, args...), env: make(map[string]string)}
+}
+
+// NewShellCommand to create command executing script by shell of platform.
+// windows 10+ -> powershell, other windows -> cmd, others -> /bin/sh
+func NewShellCommand(script string) *Command {
+	argv := shellArgv(script)
+	return NewCommand(argv[0], argv[1:]...)
+}
+
+// SplitArgs splits command line by spaces like shell, and quoted or escaped spaces are kept.
+// Characters of shell such as ; | $() aren't interpreted.
+//
+//	SplitArgs(`git commit -m "fix: a b"`) -> [git commit -m fix: a b]
+func SplitArgs(s string) ([]string, error) {
+	args := []string{}
+	var (
+		cur     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\\' && CurPlatform.OS != "windows":
+			escaped, inArg = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+func shellArgv(script string) []string {
+	switch CurPlatform.OS {
+	case "windows":
+		switch CurPlatform.Ver {
+		case "10", "11":
+			return []string{"powershell", "-NoProfile", "-Command", script}
+		default:
+			return []string{"cmd", "/C", script}
+		}
+	}
+	return []string{"/bin/sh", "-c", script}
+}
+
+// Args returns argv of command
+func (c *Command) Args() []string {
+	return append([]string{}, c.argv...)
+}
+
+// Dir sets the working directory of process
+func (c *Command) Dir(dir string) *Command {
+	c.dir = dir
+	return c
+}
+
+// Env overlays environment variable on the environment of current process
+func (c *Command) Env(key, value string) *Command {
+	c.env[key] = value
+	return c
+}
+
+// Stdin sets the standard input of process
+func (c *Command) Stdin(r io.Reader) *Command {
+	c.stdin = r
+	return c
+}
+
+// Timeout kills process when it doesn't exit in d
+func (c *Command) Timeout(d time.Duration) *Command {
+	c.timeout = d
+	return c
+}
+
+// OnStdout is called with every line of stdout without line break, which runs on other goroutine
+func (c *Command) OnStdout(fn func(line string)) *Command {
+	c.onStdout = fn
+	return c
+}
+
+// OnStderr is called with every line of stderr without line break, which runs on other goroutine
+func (c *Command) OnStderr(fn func(line string)) *Command {
+	c.onStderr = fn
+	return c
+}
+
+// Run to start process and wait for it. The process group is killed when ctx is done or timeout,
+// and the error of ctx is returned. Non-zero exit code isn't error, which is set into result.
+func (c *Command) Run(ctx context.Context) (*CommandResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, c.argv[0], c.argv[1:]...)
+	cmd.Dir = c.dir
+	cmd.Stdin = c.stdin
+	if len(c.env) > 0 {
+		keys := make([]string, 0, len(c.env))
+		for k := range c.env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cmd.Env = os.Environ()
+		for _, k := range keys {
+			cmd.Env = append(cmd.Env, k+"="+c.env[k])
+		}
+	}
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd.Process)
+	}
+	// don't wait for pipes held by orphaned descendants forever
+	cmd.WaitDelay = time.Second
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	outLines, errLines := newLineWriter(c.onStdout), newLineWriter(c.onStderr)
+	cmd.Stdout = io.MultiWriter(stdout, outLines)
+	cmd.Stderr = io.MultiWriter(stderr, errLines)
+	res := &CommandResult{Code: -1}
+	err := cmd.Run()
+	outLines.flush()
+	errLines.flush()
+	res.Stdout, res.Stderr = stdout.Bytes(), stderr.Bytes()
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	exitErr := &exec.ExitError{}
+	if err != nil && !errors.As(err, &exitErr) {
+		return res, err
+	}
+	res.Code = cmd.ProcessState.ExitCode()
+	return res, nil
+}
+
+// lineWriter splits written data into lines, and calls fn with every line
+type lineWriter struct {
+	mutex sync.Mutex
+	fn    func(string)
+	buf   []byte
+}
+
+func newLineWriter(fn func(string)) *lineWriter {
+	return &lineWriter{fn: fn}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.fn == nil {
+		return len(p), nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush calls fn with the last line without line break
+func (w *lineWriter) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.fn != nil && len(w.buf) > 0 {
+		w.fn(string(bytes.TrimSuffix(w.buf, []byte("\r"))))
+	}
+	w.buf = nil
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	if CurPlatform.OS == "windows" {
+		t.Skip("sh isn't available")
+	}
+	lines := []string{}
+	res, err := NewCommand("sh", "-c", `echo "$GREETING"; echo "$1" >&2; cat; exit 3`, "sh", "a  b").
+		Env("GREETING", "hello world").
+		Stdin(strings.NewReader("from stdin")).
+		OnStdout(func(line string) { lines = append(lines, line) }).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(res.Code, string(res.Stdout), string(res.Stderr), lines)
+	if res.Code != 3 || string(res.Stderr) != "a  b\n" || len(lines) != 2 || lines[1] != "from stdin" {
+		t.Fatal("unexpected result")
+	}
+	start := time.Now()
+	_, err = NewShellCommand("sleep 5 & sleep 5").Timeout(100 * time.Millisecond).Run(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 3*time.Second {
+		t.Fatal("process group should be killed", err)
+	}
+	out, _ := ExecStr(`echo "a   b"`)
+	if string(out) != "a   b\n" {
+		t.Fatal("quoted argument is broken")
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for s, want := range map[string][]string{
+		`git commit -m "fix: a b"`:  {"git", "commit", "-m", "fix: a b"},
+		`echo 'a "b"' c\ d ""`:      {"echo", `a "b"`, "c d", ""},
+		`echo a; rm -rf $(pwd) | x`: {"echo", "a;", "rm", "-rf", "$(pwd)", "|", "x"},
+	} {
+		args, err := SplitArgs(s)
+		if err != nil || strings.Join(args, ",") != strings.Join(want, ",") || len(args) != len(want) {
+			t.Fatalf("%s: want %q, got %q %v", s, want, args, err)
+		}
+	}
+	if _, err := SplitArgs(`echo "a`); err == nil {
+		t.Fatal("unterminated quote should fail")
+	}
+}
+
+func TestExecWithoutShell(t *testing.T) {
+	if CurPlatform.OS == "windows" {
+		t.Skip("echo isn't executable")
+	}
+	out, err := Exec("echo", "a  b", "; echo injected", "$(echo x)")
+	if err != nil || string(out) != "a  b ; echo injected $(echo x)\n" {
+		t.Fatalf("%q %v", out, err)
+	}
+	out, err = ExecStr(`echo "a  b" ; $(echo x)`)
+	if err != nil || string(out) != "a  b ; $(echo x)\n" {
+		t.Fatalf("%q %v", out, err)
+	}
+}
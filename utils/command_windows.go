@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup starts process in new process group, so that its children could be killed together
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup kills the tree of process by taskkill, because windows hasn't kill of group
+func killProcessGroup(p *os.Process) error {
+	if p == nil {
+		return nil
+	}
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run(); err != nil {
+		return p.Kill()
+	}
+	return nil
+}
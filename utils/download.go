@@ -0,0 +1,393 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DownloadOpt is the option of Download
+type DownloadOpt struct {
+	// Mirrors are tried in order when the url fails
+	Mirrors []string
+	// Checksum is the expected digest, such as sha256:<hex> or md5:<hex>.
+	// The algorithm of bare hex is inferred by length.
+	Checksum string
+	// Retries is the number of retries for every source, it defaults to 2 and -1 disables retry
+	Retries int
+	// Backoff is the delay before first retry, which is doubled for every retry. It defaults to 500ms
+	Backoff time.Duration
+	// CacheDir is the content-addressed cache keyed by checksum, which is only used when Checksum is set
+	CacheDir string
+	// Header is sent with every request
+	Header http.Header
+	// Client defaults to the client whose response header timeout is 30s
+	Client *http.Client
+	// Progress is called when data is received, and it's called at most every 100ms except the last one
+	Progress func(DownloadProgress)
+}
+
+// DownloadProgress is the progress of Download, which could be passed to progress bar of components
+type DownloadProgress struct {
+	URL        string
+	Downloaded int64
+	// Total is -1 when server doesn't tell length of content
+	Total   int64
+	Attempt int
+	Done    bool
+}
+
+// Percent returns the progress in [0, 1], and it's 0 when total is unknown
+func (p DownloadProgress) Percent() float64 {
+	if p.Total <= 0 {
+		if p.Done {
+			return 1
+		}
+		return 0
+	}
+	return float64(p.Downloaded) / float64(p.Total)
+}
+
+// DownloadResult is the result of Download
+type DownloadResult struct {
+	Path string
+	Size int64
+	// URL is the source of file, and it's empty when file is copied from cache
+	URL    string
+	Cached bool
+	// SHA256 is the hex digest of file
+	SHA256 string
+}
+
+// HTTPStatusError is returned when server responds with unexpected status
+type HTTPStatusError struct {
+	URL  string
+	Code int
+}
+
+func (err *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d %s", err.URL, err.Code, http.StatusText(err.Code))
+}
+
+// ChecksumError is returned when digest of downloaded file doesn't match expected one
+type ChecksumError struct {
+	URL      string
+	Algo     string
+	Expected string
+	Actual   string
+}
+
+func (err *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: %s mismatch, expected %s, got %s", err.URL, err.Algo, err.Expected, err.Actual)
+}
+
+var defaultDownloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+	},
+}
+
+// Download to fetch url into dst, and mirrors are tried in order when url fails.
+// Received data is kept in dst.part, so that it's resumed by HTTP range when retrying or downloading again.
+// The file is verified by checksum before it's renamed to dst, and it's stored in cache when CacheDir is set.
+func Download(ctx context.Context, url, dst string, opt DownloadOpt) (*DownloadResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opt.Retries == 0 {
+		opt.Retries = 2
+	} else if opt.Retries < 0 {
+		opt.Retries = 0
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = 500 * time.Millisecond
+	}
+	if opt.Client == nil {
+		opt.Client = defaultDownloadClient
+	}
+	algo, digest, err := parseChecksum(opt.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return nil, err
+	}
+	cache := ""
+	if len(opt.CacheDir) > 0 && len(algo) > 0 {
+		cache = filepath.Join(opt.CacheDir, algo, digest[:2], digest)
+		if res, ok := downloadFromCache(cache, dst, algo, digest); ok {
+			if opt.Progress != nil {
+				opt.Progress(DownloadProgress{Downloaded: res.Size, Total: res.Size, Done: true})
+			}
+			return res, nil
+		}
+	}
+	part := dst + ".part"
+	errs := []error{}
+	for _, src := range append([]string{url}, opt.Mirrors...) {
+		backoff := opt.Backoff
+		var err error
+		for attempt := 1; attempt <= opt.Retries+1; attempt++ {
+			if err = fetchPart(ctx, src, part, attempt, opt); err == nil {
+				err = verifyFile(part, src, algo, digest)
+			}
+			if err == nil || ctx.Err() != nil || !retryable(err) || attempt > opt.Retries {
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff *= 2
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Rename(part, dst); err != nil {
+			return nil, err
+		}
+		os.Remove(part + ".validator")
+		res, err := fileResult(dst)
+		if err != nil {
+			return nil, err
+		}
+		res.URL = src
+		if len(cache) > 0 {
+			// the cache is only an optimization, so error of writing it is ignored
+			if err := os.MkdirAll(filepath.Dir(cache), os.ModePerm); err == nil {
+				if err := CopyFile(dst, cache+".tmp"); err == nil {
+					os.Rename(cache+".tmp", cache)
+				}
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("download %s: %w", url, errors.Join(errs...))
+}
+
+// parseChecksum returns algorithm and lower hex digest, and both are empty when checksum is empty
+func parseChecksum(checksum string) (string, string, error) {
+	if len(checksum) == 0 {
+		return "", "", nil
+	}
+	algo, digest, ok := strings.Cut(checksum, ":")
+	if !ok {
+		digest = checksum
+		switch len(digest) {
+		case 64:
+			algo = "sha256"
+		case 32:
+			algo = "md5"
+		}
+	}
+	algo, digest = strings.ToLower(algo), strings.ToLower(digest)
+	want := map[string]int{"sha256": 64, "md5": 32}[algo]
+	if _, err := hex.DecodeString(digest); err != nil || want == 0 || len(digest) != want {
+		return "", "", fmt.Errorf("invalid checksum %q", checksum)
+	}
+	return algo, digest, nil
+}
+
+func newHash(algo string) hash.Hash {
+	if algo == "md5" {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// fileDigest returns hex digest of file by algorithm
+func fileDigest(file, algo string) (string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := newHash(algo)
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyFile removes file when its digest doesn't match, so that it's downloaded from scratch when retrying
+func verifyFile(file, url, algo, digest string) error {
+	if len(algo) == 0 {
+		return nil
+	}
+	actual, err := fileDigest(file, algo)
+	if err != nil {
+		return err
+	}
+	if actual != digest {
+		os.Remove(file)
+		return &ChecksumError{URL: url, Algo: algo, Expected: digest, Actual: actual}
+	}
+	return nil
+}
+
+func fileResult(file string) (*DownloadResult, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileDigest(file, "sha256")
+	if err != nil {
+		return nil, err
+	}
+	return &DownloadResult{Path: file, Size: info.Size(), SHA256: sum}, nil
+}
+
+// downloadFromCache copies cached file into dst when it's valid, and invalid file is evicted
+func downloadFromCache(cache, dst, algo, digest string) (*DownloadResult, bool) {
+	if ok, _ := PathIsExist(cache); !ok {
+		return nil, false
+	}
+	if err := verifyFile(cache, cache, algo, digest); err != nil {
+		return nil, false
+	}
+	if err := CopyFile(cache, dst); err != nil {
+		return nil, false
+	}
+	res, err := fileResult(dst)
+	if err != nil {
+		return nil, false
+	}
+	res.Cached = true
+	return res, true
+}
+
+// retryable returns whether error is transient, and client error of http except 408 and 429 isn't retried
+func retryable(err error) bool {
+	statusErr := &HTTPStatusError{}
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusRequestTimeout || statusErr.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// fetchPart appends the rest of url into part by range request.
+// Part is only resumed when the validator saved with it is sent by If-Range, or checksum is set to verify it,
+// otherwise it's downloaded from scratch so that stale data isn't spliced into new content.
+func fetchPart(ctx context.Context, url, part string, attempt int, opt DownloadOpt) error {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	validator := ""
+	if raw, err := os.ReadFile(part + ".validator"); err == nil {
+		validator = string(raw)
+	}
+	if offset > 0 && len(validator) == 0 && len(opt.Checksum) == 0 {
+		offset = 0
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range opt.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if len(validator) > 0 {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+	res, err := opt.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	flag := os.O_CREATE | os.O_WRONLY
+	switch {
+	case res.StatusCode == http.StatusPartialContent && offset > 0:
+		flag |= os.O_APPEND
+	case res.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// part has been completed, which matches the validator or is verified by checksum
+		return nil
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		flag |= os.O_TRUNC
+		offset = 0
+		if err := saveValidator(part, res.Header); err != nil {
+			return err
+		}
+	default:
+		return &HTTPStatusError{URL: url, Code: res.StatusCode}
+	}
+	fp, err := os.OpenFile(part, flag, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	progress := DownloadProgress{URL: url, Downloaded: offset, Total: -1, Attempt: attempt}
+	if res.ContentLength >= 0 {
+		progress.Total = offset + res.ContentLength
+	}
+	var w io.Writer = fp
+	if opt.Progress != nil {
+		w = &progressWriter{w: fp, progress: progress, fn: opt.Progress}
+	}
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return err
+	}
+	if pw, ok := w.(*progressWriter); ok {
+		pw.progress.Done = true
+		pw.fn(pw.progress)
+	}
+	return nil
+}
+
+// saveValidator saves strong ETag or Last-Modified of response next to part for If-Range,
+// and it's removed when response hasn't validator.
+func saveValidator(part string, header http.Header) error {
+	validator := header.Get("ETag")
+	if strings.HasPrefix(validator, "W/") {
+		// weak ETag can't be used by If-Range
+		validator = ""
+	}
+	if len(validator) == 0 {
+		validator = header.Get("Last-Modified")
+	}
+	if len(validator) == 0 {
+		if err := os.Remove(part + ".validator"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(part+".validator", []byte(validator), 0666)
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress DownloadProgress
+	fn       func(DownloadProgress)
+	last     time.Time
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.progress.Downloaded += int64(n)
+	if now := time.Now(); now.Sub(pw.last) >= 100*time.Millisecond {
+		pw.last = now
+		pw.fn(pw.progress)
+	}
+	return n, err
+}
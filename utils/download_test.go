@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("cushion"), 10000)
+	sum := sha256.Sum256(content)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	var requests, ranges, failures int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		case "/flaky":
+			if atomic.AddInt32(&failures, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if r.URL.Path == "/etag" {
+			w.Header().Set("ETag", `"v2"`)
+		}
+		if len(r.Header.Get("Range")) > 0 {
+			atomic.AddInt32(&ranges, 1)
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	opt := DownloadOpt{Checksum: checksum, Backoff: time.Millisecond, CacheDir: filepath.Join(dir, "cache")}
+
+	// resume from part
+	dst := filepath.Join(dir, "resume.bin")
+	os.WriteFile(dst+".part", content[:1000], 0666)
+	last := DownloadProgress{}
+	opt.Progress = func(p DownloadProgress) { last = p }
+	res, err := Download(context.Background(), srv.URL+"/file", dst, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(res, last)
+	if ranges != 1 || res.Size != int64(len(content)) || !last.Done || last.Percent() != 1 {
+		t.Fatal("download should be resumed")
+	}
+
+	// hit cache without request
+	requests = 0
+	res, err = Download(context.Background(), srv.URL+"/file", filepath.Join(dir, "cached.bin"), opt)
+	if err != nil || !res.Cached || requests != 0 {
+		t.Fatal("download should hit cache", err)
+	}
+
+	// fall back to mirror after 404, and retry 503
+	opt.CacheDir = ""
+	res, err = Download(context.Background(), srv.URL+"/missing", filepath.Join(dir, "mirror.bin"), DownloadOpt{
+		Mirrors:  []string{srv.URL + "/flaky"},
+		Checksum: checksum,
+		Backoff:  time.Millisecond,
+	})
+	if err != nil || res.URL != srv.URL+"/flaky" || failures != 3 {
+		t.Fatal("download should fall back to mirror", err)
+	}
+
+	// checksum mismatch
+	_, err = Download(context.Background(), srv.URL+"/file", filepath.Join(dir, "bad.bin"), DownloadOpt{
+		Checksum: "md5:00000000000000000000000000000000",
+		Retries:  -1,
+	})
+	checksumErr := &ChecksumError{}
+	if !errors.As(err, &checksumErr) {
+		t.Fatal("checksum should mismatch", err)
+	}
+	if ok, _ := PathIsExist(filepath.Join(dir, "bad.bin")); ok {
+		t.Fatal("file shouldn't be kept when checksum mismatches")
+	}
+
+	// stale part is discarded without checksum or validator, and server sends full content when validator mismatches
+	for validator, want := range map[string]int32{"": 0, `"v1"`: 1, `"v2"`: 1} {
+		ranges = 0
+		dst := filepath.Join(dir, "stale.bin")
+		os.WriteFile(dst+".part", []byte("stale"), 0666)
+		os.Remove(dst + ".part.validator")
+		if len(validator) > 0 {
+			os.WriteFile(dst+".part.validator", []byte(validator), 0666)
+			os.WriteFile(dst+".part", content[:1000], 0666)
+			if validator != `"v2"` {
+				os.WriteFile(dst+".part", []byte("stale"), 0666)
+			}
+		}
+		if _, err := Download(context.Background(), srv.URL+"/etag", dst, DownloadOpt{}); err != nil {
+			t.Fatal(err)
+		}
+		if raw, _ := os.ReadFile(dst); !bytes.Equal(raw, content) || ranges != want {
+			t.Fatalf("validator %q: stale part is spliced, ranges %d", validator, ranges)
+		}
+	}
+}
@@ -29,8 +29,12 @@ type EnvVar interface {
 	Print()
 }
 
+// EnvVarLoadOpt is the option of EnvVar.Load
 type EnvVarLoadOpt struct {
-	file string
-	keys []string
-	safe bool
+	// File is exported by EnvVar.Export
+	File string
+	// Keys to be loaded, which only works for posix
+	Keys []string
+	// Safe to skip existed keys
+	Safe bool
 }
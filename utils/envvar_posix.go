@@ -22,26 +22,25 @@ func NewEnvVar() *PosixEnvVar {
 // SetPath set operate target: posix: /etc/enviroment, this only is empty method.
 func (env *PosixEnvVar) SetPath(path string) error { return nil }
 
-// set global enviroment variable
+// set global enviroment variable. posix hasn't global enviroment like registry of windows,
+// so it's set into current process and inherited by children, and []string is joined by :
 func (env *PosixEnvVar) Set(k string, v any) error {
-	if _, err := Exec("export", fmt.Sprintf("%s=%s", k, v)); err != nil {
-		return err
-	}
-	return nil
+	return os.Setenv(k, posixEnvValue(v))
 }
 
 // set global enviroment variable when key isn't exist
 func (env *PosixEnvVar) SafeSet(k string, v any) error {
-	vv, err := Exec("echo", "$"+k)
-	if err != nil {
-		return err
+	if _, ok := os.LookupEnv(k); ok {
+		return nil
 	}
-	if string(vv) != "\n" {
-		if _, err := Exec("export", fmt.Sprintf("%s=%s", k, v)); err != nil {
-			return err
-		}
+	return env.Set(k, v)
+}
+
+func posixEnvValue(v any) string {
+	if vv, ok := v.([]string); ok {
+		return strings.Join(vv, string(os.PathListSeparator))
 	}
-	return nil
+	return fmt.Sprint(v)
 }
 
 // set local enviroment variable
@@ -66,10 +65,7 @@ func (env *PosixEnvVar) SafeSetL(k, v string) error {
 
 // unset (delete) global enviroment variable
 func (env *PosixEnvVar) Unset(k string) error {
-	if _, err := Exec("unset", k); err != nil {
-		return err
-	}
-	return nil
+	return os.Unsetenv(k)
 }
 
 // export current enviroment string into specify file
@@ -87,22 +83,30 @@ func (env *PosixEnvVar) Export(file string) error {
 	return WriteFile(file, raw)
 }
 
-// load exported env from disk
+// load exported env from disk, and all keys are loaded when Keys is empty
 func (env *PosixEnvVar) Load(opt EnvVarLoadOpt) error {
-	raw, err := ReadStraemFromFile(opt.file)
+	raw, err := ReadStraemFromFile(opt.File)
 	if err != nil {
 		return err
 	}
 	dict := make(map[string]string)
-	if json.Unmarshal(raw, &dict) != nil {
+	if err := json.Unmarshal(raw, &dict); err != nil {
 		return err
 	}
-	for _, k := range opt.keys {
+	keys := opt.Keys
+	if len(keys) == 0 {
+		for k := range dict {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
 		if v, ok := dict[k]; ok {
-			if opt.safe {
-				env.SafeSet(k, v)
-			} else {
-				env.Set(k, v)
+			set := env.Set
+			if opt.Safe {
+				set = env.SafeSet
+			}
+			if err := set(k, v); err != nil {
+				return err
 			}
 		}
 	}
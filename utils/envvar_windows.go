@@ -131,7 +131,7 @@ func (env *WinEnvVar) Export(file string) error {
 // load exported env from disk
 func (env *WinEnvVar) Load(opt EnvVarLoadOpt) error {
 	env.self.LoadEnvVar(WinEnvVarLoadOpt{
-		File: opt.file,
+		File: opt.File,
 		Spec: env.mode,
 	})
 	return nil
@@ -3,11 +3,11 @@ package utils
 import (
 	"archive/zip"
 	"bufio"
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"io/fs"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -33,144 +33,155 @@ func OpenConfFromPath(path string, opts ...viper.Option) *viper.Viper {
 	return conf
 }
 
-// Zip to compress zip of source to specify path
+// Zip to compress zip of source to specify path, see CreateArchive
 func Zip(zipPath string, paths ...string) error {
-	if err := os.MkdirAll(filepath.Dir(zipPath), os.ModePerm); err != nil {
-		return err
-	}
-	archive, err := os.Create(zipPath)
-	if err != nil {
-		return err
-	}
-	defer archive.Close()
-	zipWriter := zip.NewWriter(archive)
-	defer zipWriter.Close()
-	// traverse the file or directory
-	for _, srcPath := range paths {
-		// remove the trailing path separator if path is a directory
-		srcPath = strings.TrimSuffix(srcPath, string(os.PathSeparator))
-
-		// visit all the files or directories in the tree
-		err = filepath.Walk(srcPath, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			// create a local file header
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return err
-			}
+	return CreateArchive(zipPath, paths, ArchiveOpt{Format: ArchiveZip})
+}
 
-			// set compression
-			header.Method = zip.Deflate
+// OpenZip opens zip of source to read files without extracting, and it's also a fs.FS
+func OpenZip(src string) (*zip.ReadCloser, error) {
+	return zip.OpenReader(src)
+}
 
-			// set relative path of a file as the header name
-			header.Name, err = filepath.Rel(filepath.Dir(srcPath), path)
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				header.Name += string(os.PathSeparator)
-			}
+// Unzip unzip zip of source to specify path, and entries escaping dst are rejected, see Extract
+func Unzip(src, dst string) error {
+	return Extract(src, dst, ArchiveOpt{})
+}
 
-			// create writer for the file header and save content of the file
-			headerWriter, err := zipWriter.CreateHeader(header)
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			_, err = io.Copy(headerWriter, f)
-			return err
-		})
-		if err != nil {
-			return err
-		}
+// MoveFile move file from src to dst, like mv or move command.
+// It renames file at first, and copies file then removes src when they're on different devices.
+func MoveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
 	}
-	return nil
+	return moveByCopy(src, dst)
 }
 
-// Unzip unzip zip of source to specify path
-func Unzip(src, dst string) error {
-	reader, err := zip.OpenReader(src)
+// moveByCopy copies file with its permission then removes src, and symbolic link is recreated as link
+func moveByCopy(src, dst string) error {
+	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
-	for _, file := range reader.File {
-		if err := unzipFile(file, dst); err != nil {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		// the link is moved rather than the file it points to
+		link, err := os.Readlink(src)
+		if err != nil {
 			return err
 		}
-	}
-	return nil
-}
-
-func unzipFile(file *zip.File, dstDir string) error {
-	filePath := path.Join(dstDir, file.Name)
-	if file.FileInfo().IsDir() {
-		if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		return nil
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+		return os.Remove(src)
 	}
-	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+	if err := CopyFile(src, dst); err != nil {
 		return err
 	}
-	rc, err := file.Open()
+	return os.Remove(src)
+}
+
+// Move move file or directory from src to dst, and directory is copied then removed
+// when it couldn't be renamed, such as src and dst are on different devices.
+func Move(src, dst string) error {
+	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
-	defer rc.Close()
-	w, err := os.Create(filePath)
-	if err != nil {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
 		return err
 	}
-	defer w.Close()
-	_, err = io.Copy(w, rc)
-	return err
+	if !info.IsDir() {
+		return MoveFile(src, dst)
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := CopyDir(src, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
 }
 
-// MoveFile move file from src to dst, like mv or move command
-func MoveFile(src, dst string) error {
-	inputFile, err := os.Open(src)
+// CopyFile copy file from src to dst with the same permission, and parent of dst is created when it isn't exist
+func CopyFile(src, dst string) error {
+	info, err := os.Stat(src)
 	if err != nil {
-		return fmt.Errorf("couldn't open source file: %s", err)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
 	}
-	outputFile, err := os.Create(dst)
+	in, err := os.Open(src)
 	if err != nil {
-		inputFile.Close()
-		return fmt.Errorf("couldn't open dest file: %s", err)
+		return err
 	}
-	defer outputFile.Close()
-	_, err = io.Copy(outputFile, inputFile)
-	inputFile.Close()
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
 	if err != nil {
-		return fmt.Errorf("writing to output file failed: %s", err)
+		return err
 	}
-	return nil
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
 }
 
-// FetchFile fetch file from remote source to local destination
-func FetchFile(src, dst string) (int64, error) {
-	file, err := os.OpenFile(dst, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+// CopyDir recurse to copy directory from src to dst, and symbolic links are copied as links
+func CopyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return CopyFile(path, target)
+	})
+}
+
+// Copy copy file or directory from src to dst
+func Copy(src, dst string) error {
+	info, err := os.Stat(src)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if info.IsDir() {
+		return CopyDir(src, dst)
 	}
-	defer file.Close()
-	res, err := http.Get(src)
+	return CopyFile(src, dst)
+}
+
+// FetchFile fetch file from remote source to local destination with default option of Download,
+// and it returns the size of file.
+func FetchFile(src, dst string) (int64, error) {
+	res, err := Download(context.Background(), src, dst, DownloadOpt{})
 	if err != nil {
 		return 0, err
 	}
-	defer res.Body.Close()
-	n, err := io.Copy(file, res.Body)
-	return n, err
+	return res.Size, nil
 }
 
 // Mkdirs recurse to create path
@@ -200,40 +211,22 @@ func SafeBatchMkdirs(dirs []string) error {
 	return nil
 }
 
-// Exec automatically fit in os enviroment to execute command.
-// windows 10+ -> powershell, others -> cmd;
-// linux, darwin -> /bin/bash
+// Exec executes command whose name is arg[0], and arguments are passed as they are without shell,
+// so that argument containing spaces or characters of shell isn't split or executed.
 func Exec(arg ...string) ([]byte, error) {
-	switch CurPlatform.OS {
-	case "windows":
-		switch CurPlatform.Ver {
-		case "10", "11":
-			out, err := exec.Command("powershell", arg...).CombinedOutput()
-			if err != nil {
-				return out, err
-			}
-			return out, nil
-		default:
-			out, err := exec.Command("cmd", append([]string{"/C"}, arg...)...).CombinedOutput()
-			if err != nil {
-				return out, err
-			}
-			return out, nil
-		}
-	case "linux", "darwin":
-		out, err := exec.Command("/bin/bash", append([]string{"/C"}, arg...)...).CombinedOutput()
-		if err != nil {
-			return out, err
-		}
-		return out, nil
-	default:
+	if len(arg) == 0 {
+		return nil, errors.New("exec: command is empty")
 	}
-	return []byte(""), nil
+	return exec.Command(arg[0], arg[1:]...).CombinedOutput()
 }
 
-// ExecStr automatically split string to string arrary, then call Exec to execute
+// ExecStr splits string into arguments by SplitArgs and executes them without shell
 func ExecStr(args string) ([]byte, error) {
-	return Exec(strings.Fields(args)...)
+	argv, err := SplitArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return Exec(argv...)
 }
 
 // WriteFile write data or create file to write data according to file
@@ -243,8 +236,50 @@ func WriteFile(file string, data []byte) error {
 		return err
 	}
 	defer fp.Close()
-	fp.Write(data)
-	return nil
+	_, err = fp.Write(data)
+	return err
+}
+
+// AppendFile append data to file, and file is created when it isn't exist
+func AppendFile(file string, data []byte) error {
+	fp, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// AtomicWriteFile write data into temporary file in the same directory, and then rename it to file,
+// so that readers never observe partial content. The permission of existed file is kept.
+func AtomicWriteFile(file string, data []byte, perm fs.FileMode) error {
+	if info, err := os.Stat(file); err == nil {
+		perm = info.Mode().Perm()
+	}
+	fp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := fp.Name()
+	defer os.Remove(tmp)
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
 }
 
 // WriteFile write data or create file to write data according to file when file isn't exist
@@ -305,6 +340,86 @@ func ReadLineFromString(str string, filter func(string) string) ([]byte, error)
 	return ret, nil
 }
 
+// Glob returns files matching pattern, which supports ** to match any number of directories,
+// such as src/**/*.go. Other syntax is the same as filepath.Match.
+func Glob(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	// walk from the longest prefix without meta characters
+	base := []string{}
+	for _, part := range parts {
+		if strings.ContainsAny(part, "*?[\\") {
+			break
+		}
+		base = append(base, part)
+	}
+	root := strings.Join(base, "/")
+	if len(root) == 0 && len(base) > 0 {
+		root = "/"
+	} else if len(base) == 0 {
+		root = "."
+	}
+	parts = parts[len(base):]
+	if _, err := MatchPath(strings.Join(parts, "/"), ""); err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	err := filepath.WalkDir(filepath.FromSlash(root), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == filepath.FromSlash(root) && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(root), p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if matchSegments(parts, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// MatchPath reports whether name matches pattern, whose segments are separated by /
+// and ** matches zero or more segments. The only possible error is filepath.ErrBadPattern.
+func MatchPath(pattern, name string) (bool, error) {
+	parts := strings.Split(pattern, "/")
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return false, filepath.ErrBadPattern
+		}
+	}
+	return matchSegments(parts, strings.Split(name, "/")), nil
+}
+
+// matchSegments matches path segments with pattern segments, and ** matches zero or more segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
 // PathIsExist judge whether path exist. If exist, return true.
 func PathIsExist(path string) (bool, error) {
 	_, err := os.Stat(path)
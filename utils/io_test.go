@@ -2,6 +2,8 @@ package utils
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,3 +16,47 @@ func TestExec(t *testing.T) {
 func TestZip(t *testing.T) {
 	Zip("./Test.zip", ".")
 }
+
+func TestGlob(t *testing.T) {
+	matches, err := Glob("../runtime/**/*_test.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println(matches)
+	for _, c := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**/*.go", "io.go", true},
+		{"src/**/*.go", "src/a/b/c.go", true},
+		{"src/**", "src", true},
+		{"src/*.go", "src/a/b.go", false},
+	} {
+		if ok, _ := MatchPath(c.pattern, c.name); ok != c.want {
+			t.Fatalf("%s %s: expected %v", c.pattern, c.name, c.want)
+		}
+	}
+}
+
+func TestMoveByCopy(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "run.sh"), filepath.Join(dir, "bin", "run.sh")
+	os.WriteFile(src, []byte("echo hi"), 0755)
+	os.Symlink("run.sh", filepath.Join(dir, "link"))
+	os.MkdirAll(filepath.Join(dir, "bin"), os.ModePerm)
+	if err := moveByCopy(filepath.Join(dir, "link"), filepath.Join(dir, "bin", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "bin", "link")); err != nil || link != "run.sh" {
+		t.Fatal("link should be moved as link", link, err)
+	}
+	if err := moveByCopy(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0755 {
+		t.Fatal("permission should be kept", err)
+	}
+	if ok, _ := PathIsExist(src); ok {
+		t.Fatal("src should be removed")
+	}
+}
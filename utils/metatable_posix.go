@@ -30,7 +30,7 @@ func CreateMetaTable(path string) (MetaTable, error) {
 	return tbl, nil
 }
 
-// CreateMetaTable to open MetaTable
+// OpenMetaTable to open MetaTable
 func OpenMetaTable(path string) (MetaTable, error) {
 	if !strings.HasSuffix(path, ".plist") {
 		path += ".plist"
@@ -45,25 +45,46 @@ func OpenMetaTable(path string) (MetaTable, error) {
 	return tbl, nil
 }
 
-// GetValue return MetaValue according to key
+// dict returns the dictionary of table, and it's created when it isn't dictionary
+func (tbl *PosixMetaTable) dict() cfDictionary {
+	if tbl.parent == nil {
+		if dict, ok := tbl.fp.v.(cfDictionary); ok {
+			return dict
+		}
+		dict := cfDictionary{}
+		tbl.fp.Set(dict)
+		return dict
+	}
+	parent := tbl.parent.dict()
+	if dict, ok := parent[tbl.sub_name].(cfDictionary); ok {
+		return dict
+	}
+	dict := cfDictionary{}
+	parent[tbl.sub_name] = dict
+	return dict
+}
+
+// GetValue return MetaValue according to key, which is value decoded from plist
+// such as string, uint64, float64, bool, []byte, []any and map[string]any. It returns nil when key isn't exist.
 func (tbl *PosixMetaTable) GetValue(v string) MetaValue {
-	return tbl.fp.GetValue(v)
+	return tbl.dict()[v]
 }
 
-// SetValue set MetaTable's value,
+// SetValue set MetaTable's value, and entries of MetaMap are merged into table.
 // plist(darwin, posix): MetaValue ✔ MetaMap ✔ MetaArr ✔
 func (tbl *PosixMetaTable) SetValue(v MetaValue) {
-	if tbl.parent != nil {
-		switch vv := tbl.parent.fp.v.(type) {
-		case cfDictionary:
-			vv[tbl.sub_name] = v
-		case cfArray:
-
-		default:
-			tbl.parent.fp.Set(v)
+	switch vv := v.(type) {
+	case MetaMap:
+		dict := tbl.dict()
+		for k, v := range vv {
+			dict[k] = v
+		}
+	default:
+		if tbl.parent != nil {
+			tbl.parent.dict()[tbl.sub_name] = v
+		} else {
+			tbl.fp.Set(v)
 		}
-	} else {
-		tbl.fp.Set(v)
 	}
 }
 
@@ -72,31 +93,33 @@ func (tbl *PosixMetaTable) SetValue(v MetaValue) {
 func (tbl *PosixMetaTable) SafeSetValue(v MetaValue) {
 	switch vv := v.(type) {
 	case MetaMap:
-		tbl.fp.Set(cfDictionary{})
+		dict := tbl.dict()
 		for k, v := range vv {
-			tbl.fp.SetByField(k, any2CFValue(v))
+			if _, ok := dict[k]; !ok {
+				dict[k] = v
+			}
 		}
 	default:
-		tbl.SetValue(v)
+		if tbl.parent != nil {
+			if _, ok := tbl.parent.dict()[tbl.sub_name]; !ok {
+				tbl.parent.dict()[tbl.sub_name] = v
+			}
+		} else if tbl.fp.v == nil {
+			tbl.fp.Set(v)
+		}
 	}
 }
 
-// CreateSubTable create sub element of map or array, but not be saved automatically
+// CreateSubTable create or open sub dictionary, but not be saved automatically.
+// It shares the plist with root, so that Write of any table saves the whole plist.
 func (tbl *PosixMetaTable) CreateSubTable(name string) MetaTable {
-	dict := tbl.fp.GetDict()
-	if dict.Type() == CF_DICT {
-		sub := CFDictionary{}
-		dict.Set(name, sub)
-		return &PosixMetaTable{
-			fp: &PlistFile{
-				v:    sub,
-				file: Filename(tbl.fp.file) + "." + name,
-			},
-			parent:   tbl,
-			sub_name: name,
-		}
+	sub := &PosixMetaTable{
+		fp:       tbl.fp,
+		parent:   tbl,
+		sub_name: name,
 	}
-	return &PosixMetaTable{}
+	sub.dict()
+	return sub
 }
 
 // Write to persist MetaValue in disk.
@@ -112,7 +135,9 @@ func (tbl *PosixMetaTable) Backup() error {
 	return tbl.fp.Backup()
 }
 
-// Close to free MetaTable memory
+// Close to free MetaTable memory, and sub table doesn't close the plist of root
 func (tbl *PosixMetaTable) Close() {
-	tbl.fp.Free()
+	if tbl.parent == nil {
+		tbl.fp.Free()
+	}
 }
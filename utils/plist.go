@@ -3,6 +3,7 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"strconv"
@@ -18,25 +19,18 @@ type PlistFile struct {
 	v    any
 }
 
-// CreatePlistFile create specify plist when plist isn't exist
+// CreatePlistFile create specify plist when plist isn't exist, otherwise it opens plist
 func CreatePlistFile(file string) (*PlistFile, error) {
-	fp, err := os.Create(file)
-	if err != nil {
-		return nil, err
-	}
-	pf := &PlistFile{
-		fp:   fp,
-		file: file,
-	}
-	if err := pf.read(); err != nil {
-		return pf, err
-	}
-	return pf, err
+	return openPlistFile(file, os.O_RDWR|os.O_CREATE)
 }
 
 // OpenPlistFile open specify plist
 func OpenPlistFile(file string) (*PlistFile, error) {
-	fp, err := os.Open(file)
+	return openPlistFile(file, os.O_RDWR)
+}
+
+func openPlistFile(file string, flag int) (*PlistFile, error) {
+	fp, err := os.OpenFile(file, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -44,17 +38,35 @@ func OpenPlistFile(file string) (*PlistFile, error) {
 		fp:   fp,
 		file: file,
 	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	// empty plist is created just now
+	if info.Size() == 0 {
+		pf.v = cfDictionary{}
+		return pf, nil
+	}
 	if err := pf.read(); err != nil {
-		return pf, err
+		fp.Close()
+		return nil, err
 	}
-	return pf, err
+	return pf, nil
 }
 
 func (pf *PlistFile) read() error {
 	return plist.NewDecoder(pf.fp).Decode(&pf.v)
 }
 
+// Write to overwrite plist with current value
 func (pf *PlistFile) Write() error {
+	if err := pf.fp.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := pf.fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 	return plist.NewEncoder(pf.fp).Encode(pf.v)
 }
 